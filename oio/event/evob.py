@@ -77,6 +77,7 @@ class EventTypes(object):
     """Enum class for event type names."""
 
     ACCOUNT_SERVICES = 'account.services'
+    CHUNK_CORRUPTED = 'storage.chunk.corrupted'
     CHUNK_DELETED = 'storage.chunk.deleted'
     CHUNK_NEW = 'storage.chunk.new'
     CONTAINER_DELETED = 'storage.container.deleted'
@@ -0,0 +1,162 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Checks the signature carried by the requests, shared with the clients through
+a secret. The signature is the hexadecimal HMAC-SHA256 of the method, the
+target of the request and its time (UNIX seconds, sent in the X-oio-Timestamp
+header), separated by spaces, e.g. for an upload:
+	HMAC(secret, "PUT 0123...ABCD 1600000000")
+The target is the uppercase chunk ID, followed by the destination for a COPY,
+"list" for the listings, or "admin" for the requests on the settings. A
+signature is only accepted within a few minutes of its time.
+
+The requests whose body tells what to do, i.e. the updates of the settings
+and the bulk deletions ("delete"), also sign the hexadecimal SHA256 of their
+body, and their signature is accepted once:
+	HMAC(secret, "POST admin 1600000000 9f86...0a08")
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum gap between the time of a signature and the reception of the
+// request
+const signatureMaxAge = 5 * time.Minute
+
+var errEmptySecret = errors.New("Empty secret")
+
+type requestSigner struct {
+	secret []byte
+	// Also require a signature on the reads (GET, HEAD)
+	reads bool
+
+	// The signatures of bodies already accepted, with their expiration, so
+	// that they cannot be replayed
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+func newRequestSigner(secretFile string, reads bool) (*requestSigner, error) {
+	raw, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		return nil, err
+	}
+	secret := strings.TrimSpace(string(raw))
+	if secret == "" {
+		return nil, errEmptySecret
+	}
+	return &requestSigner{secret: []byte(secret), reads: reads}, nil
+}
+
+func (s *requestSigner) required(method string) bool {
+	switch method {
+	case "PUT", "COPY", "PATCH", "DELETE", "POST":
+		return true
+	case "GET", "HEAD", "VERIFY":
+		return s.reads
+	default:
+		return false
+	}
+}
+
+func (s *requestSigner) sign(method, target string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(method))
+	mac.Write([]byte{' '})
+	mac.Write([]byte(target))
+	return mac.Sum(nil)
+}
+
+func (s *requestSigner) signTime(method, target, timestamp string) []byte {
+	return s.sign(method, target+" "+timestamp)
+}
+
+func (s *requestSigner) signBody(method, target, timestamp string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	return s.signTime(method, target, timestamp+" "+hex.EncodeToString(digest[:]))
+}
+
+// Return the signature of the request and the time it tells, if recent
+// enough
+func signatureOf(req *http.Request, now time.Time) ([]byte, string, time.Time, bool) {
+	timestamp := req.Header.Get(HeaderNameTimestamp)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, "", time.Time{}, false
+	}
+	signed := time.Unix(ts, 0)
+	if signed.Before(now.Add(-signatureMaxAge)) || signed.After(now.Add(signatureMaxAge)) {
+		return nil, "", time.Time{}, false
+	}
+	sig, err := hex.DecodeString(req.Header.Get(HeaderNameSignature))
+	if err != nil || len(sig) <= 0 {
+		return nil, "", time.Time{}, false
+	}
+	return sig, timestamp, signed, true
+}
+
+// Tell if the request is allowed on the given target. A nil signer allows
+// everything.
+func (s *requestSigner) verify(req *http.Request, target string, now time.Time) bool {
+	if s == nil || !s.required(req.Method) {
+		return true
+	}
+	sig, timestamp, _, ok := signatureOf(req, now)
+	return ok && hmac.Equal(sig, s.signTime(req.Method, target, timestamp))
+}
+
+// Tell if the request is allowed on the given target, with the given body.
+// Unlike verify(), a nil signer allows nothing, and a signature is accepted
+// only once.
+func (s *requestSigner) verifyBody(req *http.Request, target string, body []byte, now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	sig, timestamp, signed, ok := signatureOf(req, now)
+	if !ok || !hmac.Equal(sig, s.signBody(req.Method, target, timestamp, body)) {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, expires := range s.seen {
+		if now.After(expires) {
+			delete(s.seen, k)
+		}
+	}
+	key := string(sig)
+	if _, ok := s.seen[key]; ok {
+		return false
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]time.Time)
+	}
+	s.seen[key] = signed.Add(signatureMaxAge)
+	return true
+}
@@ -0,0 +1,92 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signTestRequest(s *requestSigner, req *http.Request, target string, when time.Time) {
+	timestamp := strconv.FormatInt(when.Unix(), 10)
+	req.Header.Set(HeaderNameTimestamp, timestamp)
+	req.Header.Set(HeaderNameSignature, hex.EncodeToString(s.signTime(req.Method, target, timestamp)))
+}
+
+// The signature covers the target and the time of the request
+func TestVerifySignature(t *testing.T) {
+	s := &requestSigner{secret: []byte("secret")}
+	now := time.Now()
+	req := httptest.NewRequest("DELETE", "/"+testChunkID, nil)
+	if s.verify(req, testChunkID, now) {
+		t.Error("unsigned request allowed")
+	}
+	signTestRequest(s, req, testChunkID, now)
+	if !s.verify(req, testChunkID, now) {
+		t.Error("signed request refused")
+	}
+	if s.verify(req, strings.Repeat("0", chunkIDLength), now) {
+		t.Error("signature of another chunk accepted")
+	}
+	if s.verify(req, testChunkID, now.Add(time.Hour)) {
+		t.Error("stale signature accepted")
+	}
+	var none *requestSigner
+	if !none.verify(httptest.NewRequest("DELETE", "/"+testChunkID, nil), testChunkID, now) {
+		t.Error("request refused without secret")
+	}
+}
+
+// The signature of a bulk deletion covers its body, and cannot be replayed
+func TestBulkDeleteSignature(t *testing.T) {
+	InitNoopLogger()
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	rawx.signer = &requestSigner{secret: []byte("secret")}
+	defer func(allowed bool) { notifAllowed = allowed }(notifAllowed)
+	notifAllowed = false
+	putVerifiedChunk(t, rawx, "data", nil)
+
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	body := `["` + testChunkID + `"]`
+	sig := hex.EncodeToString(rawx.signer.signBody("POST", bulkDeleteTarget, timestamp, []byte(body)))
+	serve := func(body string) int {
+		req := httptest.NewRequest("POST", "/delete", strings.NewReader(body))
+		req.Header.Set(HeaderNameTimestamp, timestamp)
+		req.Header.Set(HeaderNameSignature, sig)
+		rec := httptest.NewRecorder()
+		(&rawxRequest{rawx: rawx, req: req, rep: rec}).serveBulkDelete()
+		return rec.Code
+	}
+
+	other := `["` + strings.Repeat("0", chunkIDLength) + `"]`
+	if code := serve(other); code != http.StatusForbidden {
+		t.Errorf("signature of another body accepted: %d", code)
+	}
+	if code := serve(body); code != http.StatusOK || rawx.repo.(*chunkRepository).sub.has(testChunkID) {
+		t.Errorf("signed deletion refused: %d", code)
+	}
+	if code := serve(body); code != http.StatusForbidden {
+		t.Errorf("replayed deletion accepted: %d", code)
+	}
+}
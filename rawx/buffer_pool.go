@@ -16,14 +16,20 @@
 
 package main
 
+import "sync"
+
 type bufferPool interface {
 	Acquire() []byte
 	Release(buf []byte)
 }
 
+// A pool of buffers of the same size. Up to max bytes of buffers are kept
+// whatever the activity, the buffers required by a burst of requests beyond
+// that amount are recycled in a sync.Pool the garbage collector may flush.
 type unisizeBufferPool struct {
-	pool chan []byte
-	size int
+	pool     chan []byte
+	overflow sync.Pool
+	size     int
 }
 
 func newBufferPool(max, size int) bufferPool {
@@ -31,7 +37,12 @@ func newBufferPool(max, size int) bufferPool {
 	if nb < 1 {
 		nb = 1
 	}
-	return &unisizeBufferPool{pool: make(chan []byte, nb), size: size}
+	p := &unisizeBufferPool{pool: make(chan []byte, nb), size: size}
+	p.overflow.New = func() interface{} {
+		buf := make([]byte, size, size)
+		return &buf
+	}
+	return p
 }
 
 func (p *unisizeBufferPool) Acquire() []byte {
@@ -39,13 +50,18 @@ func (p *unisizeBufferPool) Acquire() []byte {
 	case buf := <-p.pool:
 		return buf[:cap(buf)]
 	default:
-		return make([]byte, p.size, p.size)
+		return *(p.overflow.Get().(*[]byte))
 	}
 }
 
 func (p *unisizeBufferPool) Release(buf []byte) {
+	if cap(buf) < p.size {
+		return // not ours
+	}
+	buf = buf[:p.size]
 	select {
 	case p.pool <- buf: // reused
-	default: // freed
+	default:
+		p.overflow.Put(&buf)
 	}
 }
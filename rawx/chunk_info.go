@@ -20,10 +20,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"mime"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -46,9 +45,25 @@ type chunkInfo struct {
 	OioVersion         string `json:"oio_version,omitempty"`
 
 	compression string
+	hashAlgo    string
+	mimeType    string
 	size        int64
+
+	// Checksum computed by the rawx alone, whatever the client sent
+	secondaryHash string
+	secondaryAlgo string
+
+	// Metadata of the user, by lowercase name
+	userMeta map[string]string
 }
 
+// Prefix of the headers carrying the metadata of the user
+var userMetaPrefix = configDefaultUserMetaPrefix
+
+// Maximum size of the metadata of the user of a chunk, names and values
+// summed. 0 disables the metadata of the user.
+var userMetaMaxSize = configDefaultUserMetaMaxSize
+
 func cidFromName(account, container string) string {
 	h := sha256.New()
 	h.Write([]byte(account))
@@ -92,17 +107,102 @@ func (chunk chunkInfo) saveAttr(out decorable) error {
 		{AttrNameContentStgPol, &chunk.ContentStgPol},
 		{AttrNameOioVersion, &chunk.OioVersion},
 		{AttrNameCompression, &chunk.compression},
+		{AttrNameChunkChecksumAlgo, &chunk.hashAlgo},
+		{AttrNameContentMimeType, &chunk.mimeType},
+		{AttrNameChunkChecksumSecondary, &chunk.secondaryHash},
+		{AttrNameChunkChecksumSecondaryAlgo, &chunk.secondaryAlgo},
 	}
 	for _, hs := range detailedAttrs {
 		if err := setAttr(hs.key, *(hs.ptr)); err != nil {
 			return err
 		}
 	}
+	for k, v := range chunk.userMeta {
+		if err := out.setAttr(AttrNameUserMetaPrefix+k, []byte(v)); err != nil {
+			return err
+		}
+	}
+	if len(chunk.userMeta) > 0 {
+		if err := setAttr(AttrNameUserMetaCount, itoa(len(chunk.userMeta))); err != nil {
+			return err
+		}
+	}
 
 	// TODO(jfs): save the compression status
 	return nil
 }
 
+// Only the headers present are considered. The data of the chunk is never
+// altered, so that its hash, its size and its compression are left apart.
+func retrievePatchHeaders(headers *http.Header, chunkID string) (chunkInfo, error) {
+	var chunk chunkInfo
+
+	chunkIDHeader := headers.Get(HeaderNameChunkID)
+	if chunkIDHeader != "" && !strings.EqualFold(chunkIDHeader, chunkID) {
+		return chunk, errInvalidHeader
+	}
+	chunk.ChunkID = strings.ToUpper(chunkID)
+
+	chunk.ContentStgPol = headers.Get(HeaderNameContentStgPol)
+	chunk.ContentChunkMethod = headers.Get(HeaderNameContentChunkMethod)
+	chunk.ChunkPosition = headers.Get(HeaderNameChunkPosition)
+
+	chunk.MetachunkHash = headers.Get(HeaderNameMetachunkChecksum)
+	if chunk.MetachunkHash != "" {
+		if !isHexaString(chunk.MetachunkHash, 0) {
+			return chunk, errInvalidHeader
+		}
+		chunk.MetachunkHash = strings.ToUpper(chunk.MetachunkHash)
+	}
+	chunk.MetachunkSize = headers.Get(HeaderNameMetachunkSize)
+	if chunk.MetachunkSize != "" {
+		if _, err := strconv.ParseInt(chunk.MetachunkSize, 10, 64); err != nil {
+			return chunk, errInvalidHeader
+		}
+	}
+
+	if headers.Get(HeaderNameFullpath) != "" {
+		if err := chunk.retrieveContentFullpathHeader(headers); err != nil {
+			return chunk, err
+		}
+	}
+
+	if chunk.ContentStgPol == "" && chunk.ContentChunkMethod == "" &&
+		chunk.ChunkPosition == "" && chunk.MetachunkHash == "" &&
+		chunk.MetachunkSize == "" && chunk.ContentFullpath == "" {
+		return chunk, errMissingHeader
+	}
+	chunk.OioVersion = OioVersion
+	return chunk, nil
+}
+
+// Save the XATTR loaded by retrievePatchHeaders()
+func (chunk chunkInfo) savePatchedAttr(out decorable) error {
+	if chunk.ContentFullpath != "" {
+		if err := chunk.saveContentFullpathAttr(out); err != nil {
+			return err
+		}
+	}
+
+	var detailedAttrs = []detailedAttr{
+		{AttrNameMetachunkChecksum, &chunk.MetachunkHash},
+		{AttrNameMetachunkSize, &chunk.MetachunkSize},
+		{AttrNameChunkPosition, &chunk.ChunkPosition},
+		{AttrNameContentChunkMethod, &chunk.ContentChunkMethod},
+		{AttrNameContentStgPol, &chunk.ContentStgPol},
+		{AttrNameOioVersion, &chunk.OioVersion},
+	}
+	for _, hs := range detailedAttrs {
+		if *(hs.ptr) == "" {
+			continue
+		}
+		if err := out.setAttr(hs.key, []byte(*(hs.ptr))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func loadFullPath(getter func(string, string) (string, error), chunkID string) (chunkInfo, error) {
 	var chunk chunkInfo
 
@@ -171,8 +271,15 @@ func loadAttr(inChunk fileReader, chunkID string, reqid string) (chunkInfo, erro
 		{AttrNameChunkSize, &chunk.ChunkSize},
 		{AttrNameOioVersion, &chunk.OioVersion},
 		{AttrNameCompression, &chunk.compression},
+		{AttrNameChunkChecksumAlgo, &chunk.hashAlgo},
+		{AttrNameContentMimeType, &chunk.mimeType},
+		{AttrNameChunkChecksumSecondary, &chunk.secondaryHash},
+		{AttrNameChunkChecksumSecondaryAlgo, &chunk.secondaryAlgo},
 	}
 
+	// The missing XATTR are reported at once, on a single line
+	var missing []string
+
 	contentFullpath, err := getAttr(xattrKey(chunkID))
 	if err == nil {
 		// New chunk
@@ -196,7 +303,7 @@ func loadAttr(inChunk fileReader, chunkID string, reqid string) (chunkInfo, erro
 		_chunkID, err := getAttr(AttrNameChunkID)
 		if err != nil {
 			if err == syscall.ENODATA {
-				LogWarning(msgMissingXattr(chunkID, reqid, AttrNameChunkID, err))
+				missing = append(missing, AttrNameChunkID)
 			} else {
 				return chunk, err
 			}
@@ -220,20 +327,68 @@ func loadAttr(inChunk fileReader, chunkID string, reqid string) (chunkInfo, erro
 					(hs.key == AttrNameMetachunkChecksum || hs.key == AttrNameMetachunkSize) {
 					continue
 				}
-				LogWarning(msgMissingXattr(chunkID, reqid, hs.key, err))
+				/* chunks saved before the algorithm was configurable have no such xattr */
+				if hs.key == AttrNameChunkChecksumAlgo {
+					continue
+				}
+				/* the type and the secondary checksum are optional */
+				if hs.key == AttrNameContentMimeType || hs.key == AttrNameChunkChecksumSecondary ||
+					hs.key == AttrNameChunkChecksumSecondaryAlgo {
+					continue
+				}
+				missing = append(missing, hs.key)
 			} else {
 				return chunk, err
 			}
 		}
 	}
+	if len(missing) > 0 {
+		LogWarning(msgMissingXattr(chunkID, reqid, strings.Join(missing, ","), syscall.ENODATA))
+	}
 
 	chunk.size, err = strconv.ParseInt(chunk.ChunkSize, 10, 63)
 	if err != nil {
-		err = errMissingXattr(AttrNameChunkSize, err)
+		// The size is unknown, the caller will have to rely on the data
+		chunk.size = -1
+	}
+	if userMetaMaxSize > 0 {
+		// Only the chunks uploaded with metadata of the user are worth the
+		// listing of their XATTR
+		if _, err = getAttr(AttrNameUserMetaCount); err == nil {
+			if chunk.userMeta, err = inChunk.userMeta(); err != nil {
+				return chunk, err
+			}
+		} else if err != syscall.ENODATA {
+			return chunk, err
+		}
 	}
 	return chunk, nil
 }
 
+// Tell if the data of the chunk has been stored through a compression filter
+func (chunk chunkInfo) compressed() bool {
+	return chunk.compression != "" && chunk.compression != compressionOff
+}
+
+// Type of the content of the chunk, as declared upon its upload
+func (chunk chunkInfo) contentType() string {
+	if chunk.mimeType == "" {
+		return defaultMimeType
+	}
+	return chunk.mimeType
+}
+
+// etag returns the entity tag of the chunk, derived from the hash of its
+// clear content, or an empty string if the hash is unknown. The tag is
+// strong for the clear content, even decoded from a compressed chunk: the
+// replies of another representation must weaken it.
+func (chunk chunkInfo) etag() string {
+	if chunk.ChunkHash == "" {
+		return ""
+	}
+	return "\"" + chunk.ChunkHash + "\""
+}
+
 func msgMissingXattr(chunk, reqid, key string, cause error) string {
 	return msgErrorAction(key, reqid, cause)
 }
@@ -334,16 +489,18 @@ func retrieveDestinationHeader(headers *http.Header, rawx *rawxService, srcChunk
 	if err != nil {
 		return chunk, errInvalidHeader
 	}
+	// The copies are local to the service
 	if dstURL.Host != rawx.id && dstURL.Host != rawx.url {
-		return chunk, os.ErrPermission
+		return chunk, errForbidden
 	}
-	chunk.ChunkID = filepath.Base(filepath.Clean(dstURL.Path))
-	if !isHexaString(chunk.ChunkID, 64) {
-		return chunk, errInvalidHeader
+	// Exactly one chunk ID at the root, as in the path of the requests. The
+	// path is not cleaned: "/../<ID>" is rejected, not silently fixed.
+	if !strings.HasPrefix(dstURL.Path, "/") || !isValidChunkID(dstURL.Path[1:]) {
+		return chunk, errInvalidChunkID
 	}
-	chunk.ChunkID = strings.ToUpper(chunk.ChunkID)
+	chunk.ChunkID = strings.ToUpper(dstURL.Path[1:])
 	if chunk.ChunkID == srcChunkID {
-		return chunk, os.ErrPermission
+		return chunk, errForbidden
 	}
 	return chunk, nil
 }
@@ -399,11 +556,52 @@ func retrieveHeaders(headers *http.Header, chunkID string) (chunkInfo, error) {
 		}
 	}
 
+	chunk.mimeType = headers.Get(HeaderNameContentMimeType)
+	if chunk.mimeType != "" {
+		if _, _, err := mime.ParseMediaType(chunk.mimeType); err != nil {
+			return chunk, errInvalidHeader
+		}
+	}
+
+	var err error
+	if chunk.userMeta, err = retrieveUserMetaHeaders(headers); err != nil {
+		return chunk, err
+	}
+
 	chunk.OioVersion = OioVersion
-	err := chunk.retrieveContentFullpathHeader(headers)
+	err = chunk.retrieveContentFullpathHeader(headers)
 	return chunk, err
 }
 
+// Load the metadata of the user from the headers with the configured prefix.
+// The names are kept in lowercase, and the whole metadata is capped in size
+// since it ends up in the XATTR of the chunk, as well as each name.
+func retrieveUserMetaHeaders(headers *http.Header) (map[string]string, error) {
+	if userMetaMaxSize <= 0 {
+		return nil, nil
+	}
+	prefix := strings.ToLower(userMetaPrefix)
+	var meta map[string]string
+	total := 0
+	for k, v := range *headers {
+		name := strings.ToLower(k)
+		if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+			continue
+		}
+		name = name[len(prefix):]
+		value := strings.Join(v, ",")
+		total += len(name) + len(value)
+		if total > userMetaMaxSize || len(AttrNameUserMetaPrefix)+len(name) > xattrNameMax {
+			return nil, errHeadersTooLarge
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[name] = value
+	}
+	return meta, nil
+}
+
 // Check and load the checksum and the size of the chunk and the metachunk
 func (chunk *chunkInfo) patchWithTrailers(trailers *http.Header, ul uploadInfo) error {
 	trailerMetachunkHash := trailers.Get(HeaderNameMetachunkChecksum)
@@ -434,12 +632,22 @@ func (chunk *chunkInfo) patchWithTrailers(trailers *http.Header, ul uploadInfo)
 		}
 	}
 
+	// The hash may be sent as a header, for the clients or proxies unable to
+	// manage trailers, as a trailer, or both if they agree.
 	trailerChunkHash := trailers.Get(HeaderNameChunkChecksum)
 	if trailerChunkHash != "" {
+		if !isHexaString(trailerChunkHash, 0) {
+			return errInvalidHeader
+		}
+		if chunk.ChunkHash != "" && !strings.EqualFold(chunk.ChunkHash, trailerChunkHash) {
+			return errInvalidHeader
+		}
 		chunk.ChunkHash = strings.ToUpper(trailerChunkHash)
 	}
 	if chunk.ChunkHash != "" {
-		if !strings.EqualFold(chunk.ChunkHash, ul.hash) {
+		// The hash sent by the client, as a header or as a trailer, must match
+		// the hash computed, when it has been computed.
+		if ul.hash != "" && !strings.EqualFold(chunk.ChunkHash, ul.hash) {
 			return errInvalidHeader
 		}
 	} else {
@@ -481,13 +689,23 @@ func (chunk chunkInfo) fillHeaders(headers http.Header) {
 	setHeader(headers, HeaderNameMetachunkSize, chunk.MetachunkSize)
 	setHeader(headers, HeaderNameChunkPosition, chunk.ChunkPosition)
 	setHeader(headers, HeaderNameChunkChecksum, chunk.ChunkHash)
+	setHeader(headers, HeaderNameChunkChecksumAlgo, chunk.hashAlgo)
+	setHeader(headers, HeaderNameChunkChecksumSecondary, chunk.secondaryHash)
+	setHeader(headers, HeaderNameChunkChecksumSecondaryAlgo, chunk.secondaryAlgo)
 	setHeader(headers, HeaderNameChunkSize, chunk.ChunkSize)
 	setHeader(headers, HeaderNameXattrVersion, chunk.OioVersion)
+	for k, v := range chunk.userMeta {
+		headers.Set(userMetaPrefix+k, v)
+	}
+	headers.Set("Content-Type", chunk.contentType())
 }
 
 // Fill the headers of the reply with the chunk info calculated by the rawx
 func (chunk chunkInfo) fillHeadersLight(headers http.Header) {
 	setHeader(headers, HeaderNameChunkChecksum, chunk.ChunkHash)
+	setHeader(headers, HeaderNameChunkChecksumAlgo, chunk.hashAlgo)
+	setHeader(headers, HeaderNameChunkChecksumSecondary, chunk.secondaryHash)
+	setHeader(headers, HeaderNameChunkChecksumSecondaryAlgo, chunk.secondaryAlgo)
 	setHeader(headers, HeaderNameChunkSize, chunk.ChunkSize)
 	setHeader(headers, HeaderNameXattrVersion, chunk.OioVersion)
 }
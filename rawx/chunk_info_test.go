@@ -0,0 +1,138 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRetrieveDestinationHeader(t *testing.T) {
+	rawx := &rawxService{id: "rawx-1", url: "127.0.0.1:6010"}
+	dst := strings.Repeat("ab", 32)
+	cases := []struct {
+		destination string
+		err         error
+	}{
+		{"http://127.0.0.1:6010/" + dst, nil},
+		{"http://rawx-1/" + strings.ToUpper(dst), nil},
+		{"", errMissingHeader},
+		{"not an URL", errInvalidHeader},
+		{"http://elsewhere:6010/" + dst, errForbidden},
+		{"http://127.0.0.1:6010/" + testChunkID, errForbidden},
+		{"http://127.0.0.1:6010/", errInvalidChunkID},
+		{"http://127.0.0.1:6010/" + dst[1:], errInvalidChunkID},
+		{"http://127.0.0.1:6010/" + dst + "/", errInvalidChunkID},
+		{"http://127.0.0.1:6010/../" + dst, errInvalidChunkID},
+		{"http://127.0.0.1:6010/../../../etc/" + dst, errInvalidChunkID},
+		{"http://127.0.0.1:6010/..%2F" + dst, errInvalidChunkID},
+		{"http://127.0.0.1:6010/%2E%2E/" + dst, errInvalidChunkID},
+		{"http://127.0.0.1:6010/AB/" + dst, errInvalidChunkID},
+		{"http://127.0.0.1:6010/" + dst[:62] + "%00", errInvalidChunkID},
+		{"http://127.0.0.1:6010" + dst, errInvalidHeader},
+	}
+	for _, c := range cases {
+		h := http.Header{}
+		h.Set("Destination", c.destination)
+		chunk, err := retrieveDestinationHeader(&h, rawx, testChunkID)
+		if err != c.err {
+			t.Errorf("%q: expected %v, got %v", c.destination, c.err, err)
+		} else if err == nil && chunk.ChunkID != strings.ToUpper(dst) {
+			t.Errorf("%q: unexpected chunk ID %s", c.destination, chunk.ChunkID)
+		}
+	}
+}
+
+func TestUserMeta(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+
+	h := http.Header{}
+	h.Set("X-oio-Meta-Color", "blue")
+	h.Set("X-Oio-Meta-", "no name")
+	h.Set(HeaderNameChunkPosition, "0")
+	meta, err := retrieveUserMetaHeaders(&h)
+	if err != nil || len(meta) != 1 || meta["color"] != "blue" {
+		t.Fatalf("unexpected metadata %v: %v", meta, err)
+	}
+
+	// Saved as XATTR, then sent back with the attributes of the chunk
+	out, err := rawx.repo.put(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := chunkInfo{ChunkID: testChunkID, ContentFullpath: "a/c/p/1/0123", userMeta: meta}
+	if err = chunk.saveAttr(out); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	in, err := rawx.repo.get(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if chunk, err = loadAttr(in, testChunkID, ""); err != nil {
+		t.Fatal(err)
+	}
+	reply := http.Header{}
+	chunk.fillHeaders(reply)
+	if v := reply.Get("X-oio-Meta-Color"); v != "blue" {
+		t.Errorf("unexpected metadata sent back: %q", v)
+	}
+
+	// Capped in size, each name as well
+	h.Set("X-oio-Meta-Big", strings.Repeat("x", userMetaMaxSize))
+	if _, err = retrieveUserMetaHeaders(&h); err != errHeadersTooLarge {
+		t.Errorf("oversized metadata accepted: %v", err)
+	}
+	h.Del("X-oio-Meta-Big")
+	h.Set("X-oio-Meta-"+strings.Repeat("x", xattrNameMax), "1")
+	if _, err = retrieveUserMetaHeaders(&h); err != errHeadersTooLarge {
+		t.Errorf("oversized name accepted: %v", err)
+	}
+}
+
+func TestEtag(t *testing.T) {
+	chunk := chunkInfo{ChunkHash: "0123"}
+	if tag := chunk.etag(); tag != `"0123"` {
+		t.Errorf("unexpected tag %s", tag)
+	}
+	chunk.compression = compressionOff
+	if tag := chunk.etag(); tag != `"0123"` {
+		t.Errorf("unexpected tag %s", tag)
+	}
+
+	// The clear content is served decoded, the same bytes as hashed
+	chunk.compression = compressionZlib
+	if tag := chunk.etag(); tag != `"0123"` {
+		t.Errorf("unexpected tag %s", tag)
+	}
+
+	// The weak tag of an encoded representation is matched as well
+	tag := `W/"0123"`
+	for _, header := range []string{`"0123"`, `W/"0123"`, `"abcd", W/"0123"`, "*"} {
+		if !etagMatches(header, tag) {
+			t.Errorf("%s does not match %s", header, tag)
+		}
+	}
+	if etagMatches(`"abcd"`, tag) {
+		t.Errorf("unexpected match")
+	}
+}
@@ -19,26 +19,258 @@ package main
 /*
 Wraps the file repository to add chunk-related handlings, e.g. transparent compression,
 alternative file names, etc.
+
+The chunks of specific storage policies may be stored on dedicated volumes,
+e.g. on SSD while the primary volume is on HDD. The chunks are looked for on
+all the volumes, and a chunk ID remains unique among them.
+
+The cold chunks may be stored in an S3-compatible object storage (see
+s3repo.go): the chunks of the cold storage policies are uploaded there, and
+the chunks found on no volume are looked for there. The uploads to a volume
+are not checked against the cold storage, that would cost a request to the
+object storage on each upload: the uniqueness of the chunk IDs is ensured by
+the meta2 services.
 */
 
 import (
+	"context"
 	"os"
+	"sort"
+	"time"
 )
 
 type chunkRepository struct {
 	sub fileRepository
+
+	// Volumes dedicated to storage policies, by policy name. The chunks of
+	// the other policies go to the primary volume (sub).
+	tiers map[string]*fileRepository
+
+	// The storage of the cold chunks, and the policies of the cold chunks
+	cold         *s3Repository
+	coldPolicies map[string]bool
+}
+
+var _ repository = (*chunkRepository)(nil)
+
+// The same repository, the requests of which to the cold storage are
+// canceled with the context
+func (cr *chunkRepository) withContext(ctx context.Context) *chunkRepository {
+	if cr.cold == nil {
+		return cr
+	}
+	c := *cr
+	c.cold = cr.cold.withContext(ctx)
+	return &c
+}
+
+// The same repository, restricted to the volumes
+func (cr *chunkRepository) local() *chunkRepository {
+	c := *cr
+	c.cold = nil
+	c.coldPolicies = nil
+	return &c
+}
+
+// Find the volume holding the chunk, tell if any does
+func (cr *chunkRepository) lookup(name string) (*fileRepository, bool) {
+	if cr.sub.has(name) {
+		return &cr.sub, true
+	}
+	for _, fr := range cr.tiers {
+		if fr.has(name) {
+			return fr, true
+		}
+	}
+	return &cr.sub, false
+}
+
+// Find the volume holding the chunk, the primary volume when none does
+func (cr *chunkRepository) locate(name string) *fileRepository {
+	if len(cr.tiers) <= 0 {
+		return &cr.sub
+	}
+	fr, _ := cr.lookup(name)
+	return fr
+}
+
+// Tell if the chunk is on no volume, and must be looked for in the cold
+// storage
+func (cr *chunkRepository) isCold(name string) bool {
+	if cr.cold == nil {
+		return false
+	}
+	_, found := cr.lookup(name)
+	return !found
+}
+
+// All the volumes, the primary volume first
+func (cr *chunkRepository) volumes() []*fileRepository {
+	all := []*fileRepository{&cr.sub}
+	for _, fr := range cr.tiers {
+		all = append(all, fr)
+	}
+	return all
 }
 
 func (cr *chunkRepository) getAttr(name, key string, value []byte) (int, error) {
-	return cr.sub.getAttr(name, key, value)
+	var n int
+	var err error
+	if cr.isCold(name) {
+		n, err = cr.cold.getAttr(name, key, value)
+	} else {
+		n, err = cr.locate(name).getAttr(name, key, value)
+	}
+	if err == nil {
+		return n, nil
+	} else if err != os.ErrNotExist && !os.IsNotExist(err) {
+		return n, err
+	} else {
+		return n, os.ErrNotExist
+	}
+}
+
+func (cr *chunkRepository) setAttr(name, key string, value []byte) error {
+	var err error
+	if cr.isCold(name) {
+		err = cr.cold.setAttr(name, key, value)
+	} else {
+		err = cr.locate(name).setAttr(name, key, value)
+	}
+	if err == nil {
+		return nil
+	} else if err != os.ErrNotExist && !os.IsNotExist(err) {
+		return err
+	} else {
+		return os.ErrNotExist
+	}
+}
+
+// Decorates an existing chunk of the repository
+type chunkDecorator struct {
+	repo repository
+	name string
+}
+
+func (cd chunkDecorator) setAttr(key string, value []byte) error {
+	return cd.repo.setAttr(cd.name, key, value)
+}
+
+// The space of the primary volume only
+func (cr *chunkRepository) statfs() (uint64, uint64, error) {
+	return cr.sub.statfs()
+}
+
+func (cr *chunkRepository) volumeOf(policy string) string {
+	if cr.coldPolicies[policy] {
+		return cr.cold.volumeOf(policy)
+	}
+	if tier, ok := cr.tiers[policy]; ok {
+		return tier.root
+	}
+	return cr.sub.root
+}
+
+func (cr *chunkRepository) statfsPolicy(policy string) (uint64, uint64, error) {
+	if cr.coldPolicies[policy] {
+		return cr.cold.statfsPolicy(policy)
+	}
+	if tier, ok := cr.tiers[policy]; ok {
+		return tier.statfs()
+	}
+	return cr.sub.statfs()
+}
+
+func (cr *chunkRepository) writable() error {
+	for _, fr := range cr.volumes() {
+		if err := fr.writable(); err != nil {
+			return err
+		}
+	}
+	if len(cr.coldPolicies) > 0 {
+		return cr.cold.writable()
+	}
+	return nil
+}
+
+func (cr *chunkRepository) durability() (bool, bool) {
+	return cr.sub.syncFile, cr.sub.syncDir
+}
+
+func (cr *chunkRepository) sweepPending(deadline time.Time) (int, int64, error) {
+	var count int
+	var reclaimed int64
+	for _, fr := range cr.volumes() {
+		c, r, err := fr.sweepPending(deadline)
+		count, reclaimed = count+c, reclaimed+r
+		if err != nil {
+			return count, reclaimed, err
+		}
+	}
+	return count, reclaimed, nil
+}
+
+func (cr *chunkRepository) precreateDirs(max int) (int, error) {
+	var created int
+	for _, fr := range cr.volumes() {
+		c, err := fr.precreateDirs(max)
+		created += c
+		if err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// Merge the listings of the volumes. Each one holds the first chunks of its
+// volume, so that the first of the merged chunks are the first of all.
+func (cr *chunkRepository) list(prefix, marker string, max int) ([]listedChunk, bool, error) {
+	if len(cr.tiers) <= 0 && cr.cold == nil {
+		return cr.sub.list(prefix, marker, max)
+	}
+	var chunks []listedChunk
+	truncated := false
+	merge := func(page []listedChunk, more bool) {
+		chunks = append(chunks, page...)
+		truncated = truncated || more
+	}
+	for _, fr := range cr.volumes() {
+		page, more, err := fr.list(prefix, marker, max)
+		if err != nil {
+			return nil, false, err
+		}
+		merge(page, more)
+	}
+	if cr.cold != nil {
+		page, more, err := cr.cold.list(prefix, marker, max)
+		if err != nil {
+			return nil, false, err
+		}
+		merge(page, more)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].id < chunks[j].id })
+	if len(chunks) > max {
+		return chunks[:max], true, nil
+	}
+	return chunks, truncated, nil
 }
 
 func (cr *chunkRepository) lock(ns, url string) error {
-	return cr.sub.lock(ns, url)
+	for _, fr := range cr.volumes() {
+		if err := fr.lock(ns, url); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (cr *chunkRepository) del(name string) error {
-	err := cr.sub.del(name)
+	var err error
+	if cr.isCold(name) {
+		err = cr.cold.del(name)
+	} else {
+		err = cr.locate(name).del(name)
+	}
 	if err == nil {
 		return nil
 	} else if err != os.ErrNotExist && !os.IsNotExist(err) {
@@ -49,7 +281,13 @@ func (cr *chunkRepository) del(name string) error {
 }
 
 func (cr *chunkRepository) get(name string) (fileReader, error) {
-	r, err := cr.sub.get(name)
+	var r fileReader
+	var err error
+	if cr.isCold(name) {
+		r, err = cr.cold.get(name)
+	} else {
+		r, err = cr.locate(name).get(name)
+	}
 	if err == nil {
 		return r, nil
 	} else if err != os.ErrNotExist && !os.IsNotExist(err) {
@@ -60,9 +298,116 @@ func (cr *chunkRepository) get(name string) (fileReader, error) {
 }
 
 func (cr *chunkRepository) put(name string) (fileWriter, error) {
-	return cr.sub.put(name)
+	return cr.putPolicy("", name)
+}
+
+func (cr *chunkRepository) putPolicy(policy, name string) (fileWriter, error) {
+	if cr.coldPolicies[policy] {
+		// A chunk is unique among the volumes and the cold storage
+		if _, found := cr.lookup(name); found {
+			return nil, errChunkExists
+		}
+		w, err := cr.cold.put(name)
+		if err == os.ErrExist {
+			err = errChunkExists
+		}
+		return w, err
+	}
+	fr := &cr.sub
+	if len(cr.tiers) > 0 {
+		if tier, ok := cr.tiers[policy]; ok {
+			fr = tier
+		}
+		// A chunk is unique among all the volumes
+		if other, found := cr.lookup(name); found && other != fr {
+			return nil, errChunkExists
+		}
+	}
+	w, err := fr.put(name)
+	if err == nil {
+		return w, nil
+	} else if err != os.ErrExist && !os.IsExist(err) {
+		return nil, err
+	} else {
+		return nil, errChunkExists
+	}
+}
+
+func (cr *chunkRepository) replace(name string) (fileWriter, error) {
+	if cr.isCold(name) {
+		return cr.cold.replace(name)
+	}
+	return cr.locate(name).replace(name)
 }
 
+// The chunk is replaced in place when it is already stored where its policy
+// requires. Otherwise the new chunk is stored there, and the previous one is
+// deleted upon the commit.
+func (cr *chunkRepository) replacePolicy(policy, name string) (fileWriter, error) {
+	if len(cr.tiers) <= 0 && len(cr.coldPolicies) <= 0 {
+		return cr.replace(name)
+	}
+	current, found := cr.lookup(name)
+	toCold := cr.coldPolicies[policy]
+	target := &cr.sub
+	if tier, ok := cr.tiers[policy]; ok {
+		target = tier
+	}
+	if (!found && cr.cold == nil) || (found && !toCold && current == target) || (!found && toCold) {
+		return cr.replace(name)
+	}
+
+	var w fileWriter
+	var err error
+	if toCold {
+		w, err = cr.cold.put(name)
+	} else {
+		w, err = target.put(name)
+	}
+	if err == os.ErrExist || os.IsExist(err) {
+		return nil, errChunkExists
+	} else if err != nil {
+		return nil, err
+	}
+	previous := func() error {
+		if found {
+			return current.del(name)
+		}
+		return cr.cold.del(name)
+	}
+	return &movingWriter{fileWriter: w, previous: previous}, nil
+}
+
+// Deletes the previous copy of a chunk moved to another volume, once the new
+// one is committed
+type movingWriter struct {
+	fileWriter
+	previous func() error
+}
+
+func (mw *movingWriter) commit() error {
+	if err := mw.fileWriter.commit(); err != nil {
+		return err
+	}
+	if err := mw.previous(); err != nil && err != os.ErrNotExist && !os.IsNotExist(err) {
+		LogWarning("Failed to delete the previous copy of a moved chunk: %v", err)
+	}
+	return nil
+}
+
+// The copy stays on the volume of the source, the link cannot cross volumes
 func (cr *chunkRepository) link(fromName, toName string) (linkOperation, error) {
-	return cr.sub.link(fromName, toName)
+	if cr.isCold(fromName) {
+		if _, found := cr.lookup(toName); found {
+			return nil, os.ErrExist
+		}
+		return cr.cold.link(fromName, toName)
+	}
+	fr := cr.locate(fromName)
+	if len(cr.tiers) > 0 {
+		if other, found := cr.lookup(toName); found && other != fr {
+			return nil, os.ErrExist
+		}
+	}
+	return fr.link(fromName, toName)
 }
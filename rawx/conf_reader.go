@@ -64,29 +64,108 @@ var loadedOpts = map[string]string{
 	"fallocate":        "fallocate",
 	"http_keepalive":   "keepalive",
 	"checksum":         "checksum",
+	"checksum_algo":    "checksum_algo",
+	"verify_read":      "verify_read",
+	"chunk_size_max":   "chunk_size_max",
 	"buffer_size":      "buffer_size",
 	"fadvise_upload":   "fadvise_upload",
 	"fadvise_download": "fadvise_download",
 	"open_nonblock":    "nonblock",
 
+	"free_space_min_bytes":   "free_space_min_bytes",
+	"free_space_min_percent": "free_space_min_percent",
+
+	"cors_allow_origin": "cors_allow_origin",
+
+	"checksum_secondary_algo": "checksum_secondary_algo",
+
+	"disabled_methods": "disabled_methods",
+	"read_only":        "read_only",
+
+	"max_concurrent_reads":  "max_concurrent_reads",
+	"max_concurrent_writes": "max_concurrent_writes",
+
+	"upload_rate_requests": "upload_rate_requests",
+	"upload_rate_bytes":    "upload_rate_bytes",
+	"upload_rate_header":   "upload_rate_header",
+
+	"idempotency_ttl":      "idempotency_ttl",
+	"idempotency_max_keys": "idempotency_max_keys",
+
+	"pending_max_age": "pending_max_age",
+	"precreate_dirs":  "precreate_dirs",
+
+	"policy_volumes": "policy_volumes",
+
+	"s3_endpoint":        "s3_endpoint",
+	"s3_bucket":          "s3_bucket",
+	"s3_prefix":          "s3_prefix",
+	"s3_region":          "s3_region",
+	"s3_access_key":      "s3_access_key",
+	"s3_secret_key_file": "s3_secret_key_file",
+	"s3_part_size":       "s3_part_size",
+	"s3_policies":        "s3_policies",
+
+	"user_metadata_prefix":   "user_metadata_prefix",
+	"user_metadata_max_size": "user_metadata_max_size",
+
+	"scrub":              "scrub",
+	"scrub_rate":         "scrub_rate",
+	"scrub_rate_bytes":   "scrub_rate_bytes",
+	"scrub_max_inflight": "scrub_max_inflight",
+	"scrub_interval":     "scrub_interval",
+
+	"grid_hash_width_previous": "hash_width_previous",
+	"grid_hash_depth_previous": "hash_depth_previous",
+	"hash_width_previous":      "hash_width_previous",
+	"hash_depth_previous":      "hash_depth_previous",
+
+	"compression_min_size":        "compression_min_size",
+	"compression_zlib_level":      "compression_zlib_level",
+	"compression_skip_extensions": "compression_skip_extensions",
+
+	"gzip_download": "gzip_download",
+	"gzip_min_size": "gzip_min_size",
+
+	"auth_secret_file": "auth_secret_file",
+	"auth_reads":       "auth_reads",
+
 	"timeout_read_header":  "timeout_read_header",
 	"timeout_read_request": "timeout_read_request",
+	"timeout_read_idle":    "timeout_read_idle",
 	"timeout_write_reply":  "timeout_write_reply",
+	"timeout_write_idle":   "timeout_write_idle",
 	"timeout_idle":         "timeout_idle",
+	"timeout_graceful":     "timeout_graceful",
 	"headers_buffer_size":  "headers_buffer_size",
+	"headers_max_count":    "headers_max_count",
 
 	"sock_tcp_cork":    "cork",
 	"sock_tcp_nodelay": "nodelay",
 
-	"events": "events",
+	"events":             "events",
+	"events_queue_size":  "events_queue_size",
+	"events_retry_delay": "events_retry_delay",
 
 	"tls_cert_file": "tls_cert_file",
 	"tls_key_file":  "tls_key_file",
 	"tls_rawx_url":  "tls_rawx_url",
 
+	"tls_min_version":    "tls_min_version",
+	"tls_cipher_suites":  "tls_cipher_suites",
+	"tls_client_ca_file": "tls_client_ca_file",
+	"tls_client_allow":   "tls_client_allow",
+	"tls_http2":          "tls_http2",
+
 	"log_access_get":    "log_access_get",
 	"log_access_put":    "log_access_put",
 	"log_access_delete": "log_access_delete",
+	"log_access_format": "log_access_format",
+	"log_level":         "log_level",
+
+	"syslog_addr":            "syslog_addr",
+	"syslog_facility":        "syslog_facility",
+	"syslog_facility_access": "syslog_facility_access",
 	// TODO(jfs): also implement a cachedir
 }
 
@@ -139,6 +218,19 @@ func (m optionsMap) getInt(k string, def int) int {
 	return int(i64)
 }
 
+func (m optionsMap) getInt64(k string, def int64) int64 {
+	v := m[k]
+	if len(v) <= 0 {
+		return def
+	}
+	i64, err := strconv.ParseInt(v, 0, 64)
+	if err != nil {
+		log.Fatalf("Invalid integer option for %s: %s (%s)", k, v, err.Error())
+		return 0
+	}
+	return i64
+}
+
 func (m optionsMap) getBool(k string, def bool) bool {
 	v := m[k]
 	if len(v) <= 0 {
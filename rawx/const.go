@@ -39,13 +39,33 @@ const (
 	AttrNameChunkSize          = "user.grid.chunk.size"
 	AttrNameOioVersion         = "user.grid.oio.version"
 	AttrNameCompression        = "user.grid.compression"
+	AttrNameChunkChecksumAlgo  = "user.grid.chunk.hash_algo"
+	AttrNameContentMimeType    = "user.grid.content.mime_type"
+
+	AttrNameChunkChecksumSecondary     = "user.grid.chunk.hash_secondary"
+	AttrNameChunkChecksumSecondaryAlgo = "user.grid.chunk.hash_secondary_algo"
+
+	// Prefix of the XATTR holding the metadata of the user, followed by the
+	// name of the metadata in lowercase
+	AttrNameUserMetaPrefix = "user.grid.meta."
+	// Number of metadata of the user, only set on the chunks having some: the
+	// XATTR of the others are never listed on downloads
+	AttrNameUserMetaCount = "user.grid.meta_count"
+
+	// Maximum length of the name of a XATTR
+	xattrNameMax = 255
 )
 
+// Type of the chunks uploaded without one
+const defaultMimeType = "application/octet-stream"
+
 const (
 	compressionOff     = "off"
 	compressionLzw     = "lzw"
 	compressionZlib    = "zlib"
 	compressionDeflate = "deflate"
+	compressionZstd    = "zstd"
+	compressionLz4     = "lz4"
 )
 
 const (
@@ -59,10 +79,15 @@ const (
 	HeaderNameChunkPosition      = "X-oio-Chunk-Meta-Chunk-Pos"
 	HeaderNameChunkSize          = "X-oio-Chunk-Meta-Chunk-Size"
 	HeaderNameChunkChecksum      = "X-oio-Chunk-Meta-Chunk-Hash"
+	HeaderNameChunkChecksumAlgo  = "X-oio-Chunk-Meta-Chunk-Hash-Algo"
 	HeaderNameMetachunkSize      = "X-oio-Chunk-Meta-Metachunk-Size"
 	HeaderNameMetachunkChecksum  = "X-oio-Chunk-Meta-Metachunk-Hash"
 	HeaderNameChunkID            = "X-oio-Chunk-Meta-Chunk-Id"
 	HeaderNameXattrVersion       = "X-oio-Chunk-Meta-Oio-Version"
+	HeaderNameContentMimeType    = "X-oio-Chunk-Meta-Content-Mime-Type"
+
+	HeaderNameChunkChecksumSecondary     = "X-oio-Chunk-Meta-Chunk-Hash-Secondary"
+	HeaderNameChunkChecksumSecondaryAlgo = "X-oio-Chunk-Meta-Chunk-Hash-Secondary-Algo"
 )
 
 const (
@@ -71,6 +96,41 @@ const (
 	HeaderLenOioReqId   = 63
 	HeaderNameTransId   = "X-trans-id"
 	HeaderNameError     = "X-Error"
+
+	// Trailer carrying the checksum of the data actually sent on a download
+	HeaderNameComputedChecksum = "X-oio-Chunk-Computed-Hash"
+
+	// Announces the trailers accepted on an upload
+	HeaderNameAcceptTrailers = "X-oio-Accept-Trailers"
+
+	// Signature of the request, when a shared secret is configured
+	HeaderNameSignature = "X-oio-Signature"
+	// Time (UNIX seconds) of the signature of the request
+	HeaderNameTimestamp = "X-oio-Timestamp"
+
+	// Set by the clients uploading already compressed data
+	HeaderNameIncompressible = "X-oio-Chunk-Incompressible"
+
+	// Range of the source chunk to copy, with the syntax of "Range"
+	HeaderNameCopySourceRange = "X-oio-Copy-Source-Range"
+
+	// Set by the clients checking an upload without sending its data
+	HeaderNameDryRun = "X-oio-Dry-Run"
+
+	// Identifies an upload and its retries
+	HeaderNameIdempotencyKey = "X-oio-Idempotency-Key"
+
+	// Sizes of an uploaded chunk, as received and as written on disk (after
+	// compression)
+	HeaderNameClearSize  = "X-oio-Chunk-Clear-Size"
+	HeaderNameStoredSize = "X-oio-Chunk-Stored-Size"
+
+	// Hash of a whole object, computed across the uploads of its chunks:
+	// the state of the hash is sent with each upload, and the updated state
+	// is replied with the hash of the data so far.
+	HeaderNameObjectChecksumAlgo  = "X-oio-Object-Hash-Algo"
+	HeaderNameObjectChecksumState = "X-oio-Object-Hash-State"
+	HeaderNameObjectChecksum      = "X-oio-Object-Hash"
 )
 
 const (
@@ -119,10 +179,85 @@ const (
 	// connection is used.
 	configDefaultCork = false
 
+	// By default, should the mutations of the chunks be refused
+	configDefaultReadOnly = false
+
+	// By default, should HTTP/2 be offered (via ALPN) to the clients of the
+	// HTTPS server. The plain HTTP server only speaks HTTP/1.*.
+	configDefaultHTTP2 = true
+
 	// By default, should the O_NONBLOCK flag be set when opening a file?
 	// It turns out that the impact on Go is not weak. The presence of the
 	// flag induces many syscalls.
 	configDefaultOpenNonblock = false
+
+	// By default, should the checksum of the chunks be verified when they
+	// are downloaded? The verification is skipped on range downloads.
+	configDefaultVerifyRead = false
+
+	// By default, all the chunks are compressed when the compression is
+	// enabled, whatever their size
+	configDefaultCompressionMinSize int64 = 0
+
+	// By default, the downloads are never compressed on the fly. When they
+	// are, the chunks under 1KiB are not worth it.
+	configDefaultGzipDownload       = false
+	configDefaultGzipMinSize  int64 = 1024
+
+	// By default, the pending files left by a previous run for more than a
+	// day are removed at startup
+	configDefaultPendingMaxAge = 86400
+
+	// By default, the directories are created by the first upload needing
+	// them. When they are created at startup, a layout with more than 64Ki
+	// directories at its last level is left apart.
+	configDefaultPrecreateDirs = false
+	precreateDirsMax           = 65536
+
+	// By default, the headers starting with "X-oio-Meta-" are saved as the
+	// metadata of the user, up to 4KiB per chunk (names and values)
+	configDefaultUserMetaPrefix      = "X-oio-Meta-"
+	configDefaultUserMetaMaxSize int = 4096
+
+	// By default, the chunks are not verified in the background. When they
+	// are, 10 chunks and 16MiB per second at most, while less than 8 requests
+	// are in flight, and a new pass starts every day.
+	configDefaultScrub                  = false
+	configDefaultScrubRate              = 10
+	configDefaultScrubRateBytes   int64 = 16 * 1024 * 1024
+	configDefaultScrubMaxInflight       = 8
+	configDefaultScrubInterval          = 86400
+
+	// By default, the size of the chunks is not limited
+	configDefaultChunkSizeMax int64 = 0
+
+	// By default, the number of concurrent reads (GET, HEAD) and writes
+	// (PUT, COPY, PATCH, DELETE) on the chunks is not limited
+	configDefaultMaxConcurrentReads  = 0
+	configDefaultMaxConcurrentWrites = 0
+
+	// By default, the uploads of the clients are not throttled, neither in
+	// requests per second nor in bytes per second
+	configDefaultUploadRateRequests int64 = 0
+	configDefaultUploadRateBytes    int64 = 0
+
+	// By default, the successful uploads with an idempotency key are
+	// remembered for 5 minutes, 10000 of them at most
+	configDefaultIdempotencyTTL     = 300
+	configDefaultIdempotencyMaxKeys = 10000
+
+	// By default, when a secret is configured, only the writes must be signed
+	configDefaultAuthReads = false
+
+	// Region of the S3 cold storage, and size of the parts of its multipart
+	// uploads, thus of the buffer of each upload
+	configDefaultS3Region   = "us-east-1"
+	configDefaultS3PartSize = 8 * 1024 * 1024
+
+	// By default, the free space of the volume is not checked before an
+	// upload, neither in bytes nor in percents of the volume size.
+	configDefaultFreeSpaceMinBytes   int64 = 0
+	configDefaultFreeSpaceMinPercent       = 0
 )
 
 const (
@@ -146,6 +281,14 @@ const (
 	// Total amount (in bytes) of buffers allocated for xattr operations
 	xattrBufferTotalSizeDefault = 256 * 1024
 
+	// Default maximum size (in bytes) of the header of a request, the
+	// default of Go (1MiB) is far beyond the needs of a rawx
+	headersMaxSizeDefault = 64 * 1024
+
+	// Default maximum number of fields in the header of a request, a chunk
+	// upload carries less than 20 of them
+	headersMaxCountDefault = 100
+
 	// Default size (in bytes) of each buffer allocated for the upload
 	uploadBufferSizeDefault = 2 * 1024 * 1024
 
@@ -166,11 +309,58 @@ const (
 	uploadExtensionSize int64 = 16 * 1024 * 1024
 )
 
+// Delay (in seconds) suggested to the clients denied because of the
+// concurrency limits
+const overloadRetryAfter = "1"
+
+// Status of the requests cut because the client disconnected, as logged
+// by nginx: no client reads it, it is only accounted and logged.
+const statusClientClosed = 499
+
+// Trailers of the uploads, taken into account as the headers of the same name
+const uploadTrailers = HeaderNameChunkChecksum + ", " + HeaderNameChunkSize + ", " +
+	HeaderNameMetachunkChecksum + ", " + HeaderNameMetachunkSize
+
+// Methods served on the chunks and on the service endpoints (e.g. /info),
+// as announced in the "Allow" header
+const (
+	chunkAllowedMethods   = "PUT, COPY, PATCH, HEAD, GET, DELETE, VERIFY, OPTIONS"
+	serviceAllowedMethods = "GET, HEAD"
+	bulkAllowedMethods    = "POST"
+	listAllowedMethods    = "GET"
+	adminAllowedMethods   = "GET, POST"
+)
+
+// Methods on the chunks that may be disabled, in the order of chunkAllowedMethods
+var chunkToggledMethods = []string{"PUT", "COPY", "PATCH", "HEAD", "GET", "DELETE", "VERIFY"}
+
+const (
+	// Maximum number of chunks deleted by a single bulk request
+	bulkDeleteMaxChunks = 1000
+
+	// Maximum size (in bytes) of the body of a bulk request
+	bulkDeleteMaxBodySize = 128 * 1024
+)
+
+const (
+	// Number of chunks in a page of listing, unless specified
+	listDefaultMaxChunks = 1000
+
+	// Maximum number of chunks in a page of listing
+	listMaxChunks = 10000
+)
+
+// Number of hexadecimal digits of a chunk ID
+const chunkIDLength = 64
+
 const (
 	hashWidth    = 3
 	hashDepth    = 1
 	putOpenMode  = 0644
 	putMkdirMode = 0755
+
+	// Suffix of the files of the uploads in progress
+	pendingSuffix = ".pending"
 )
 
 const (
@@ -179,6 +369,17 @@ const (
 	checksumSmart  = iota
 )
 
+const (
+	checksumAlgoMD5    = "md5"
+	checksumAlgoSHA256 = "sha256"
+	checksumAlgoSHA512 = "sha512"
+	checksumAlgoCRC32C = "crc32c"
+
+	// MD5 is kept as the default for backward compatibility, the chunks
+	// without the XATTR telling the algorithm have been hashed with MD5.
+	checksumAlgoDefault = checksumAlgoMD5
+)
+
 const (
 	oioEtcDir          = "/etc/oio"
 	oioConfigFilePath  = oioEtcDir + "/sds.conf"
@@ -196,22 +397,38 @@ const (
 	// How long (in seconds) might a client take to send its whole request
 	timeoutReadRequest = 900
 
+	// How long (in seconds) might a client stay silent while sending a chunk
+	timeoutReadIdle = 60
+
 	// How long (in seconds) might it takes to emit the whole reply
 	timeoutWrite = 900
 
+	// How long (in seconds) might a client stop reading a chunk
+	timeoutWriteIdle = 60
+
 	// How long (in seconds) might a connection stay idle (between two requests)
 	timeoutIdle = 3600
+
+	// How long (in seconds) might the in-flight requests take to complete
+	// when the service is stopped
+	timeoutGraceful = 10
 )
 
 const (
 	ECMethodPrefix = "ec/"
 )
 
+// Number of locks shared by the chunks, to serialize the conditional
+// operations on a same chunk
+const chunkLockStripes = 256
+
 const (
 	eventTypeNewChunk = "storage.chunk.new"
 
 	eventTypeDelChunk = "storage.chunk.deleted"
 
+	eventTypeCorruptedChunk = "storage.chunk.corrupted"
+
 	// Parallelism factor in situations of single targets
 	notifierSingleMultiplier = 4
 
@@ -221,5 +438,14 @@ const (
 	// Number of slots in the channel feeding the notifier backends
 	notifierDefaultPipeSize = 32768
 
+	// Delay (in milliseconds) before a failed event is delivered again
+	notifierDefaultRetryDelay = 1000
+
 	beanstalkNotifierDefaultTube = "oio"
+
+	// Topic used when the Kafka endpoint tells none
+	kafkaNotifierDefaultTopic = "oio"
+
+	// How many attempts to publish an event before it is dropped
+	kafkaNotifierMaxAttempts = 3
 )
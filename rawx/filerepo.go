@@ -19,9 +19,13 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	syscall "golang.org/x/sys/unix"
 )
@@ -39,6 +43,10 @@ type fileRepository struct {
 	openNonBlock    bool
 	fadviseUpload   int
 	fadviseDownload int
+
+	// Layout of the chunks written before the current one, 0 if none
+	prevHashWidth int
+	prevHashDepth int
 }
 
 func (fr *fileRepository) openFlagsRO() int {
@@ -77,8 +85,45 @@ func (fr *fileRepository) init(root string) error {
 	return err
 }
 
+// Open another volume with the same settings
+func (fr *fileRepository) sibling(root string) (*fileRepository, error) {
+	other := *fr
+	if err := other.init(root); err != nil {
+		return nil, err
+	}
+	other.hashWidth, other.hashDepth = fr.hashWidth, fr.hashDepth
+	other.syncFile, other.syncDir = fr.syncFile, fr.syncDir
+	other.fallocateFile = fr.fallocateFile
+	other.fadviseUpload, other.fadviseDownload = fr.fadviseUpload, fr.fadviseDownload
+	return &other, nil
+}
+
+// Tell if the chunk is present, with any layout
+func (fr *fileRepository) has(name string) bool {
+	return syscall.Faccessat(fr.rootFd, fr.findRelPath(name), syscall.F_OK, 0) == nil
+}
+
+// Return the total size and the space available to unprivileged users
+// (in bytes) on the volume.
+func (fr *fileRepository) statfs() (total, avail uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(fr.root, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Blocks * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
+
+// Tell if the volume is still accessible for writing
+func (fr *fileRepository) writable() error {
+	return syscall.Faccessat(fr.rootFd, ".", syscall.W_OK, 0)
+}
+
 func (fr *fileRepository) getAttr(name, key string, value []byte) (int, error) {
-	return syscall.Getxattr(fr.nameToAbsPath(name), key, value)
+	return syscall.Getxattr(fr.relToAbsPath(fr.findRelPath(name)), key, value)
+}
+
+func (fr *fileRepository) setAttr(name, key string, value []byte) error {
+	return syscall.Setxattr(fr.relToAbsPath(fr.findRelPath(name)), key, value, 0)
 }
 
 func (fr *fileRepository) lock(ns, id string) error {
@@ -99,7 +144,7 @@ func (fr *fileRepository) lock(ns, id string) error {
 }
 
 func (fr *fileRepository) del(name string) error {
-	relPath := fr.nameToRelPath(name)
+	relPath := fr.findRelPath(name)
 	absPath := fr.relToAbsPath(relPath)
 	xattrName := xattrKey(name)
 
@@ -142,10 +187,51 @@ func (fr *fileRepository) getRelPath(path string) (fileReader, error) {
 }
 
 func (fr *fileRepository) get(name string) (fileReader, error) {
-	return fr.getRelPath(fr.nameToRelPath(name))
+	return fr.getRelPath(fr.findRelPath(name))
 }
 
-func (fr *fileRepository) putRelPath(path string) (fileWriter, error) {
+// Create all the directories of the current layout, so that no upload has
+// to create the directory of its chunk. Nothing is done when the layout has
+// more than max directories at its last level. Return the number of
+// directories created, those already present are kept.
+func (fr *fileRepository) precreateDirs(max int) (int, error) {
+	fanout := 1 << uint(4*fr.hashWidth)
+	leaves := 1
+	for i := 0; i < fr.hashDepth; i++ {
+		leaves *= fanout
+		if leaves > max {
+			return 0, nil
+		}
+	}
+	created := 0
+	var mkdirs func(parent string, depth int) error
+	mkdirs = func(parent string, depth int) error {
+		if depth >= fr.hashDepth {
+			return nil
+		}
+		for i := 0; i < fanout; i++ {
+			path := fmt.Sprintf("%0*X", fr.hashWidth, i)
+			if parent != "" {
+				path = joinPath2(parent, path)
+			}
+			err := syscall.Mkdirat(fr.rootFd, path, uint32(fr.putMkdirMode))
+			if err == nil {
+				created++
+			} else if err != syscall.EEXIST {
+				return err
+			}
+			if err = mkdirs(path, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return created, mkdirs("", 0)
+}
+
+// Open a pending file for the given path. Unless overwrite is set, the path
+// must not exist yet. The final file is replaced at once upon the commit.
+func (fr *fileRepository) putRelPath(path string, overwrite bool) (fileWriter, error) {
 	pathTemp := pendingPath(path)
 	fd, err := syscall.Openat(fr.rootFd, pathTemp, syscall.O_CREAT|syscall.O_EXCL|fr.openFlagsWO(), fr.putOpenMode)
 	if err != nil {
@@ -154,15 +240,14 @@ func (fr *fileRepository) putRelPath(path string) (fileWriter, error) {
 			abs := fr.relToAbsPath(path)
 			err = os.MkdirAll(filepath.Dir(abs), fr.putMkdirMode)
 			if err == nil {
-				return fr.putRelPath(path)
+				return fr.putRelPath(path, overwrite)
 			}
 		}
 		return nil, err
 	}
 
 	// Check that the final chunk doesn't exist yet
-	err = syscall.Faccessat(fr.rootFd, path, syscall.F_OK, 0)
-	if err == nil {
+	if !overwrite && syscall.Faccessat(fr.rootFd, path, syscall.F_OK, 0) == nil {
 		_ = syscall.Unlinkat(fr.rootFd, pathTemp, 0)
 		_ = syscall.Close(fd)
 		return nil, os.ErrExist
@@ -175,7 +260,18 @@ func (fr *fileRepository) putRelPath(path string) (fileWriter, error) {
 }
 
 func (fr *fileRepository) put(name string) (fileWriter, error) {
-	return fr.putRelPath(fr.nameToRelPath(name))
+	relPath := fr.nameToRelPath(name)
+	if fr.findRelPath(name) != relPath {
+		// Already present with a previous layout
+		return nil, os.ErrExist
+	}
+	return fr.putRelPath(relPath, false)
+}
+
+// Like put() but an existing chunk is replaced upon the commit, wherever it
+// was found
+func (fr *fileRepository) replace(name string) (fileWriter, error) {
+	return fr.putRelPath(fr.findRelPath(name), true)
 }
 
 // Fast path: initial optimistic attempt when everything works fine
@@ -204,14 +300,18 @@ func (fr *fileRepository) linkRelPath(fromPath, toPath string) (linkOperation, e
 			return op, err
 		}
 
-		switch err.(syscall.Errno) {
+		switch err {
 		case syscall.ENOENT:
 			if e0 := syscall.Faccessat(fr.rootFd, fromPath, syscall.F_OK, 0); e0 != nil {
 				return nil, err
 			}
-			if e0 := os.MkdirAll(filepath.Dir(toPath), fr.putMkdirMode); e0 != nil {
+			if e0 := os.MkdirAll(filepath.Dir(fr.relToAbsPath(toPath)), fr.putMkdirMode); e0 != nil {
 				return nil, err
 			}
+		case syscall.EXDEV, syscall.EMLINK, syscall.EPERM, syscall.EOPNOTSUPP:
+			// The source and the target are on different filesystems, or
+			// the filesystem does not support (more) hard links.
+			return fr.copyRelPath(fromPath, toPath)
 		default:
 			// The initial link() failed
 			return nil, err
@@ -219,9 +319,102 @@ func (fr *fileRepository) linkRelPath(fromPath, toPath string) (linkOperation, e
 	}
 }
 
+// Slow path: copy the data and the XATTR of the source into a new file. Once
+// the copy is complete, the target behaves like a link.
+func (fr *fileRepository) copyRelPath(fromPath, toPath string) (linkOperation, error) {
+	in, err := fr.getRelPath(fromPath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	out, err := fr.putRelPath(toPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	out.Extend(in.size())
+	if _, err = io.Copy(out, in); err == nil {
+		err = copyAttrs(in.File(), out)
+	}
+	if err != nil {
+		_ = out.abort()
+		return nil, err
+	}
+	if err = out.commit(); err != nil {
+		return nil, err
+	}
+	return &realLinkOp{relPath: toPath, repo: fr}, nil
+}
+
+// Copy the XATTR of the "user" namespace, the only one managed by the rawx
+func copyAttrs(src *os.File, dst decorable) error {
+	fd := int(src.Fd())
+	size, err := syscall.Flistxattr(fd, nil)
+	if err != nil || size <= 0 {
+		return err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Flistxattr(fd, names); err != nil {
+		return err
+	}
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		size, err = syscall.Fgetxattr(fd, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Fgetxattr(fd, name, value); err != nil {
+			return err
+		}
+		if err = dst.setAttr(name, value[:size]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load the metadata of the user, nil if there is none
+func loadUserMeta(f *os.File) (map[string]string, error) {
+	fd := int(f.Fd())
+	size, err := syscall.Flistxattr(fd, nil)
+	if err != nil || size <= 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Flistxattr(fd, names); err != nil {
+		return nil, err
+	}
+	var meta map[string]string
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if !strings.HasPrefix(name, AttrNameUserMetaPrefix) {
+			continue
+		}
+		size, err = syscall.Fgetxattr(fd, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Fgetxattr(fd, name, value); err != nil {
+			return nil, err
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.TrimPrefix(name, AttrNameUserMetaPrefix)] = string(value[:size])
+	}
+	return meta, nil
+}
+
 func (fr *fileRepository) link(src, dst string) (linkOperation, error) {
-	relSrc := fr.nameToRelPath(src)
+	relSrc := fr.findRelPath(src)
 	relDst := fr.nameToRelPath(dst)
+	if fr.findRelPath(dst) != relDst {
+		return nil, os.ErrExist
+	}
 	return fr.linkRelPath(relSrc, relDst)
 }
 
@@ -240,14 +433,15 @@ func (fr *fileRepository) syncRelParent(path string) error {
 
 }
 
-// Synchronize just the file, based on its path
+// Synchronize just the file, based on its path. The XATTR are metadata that
+// fdatasync() would not flush, hence a complete fsync().
 func (fr *fileRepository) syncRelFile(relPath string) error {
 	if !fr.syncFile {
 		return nil
 	}
 	fd, err := syscall.Openat(fr.rootFd, relPath, fr.openFlagsRO(), 0)
 	if err == nil {
-		err = syscall.Fdatasync(fd)
+		err = syscall.Fsync(fd)
 		syscall.Close(fd)
 	}
 	return err
@@ -323,13 +517,9 @@ func (fw *realFileWriter) abort() error {
 
 func (fw *realFileWriter) commit() error {
 	var err error
-	var syncAll bool
 
 	if fw.allocated > fw.written {
 		err = fw.f.Truncate(fw.written)
-		if err == nil {
-			syncAll = true
-		}
 	}
 
 	if err == nil {
@@ -346,9 +536,9 @@ func (fw *realFileWriter) commit() error {
 	}
 
 	if err == nil {
-		err = fw.syncFile(syncAll)
+		err = fw.syncFile()
 		if err == nil {
-			err := syscall.Renameat(fw.repo.rootFd, fw.pathTemp, fw.repo.rootFd, fw.pathFinal)
+			err = syscall.Renameat(fw.repo.rootFd, fw.pathTemp, fw.repo.rootFd, fw.pathFinal)
 			if err == nil {
 				_ = fw.repo.syncRelParent(fw.pathFinal)
 			}
@@ -363,15 +553,13 @@ func (fw *realFileWriter) commit() error {
 	return err
 }
 
-func (fw *realFileWriter) syncFile(all bool) error {
+// The data and the XATTR of the chunk must be durable before it is renamed in
+// place, fdatasync() would not flush the XATTR.
+func (fw *realFileWriter) syncFile() error {
 	if !fw.repo.syncFile {
 		return nil
 	}
-	if all {
-		return syscall.Fsync(fw.fd())
-	} else {
-		return syscall.Fdatasync(fw.fd())
-	}
+	return syscall.Fsync(fw.fd())
 }
 
 func (fw *realFileWriter) Extend(size int64) {
@@ -383,6 +571,22 @@ func (fw *realFileWriter) Extend(size int64) {
 	}
 }
 
+func (fw *realFileWriter) preallocate(size int64) error {
+	err := syscall.Fallocate(fw.fd(), syscall.FALLOC_FL_KEEP_SIZE, 0, size)
+	switch err {
+	case nil:
+		if size > fw.allocated {
+			fw.allocated = size
+		}
+		return nil
+	case syscall.ENOSPC, syscall.EDQUOT:
+		return errNoSpace
+	default:
+		// e.g. EOPNOTSUPP on the file systems without fallocate()
+		return nil
+	}
+}
+
 type realFileReader struct {
 	f    *os.File
 	repo *fileRepository
@@ -401,6 +605,14 @@ func (fr *realFileReader) size() int64 {
 	}
 }
 
+func (fr *realFileReader) mtime() time.Time {
+	fi, err := fr.f.Stat()
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
 func (fr *realFileReader) seek(offset int64) error {
 	_, err := fr.f.Seek(offset, os.SEEK_SET)
 	return err
@@ -424,17 +636,68 @@ func (fr *realFileReader) getAttr(key string, value []byte) (int, error) {
 	return syscall.Fgetxattr(fr.fd(), key, value)
 }
 
-func (fr *fileRepository) nameToRelPath(name string) string {
+func (fr *realFileReader) userMeta() (map[string]string, error) {
+	return loadUserMeta(fr.f)
+}
+
+// Build the path of a chunk under "depth" levels of directories, each named
+// after the next "width" characters of the chunk ID. With step != width, the
+// names of the directories overlap or skip characters.
+func hashedRelPath(name string, width, depth, step int) string {
 	sb := strings.Builder{}
-	for i := 0; i < fr.hashDepth; i++ {
-		start := i * fr.hashDepth
-		sb.WriteString(name[start : start+fr.hashWidth])
+	for i := 0; i < depth; i++ {
+		start := i * step
+		sb.WriteString(name[start : start+width])
 		sb.WriteRune('/')
 	}
 	sb.WriteString(name)
 	return sb.String()
 }
 
+// The directories must be named after the characters of the chunk ID
+func validHashLayout(width, depth int) bool {
+	return width >= 0 && depth >= 0 && width*depth <= chunkIDLength
+}
+
+// Path of a chunk with the current layout
+func (fr *fileRepository) nameToRelPath(name string) string {
+	return hashedRelPath(name, fr.hashWidth, fr.hashDepth, fr.hashWidth)
+}
+
+// Paths of a chunk with the layouts used before the current one: the
+// configured previous layout, and the layout of the former releases that
+// advanced by hashDepth characters instead of hashWidth between the levels.
+func (fr *fileRepository) nameToLegacyRelPaths(name string) []string {
+	var paths []string
+	if fr.hashDepth > 1 && fr.hashDepth != fr.hashWidth {
+		paths = append(paths, hashedRelPath(name, fr.hashWidth, fr.hashDepth, fr.hashDepth))
+	}
+	if fr.prevHashWidth > 0 || fr.prevHashDepth > 0 {
+		paths = append(paths, hashedRelPath(name, fr.prevHashWidth, fr.prevHashDepth, fr.prevHashWidth))
+	}
+	return paths
+}
+
+// Find the path of an existing chunk, with the current layout first, then
+// the previous ones. The current layout is assumed when the chunk is absent.
+// Without previous layout, no syscall is issued.
+func (fr *fileRepository) findRelPath(name string) string {
+	relPath := fr.nameToRelPath(name)
+	legacy := fr.nameToLegacyRelPaths(name)
+	if len(legacy) <= 0 {
+		return relPath
+	}
+	if syscall.Faccessat(fr.rootFd, relPath, syscall.F_OK, 0) == nil {
+		return relPath
+	}
+	for _, p := range legacy {
+		if p != relPath && syscall.Faccessat(fr.rootFd, p, syscall.F_OK, 0) == nil {
+			return p
+		}
+	}
+	return relPath
+}
+
 func (fr *fileRepository) nameToAbsPath(name string) string {
 	return fr.relToAbsPath(fr.nameToRelPath(name))
 }
@@ -469,10 +732,103 @@ func xattrKey(name string) string {
 	return sb.String()
 }
 
+// Remove the pending files last modified before the deadline, left by the
+// uploads interrupted by a crash. With a deadline before the start of the
+// process, no upload in progress can own them. The committed chunks are
+// never touched.
+func (fr *fileRepository) sweepPending(deadline time.Time) (int, int64, error) {
+	var count int
+	var reclaimed int64
+	err := filepath.Walk(fr.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The file may have been committed or aborted meanwhile
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, pendingSuffix) || info.ModTime().After(deadline) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				LogWarning("Failed to remove the pending file %s: %v", path, err)
+			}
+			return nil
+		}
+		count++
+		reclaimed += info.Size()
+		return nil
+	})
+	return count, reclaimed, err
+}
+
+// Returned by the walk of the listing to stop it, never to the caller
+var errListComplete = errors.New("Listing complete")
+
+// Tell if the directory, named after the given prefix of the chunk IDs, may
+// hold chunks matching the prefix and following the marker.
+func listMayMatch(dirPrefix, prefix, marker string) bool {
+	if !strings.HasPrefix(dirPrefix, prefix) && !strings.HasPrefix(prefix, dirPrefix) {
+		return false
+	}
+	if len(marker) > len(dirPrefix) {
+		marker = marker[:len(dirPrefix)]
+	}
+	return dirPrefix >= marker
+}
+
+// List at most max chunks, in the lexical order of their IDs, matching the
+// prefix and strictly following the marker. The chunks are never opened,
+// their size comes with the walk of the directories. With the current layout
+// only, the directories that cannot match are skipped and the walk stops as
+// soon as the page is full. With previous layouts, the whole volume must be
+// walked.
+func (fr *fileRepository) list(prefix, marker string, max int) ([]listedChunk, bool, error) {
+	chunks := make([]listedChunk, 0)
+	legacy := len(fr.nameToLegacyRelPaths(strings.Repeat("0", chunkIDLength))) > 0
+	err := filepath.Walk(fr.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The chunk may have been deleted meanwhile
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if legacy || path == fr.root {
+				return nil
+			}
+			rel := strings.TrimPrefix(path, fr.root)
+			if !listMayMatch(strings.Replace(rel, "/", "", -1), prefix, marker) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		id := info.Name()
+		if !isValidChunkID(id) || id <= marker || !strings.HasPrefix(id, prefix) {
+			return nil
+		}
+		chunks = append(chunks, listedChunk{id: id, size: info.Size()})
+		if !legacy && len(chunks) > max {
+			return errListComplete
+		}
+		return nil
+	})
+	if err != nil && err != errListComplete {
+		return nil, false, err
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].id < chunks[j].id })
+	if len(chunks) > max {
+		return chunks[:max], true, nil
+	}
+	return chunks, false, nil
+}
+
 func pendingPath(path string) string {
 	sb := strings.Builder{}
 	sb.WriteString(path)
-	sb.WriteString(".pending")
+	sb.WriteString(pendingSuffix)
 	return sb.String()
 }
 
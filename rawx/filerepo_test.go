@@ -0,0 +1,509 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testChunkID = "0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"
+
+func newTestRepository(t *testing.T) (*fileRepository, func()) {
+	InitNoopLogger()
+	dir, err := ioutil.TempDir("", "rawx-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fileRepository{}
+	if err = fr.init(dir); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return fr, func() { os.RemoveAll(dir) }
+}
+
+func TestPutVisibleOnlyAfterCommit(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	out, err := fr.put(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = out.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fr.get(testChunkID); !os.IsNotExist(err) {
+		t.Fatalf("uncommitted chunk visible: %v", err)
+	}
+
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	in, err := fr.get(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if size := in.size(); size != 7 {
+		t.Errorf("expected 7 bytes, got %d", size)
+	}
+	if _, err = os.Stat(pendingPath(fr.nameToAbsPath(testChunkID))); !os.IsNotExist(err) {
+		t.Errorf("pending file left: %v", err)
+	}
+}
+
+func TestPutAbort(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	out, err := fr.put(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = out.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fr.get(testChunkID); !os.IsNotExist(err) {
+		t.Errorf("aborted chunk visible: %v", err)
+	}
+	if _, err = os.Stat(pendingPath(fr.nameToAbsPath(testChunkID))); !os.IsNotExist(err) {
+		t.Errorf("pending file left: %v", err)
+	}
+}
+
+func TestSweepPending(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	dir := filepath.Join(fr.root, "ABC")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	files := map[string]bool{
+		// name: expected to be removed
+		"ABC1" + pendingSuffix: true,
+		"ABC2" + pendingSuffix: false,
+		"ABC3":                 false,
+	}
+	for name, stale := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if stale || name == "ABC3" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	count, reclaimed, err := fr.sweepPending(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || reclaimed != 4 {
+		t.Errorf("expected 1 file and 4 bytes, got %d files and %d bytes", count, reclaimed)
+	}
+	for name, stale := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if stale != os.IsNotExist(err) {
+			t.Errorf("%s: unexpected state after the sweep: %v", name, err)
+		}
+	}
+}
+
+func TestNameToRelPath(t *testing.T) {
+	fr := &fileRepository{hashWidth: 3, hashDepth: 2}
+	expected := "012/345/" + testChunkID
+	if p := fr.nameToRelPath(testChunkID); p != expected {
+		t.Errorf("expected %s, got %s", expected, p)
+	}
+	fr.hashDepth = 0
+	if p := fr.nameToRelPath(testChunkID); p != testChunkID {
+		t.Errorf("expected %s, got %s", testChunkID, p)
+	}
+}
+
+func putTestChunk(t *testing.T, fr *fileRepository, data string) {
+	out, err := fr.put(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = out.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreviousLayout(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	// Written with the default layout, then the layout changes
+	putTestChunk(t, fr, "data")
+	fr.prevHashWidth, fr.prevHashDepth = fr.hashWidth, fr.hashDepth
+	fr.hashWidth, fr.hashDepth = 2, 3
+
+	in, err := fr.get(testChunkID)
+	if err != nil {
+		t.Fatalf("chunk not found with the previous layout: %v", err)
+	}
+	in.Close()
+	if _, err = fr.put(testChunkID); !os.IsExist(err) {
+		t.Errorf("chunk overwritten: %v", err)
+	}
+
+	if err = fr.del(testChunkID); err != nil {
+		t.Fatal(err)
+	}
+	putTestChunk(t, fr, "data")
+	if _, err = os.Stat(filepath.Join(fr.root, "01", "23", "45", testChunkID)); err != nil {
+		t.Errorf("chunk not written with the current layout: %v", err)
+	}
+	if in, err = fr.get(testChunkID); err != nil {
+		t.Fatal(err)
+	}
+	in.Close()
+}
+
+func TestList(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	ids := []string{
+		"0" + testChunkID[1:],
+		"1" + testChunkID[1:],
+		"10" + testChunkID[2:],
+		"F" + testChunkID[1:],
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		out, err := fr.put(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = out.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Neither the uploads in progress nor the foreign files are listed
+	if _, err := fr.put("2" + testChunkID[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	listIDs := func(prefix, marker string, max int) ([]string, bool, error) {
+		chunks, truncated, err := fr.list(prefix, marker, max)
+		ids := make([]string, 0, len(chunks))
+		for _, c := range chunks {
+			ids = append(ids, c.id)
+		}
+		return ids, truncated, err
+	}
+
+	var listed []string
+	marker := ""
+	for {
+		page, truncated, err := listIDs("", marker, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, page...)
+		if !truncated {
+			break
+		}
+		marker = page[len(page)-1]
+	}
+	if !reflect.DeepEqual(ids, listed) {
+		t.Errorf("expected %v, got %v", ids, listed)
+	}
+
+	page, truncated, err := listIDs("1", "", 10)
+	if err != nil || truncated || !reflect.DeepEqual(ids[1:3], page) {
+		t.Errorf("expected %v, got %v (%v)", ids[1:3], page, err)
+	}
+	page, _, err = listIDs("1", ids[1], 10)
+	if err != nil || !reflect.DeepEqual(ids[2:3], page) {
+		t.Errorf("expected %v, got %v (%v)", ids[2:3], page, err)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	putTestChunk(t, fr, "old")
+	out, err := fr.replace(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = out.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	// The former chunk is still served until the commit
+	if data, _ := ioutil.ReadFile(fr.nameToAbsPath(testChunkID)); string(data) != "old" {
+		t.Errorf("unexpected data before the commit: %s", data)
+	}
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(fr.nameToAbsPath(testChunkID)); string(data) != "new" {
+		t.Errorf("unexpected data after the commit: %s", data)
+	}
+}
+
+// Both the hard link and the copy must keep the compression of the source,
+// so that the destination is decompressed when downloaded.
+func TestLinkKeepsCompression(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	clear := bytes.Repeat([]byte("compressible "), 100)
+	packed := bytes.Buffer{}
+	z := zlib.NewWriter(&packed)
+	z.Write(clear)
+	z.Close()
+
+	out, err := fr.put(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(packed.Bytes())
+	out.setAttr(AttrNameCompression, []byte(compressionZlib))
+	out.setAttr(AttrNameChunkSize, []byte(strconv.Itoa(len(clear))))
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(dst string) {
+		buf := make([]byte, 64)
+		nb, err := fr.getAttr(dst, AttrNameCompression, buf)
+		if err != nil || string(buf[:nb]) != compressionZlib {
+			t.Errorf("%s: compression lost: %v", dst, err)
+		}
+		nb, err = fr.getAttr(dst, AttrNameChunkSize, buf)
+		if err != nil || string(buf[:nb]) != strconv.Itoa(len(clear)) {
+			t.Errorf("%s: size lost: %v", dst, err)
+		}
+		in, err := fr.get(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		zr, err := zlib.NewReader(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(data, clear) {
+			t.Errorf("%s: data altered: %v", dst, err)
+		}
+	}
+
+	linked := "1" + testChunkID[1:]
+	op, err := fr.link(testChunkID, linked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op.commit()
+	check(linked)
+
+	copied := "2" + testChunkID[1:]
+	op, err = fr.copyRelPath(fr.nameToRelPath(testChunkID), fr.nameToRelPath(copied))
+	if err != nil {
+		t.Fatal(err)
+	}
+	op.commit()
+	check(copied)
+}
+
+func TestPolicyVolumes(t *testing.T) {
+	primary, cleanup := newTestRepository(t)
+	defer cleanup()
+	ssd, cleanupSSD := newTestRepository(t)
+	defer cleanupSSD()
+	cr := &chunkRepository{sub: *primary, tiers: map[string]*fileRepository{"SSD": ssd}}
+
+	out, err := cr.putPolicy("SSD", testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("data"))
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !ssd.has(testChunkID) || primary.has(testChunkID) {
+		t.Fatal("chunk not stored on the volume of its policy")
+	}
+
+	// Unique among the volumes
+	if _, err = cr.putPolicy("", testChunkID); err != errChunkExists {
+		t.Errorf("duplicate chunk accepted: %v", err)
+	}
+
+	// Found wherever it is
+	in, err := cr.get(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.Close()
+	other := strings.Repeat("0", chunkIDLength)
+	out, err = cr.putPolicy("HDD", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	chunks, truncated, err := cr.list("", "", 10)
+	if err != nil || truncated || len(chunks) != 2 || chunks[0].id != other || chunks[1].id != testChunkID {
+		t.Errorf("unexpected listing %v %v: %v", chunks, truncated, err)
+	}
+	if chunks, truncated, _ = cr.list("", "", 1); len(chunks) != 1 || !truncated {
+		t.Errorf("unexpected listing %v %v", chunks, truncated)
+	}
+
+	// Replaced in place, or moved to the volume of its new policy
+	for _, policy := range []string{"SSD", "HDD"} {
+		out, err = cr.replacePolicy(policy, testChunkID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write([]byte(policy))
+		if err = out.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ssd.has(testChunkID) || !primary.has(testChunkID) {
+		t.Error("replaced chunk not moved to the volume of its policy")
+	}
+
+	if err = cr.del(testChunkID); err != nil || primary.has(testChunkID) {
+		t.Errorf("chunk not deleted: %v", err)
+	}
+}
+
+func TestPrecreateDirs(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+	fr.hashWidth, fr.hashDepth = 1, 2
+
+	if created, err := fr.precreateDirs(100); created != 0 || err != nil {
+		t.Errorf("too many directories created: %d %v", created, err)
+	}
+	if created, err := fr.precreateDirs(256); created != 16+256 || err != nil {
+		t.Fatalf("unexpected directories created: %d %v", created, err)
+	}
+	if created, err := fr.precreateDirs(256); created != 0 || err != nil {
+		t.Errorf("directories created twice: %d %v", created, err)
+	}
+
+	// The upload finds its directory, it has nothing to create: the leaf
+	// directory is the same, and its parent is left untouched
+	dir := filepath.Dir(fr.nameToAbsPath(testChunkID))
+	stat := func(path string) *syscall.Stat_t {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			t.Fatalf("directory %s missing: %v", path, err)
+		}
+		return info.Sys().(*syscall.Stat_t)
+	}
+	countDirs := func() int {
+		count := 0
+		filepath.Walk(fr.root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				count++
+			}
+			return nil
+		})
+		return count
+	}
+	leaf, parent, dirs := *stat(dir), *stat(filepath.Dir(dir)), countDirs()
+	// Any change would be visible in the timestamps
+	time.Sleep(10 * time.Millisecond)
+	putTestChunk(t, fr, "data")
+	if after := stat(dir); after.Ino != leaf.Ino {
+		t.Error("directory of the chunk created by the upload")
+	}
+	if after := stat(filepath.Dir(dir)); after.Mtim != parent.Mtim || after.Ino != parent.Ino {
+		t.Error("parent directory modified by the upload")
+	}
+	if after := countDirs(); after != dirs {
+		t.Errorf("directories created by the upload: %d then %d", dirs, after)
+	}
+	if _, err := os.Stat(fr.nameToAbsPath(testChunkID)); err != nil {
+		t.Errorf("chunk missing: %v", err)
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	out, err := fr.put(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = out.preallocate(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(pendingPath(fr.nameToAbsPath(testChunkID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("preallocation changed the size: %d", info.Size())
+	}
+	if info.Sys().(*syscall.Stat_t).Blocks*512 < 1024*1024 {
+		out.abort()
+		t.Skip("fallocate() not supported")
+	}
+
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(fr.root, &st); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.preallocate(2 * int64(st.Bavail) * st.Bsize); err != errNoSpace {
+		t.Errorf("preallocation beyond the free space: %v", err)
+	}
+
+	if _, err = out.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(fr.nameToAbsPath(testChunkID)); err != nil || info.Size() != 4 {
+		t.Errorf("unexpected size of the chunk: %v %v", info, err)
+	}
+}
@@ -0,0 +1,204 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Reads and updates the settings that may change without a restart. A GET
+replies the current settings, a POST carries a JSON object with the settings
+to change and replies the settings once changed, e.g.:
+	{"read_only": true, "log_level": "debug"}
+The whole update is refused if any of the settings is invalid. The updates
+require a secret to be configured, and sign their body and their time with
+the "admin" target, see auth.go.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// Target of the signature of the requests on the settings
+	adminTarget = "admin"
+
+	// Maximum size of the body of an update of the settings
+	adminMaxBodySize = 64 * 1024
+)
+
+type adminSettings struct {
+	ReadOnly            *bool   `json:"read_only,omitempty"`
+	LogLevel            *string `json:"log_level,omitempty"`
+	MaxConcurrentReads  *int32  `json:"max_concurrent_reads,omitempty"`
+	MaxConcurrentWrites *int32  `json:"max_concurrent_writes,omitempty"`
+	FreeSpaceMinBytes   *int64  `json:"free_space_min_bytes,omitempty"`
+	FreeSpaceMinPercent *int    `json:"free_space_min_percent,omitempty"`
+}
+
+func (rawx *rawxService) getSettings() adminSettings {
+	readOnly := rawx.isReadOnly()
+	logLevel := severityName()
+	maxReads := rawx.readLimit.getMax()
+	maxWrites := rawx.writeLimit.getMax()
+	minBytes, minPercent := rawx.freeSpace.get()
+	return adminSettings{
+		ReadOnly:            &readOnly,
+		LogLevel:            &logLevel,
+		MaxConcurrentReads:  &maxReads,
+		MaxConcurrentWrites: &maxWrites,
+		FreeSpaceMinBytes:   &minBytes,
+		FreeSpaceMinPercent: &minPercent,
+	}
+}
+
+func (s *adminSettings) validate() error {
+	if s.LogLevel != nil {
+		if _, ok := parseSeverity(*s.LogLevel); !ok {
+			return errInvalidBody
+		}
+	}
+	if (s.MaxConcurrentReads != nil && *s.MaxConcurrentReads < 0) ||
+		(s.MaxConcurrentWrites != nil && *s.MaxConcurrentWrites < 0) ||
+		(s.FreeSpaceMinBytes != nil && *s.FreeSpaceMinBytes < 0) ||
+		(s.FreeSpaceMinPercent != nil && (*s.FreeSpaceMinPercent < 0 || *s.FreeSpaceMinPercent > 100)) {
+		return errInvalidBody
+	}
+	return nil
+}
+
+// Apply the settings present, that must have been validated. Each change is
+// logged, for the sake of the audit.
+func (rr *rawxRequest) applySettings(s *adminSettings) {
+	rawx := rr.rawx
+	rawx.adminLock.Lock()
+	defer rawx.adminLock.Unlock()
+
+	audit := func(name string, value interface{}) {
+		LogInfo("Setting %s changed to %v (peer=%s reqid=%s)", name, value, rr.req.RemoteAddr, rr.reqid)
+	}
+	if s.ReadOnly != nil {
+		rawx.setReadOnly(*s.ReadOnly)
+		audit("read_only", *s.ReadOnly)
+	}
+	if s.LogLevel != nil {
+		severity, _ := parseSeverity(*s.LogLevel)
+		initVerbosity(severity)
+		audit("log_level", *s.LogLevel)
+	}
+	if s.MaxConcurrentReads != nil {
+		rawx.readLimit.setMax(*s.MaxConcurrentReads)
+		audit("max_concurrent_reads", *s.MaxConcurrentReads)
+	}
+	if s.MaxConcurrentWrites != nil {
+		rawx.writeLimit.setMax(*s.MaxConcurrentWrites)
+		audit("max_concurrent_writes", *s.MaxConcurrentWrites)
+	}
+	if s.FreeSpaceMinBytes != nil || s.FreeSpaceMinPercent != nil {
+		minBytes, minPercent := rawx.freeSpace.get()
+		if s.FreeSpaceMinBytes != nil {
+			minBytes = *s.FreeSpaceMinBytes
+			audit("free_space_min_bytes", minBytes)
+		}
+		if s.FreeSpaceMinPercent != nil {
+			minPercent = *s.FreeSpaceMinPercent
+			audit("free_space_min_percent", minPercent)
+		}
+		rawx.freeSpace.set(minBytes, minPercent)
+	}
+}
+
+func (rr *rawxRequest) updateSettings() {
+	body, err := ioutil.ReadAll(io.LimitReader(rr.req.Body, adminMaxBodySize+1))
+	if err != nil || len(body) > adminMaxBodySize {
+		rr.req.Close = true
+		rr.replyError("", errInvalidBody)
+		return
+	}
+	if !rr.rawx.signer.verifyBody(rr.req, adminTarget, body, time.Now()) {
+		rr.replyError("", errForbidden)
+		return
+	}
+
+	var settings adminSettings
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		rr.replyError("", errInvalidBody)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		rr.replyError("", err)
+		return
+	}
+	rr.applySettings(&settings)
+	rr.replySettings()
+}
+
+func (rr *rawxRequest) replySettings() {
+	rr.rep.Header().Set("Content-Type", "application/json")
+	rr.replyCode(http.StatusOK)
+	json.NewEncoder(rr.rep).Encode(rr.rawx.getSettings())
+}
+
+func (rr *rawxRequest) serveAdmin() {
+	var spent uint64
+	allowed := rr.rawx.clientAllowed(rr.req)
+	switch rr.req.Method {
+	case "GET":
+		if err := rr.drain(); err != nil {
+			rr.replyError("", err)
+		} else if !allowed || !rr.rawx.signer.verify(rr.req, adminTarget, time.Now()) {
+			rr.replyError("", errForbidden)
+		} else {
+			rr.replySettings()
+		}
+	case "POST":
+		// Without a secret, anyone could change the settings. The signature
+		// of the body is checked once it is read.
+		if !allowed || rr.rawx.signer == nil {
+			rr.replyError("", errForbidden)
+		} else {
+			rr.updateSettings()
+		}
+	default:
+		if err := rr.drain(); err != nil {
+			rr.replyError("", err)
+		} else {
+			rr.replyNotAllowed(adminAllowedMethods)
+		}
+	}
+	spent = IncrementStatReqOther(rr)
+
+	if shouldAccessLog(rr.status, rr.req.Method) {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.req.Host,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+			tls:       rr.req.TLS != nil,
+			err:       rr.err,
+		})
+	}
+}
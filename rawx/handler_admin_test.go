@@ -0,0 +1,139 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log/syslog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serveTestAdmin(rawx *rawxService, body string, signed bool) *httptest.ResponseRecorder {
+	return serveSignedAdmin(rawx, body, signed, time.Now())
+}
+
+func serveSignedAdmin(rawx *rawxService, body string, signed bool, when time.Time) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/admin", strings.NewReader(body))
+	if signed {
+		timestamp := strconv.FormatInt(when.Unix(), 10)
+		sig := rawx.signer.signBody("POST", adminTarget, timestamp, []byte(body))
+		req.Header.Set(HeaderNameTimestamp, timestamp)
+		req.Header.Set(HeaderNameSignature, hex.EncodeToString(sig))
+	}
+	rec := httptest.NewRecorder()
+	rr := &rawxRequest{rawx: rawx, req: req, rep: rec}
+	rr.serveAdmin()
+	return rec
+}
+
+func TestAdminSettings(t *testing.T) {
+	InitNoopLogger()
+	defer initVerbosity(currentSeverity())
+	rawx := &rawxService{
+		freeSpace: newFreeSpaceChecker(0, 0),
+		signer:    &requestSigner{secret: []byte("secret")},
+	}
+
+	// Signed and valid: all the settings are applied
+	rec := serveTestAdmin(rawx, `{"read_only": true, "log_level": "debug", "max_concurrent_writes": 4,
+		"free_space_min_percent": 5}`, true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var settings adminSettings
+	if err := json.NewDecoder(rec.Body).Decode(&settings); err != nil {
+		t.Fatal(err)
+	}
+	if !*settings.ReadOnly || *settings.LogLevel != "debug" || *settings.MaxConcurrentWrites != 4 ||
+		*settings.MaxConcurrentReads != 0 || *settings.FreeSpaceMinPercent != 5 {
+		t.Errorf("unexpected settings %s", rec.Body.String())
+	}
+	if !rawx.isReadOnly() || currentSeverity() != syslog.LOG_DEBUG || rawx.writeLimit.getMax() != 4 {
+		t.Error("settings not applied")
+	}
+
+	// Any invalid setting prevents the whole update
+	for _, body := range []string{
+		`{"read_only": false, "log_level": "verbose"}`,
+		`{"read_only": false, "free_space_min_percent": 101}`,
+		`{"read_only": false, "unknown": 1}`,
+		`not JSON`,
+	} {
+		if rec = serveTestAdmin(rawx, body, true); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status %d", body, rec.Code)
+		}
+	}
+	if !rawx.isReadOnly() {
+		t.Error("invalid update partially applied")
+	}
+
+	// Unsigned, or without a secret configured
+	if rec = serveTestAdmin(rawx, `{"read_only": false}`, false); rec.Code != http.StatusForbidden {
+		t.Errorf("unsigned update: unexpected status %d", rec.Code)
+	}
+	rawx.signer = nil
+	if rec = serveTestAdmin(rawx, `{"read_only": false}`, false); rec.Code != http.StatusForbidden {
+		t.Errorf("update without secret: unexpected status %d", rec.Code)
+	}
+	if !rawx.isReadOnly() {
+		t.Error("unauthorized update applied")
+	}
+}
+
+// The signature of an update covers its body and its time, and cannot be
+// replayed
+func TestAdminSignature(t *testing.T) {
+	InitNoopLogger()
+	rawx := &rawxService{
+		freeSpace: newFreeSpaceChecker(0, 0),
+		signer:    &requestSigner{secret: []byte("secret")},
+	}
+
+	now := time.Now()
+	body := `{"read_only": true}`
+	if rec := serveSignedAdmin(rawx, body, true, now); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	// The very same request, replayed
+	if rec := serveSignedAdmin(rawx, body, true, now); rec.Code != http.StatusForbidden {
+		t.Errorf("replayed update: unexpected status %d", rec.Code)
+	}
+	// Signed too long ago, or in the future
+	for _, when := range []time.Time{now.Add(-time.Hour), now.Add(time.Hour)} {
+		if rec := serveSignedAdmin(rawx, body, true, when); rec.Code != http.StatusForbidden {
+			t.Errorf("update signed at %v: unexpected status %d", when, rec.Code)
+		}
+	}
+
+	// The signature of another body
+	timestamp := strconv.FormatInt(now.Unix()+1, 10)
+	sig := rawx.signer.signBody("POST", adminTarget, timestamp, []byte(`{"read_only": true}`))
+	req := httptest.NewRequest("POST", "/admin", strings.NewReader(`{"read_only": false}`))
+	req.Header.Set(HeaderNameTimestamp, timestamp)
+	req.Header.Set(HeaderNameSignature, hex.EncodeToString(sig))
+	rec := httptest.NewRecorder()
+	(&rawxRequest{rawx: rawx, req: req, rep: rec}).serveAdmin()
+	if rec.Code != http.StatusForbidden || !rawx.isReadOnly() {
+		t.Errorf("altered body: unexpected status %d", rec.Code)
+	}
+}
@@ -17,33 +17,70 @@
 package main
 
 import (
+	"bytes"
 	"compress/flate"
+	"compress/gzip"
 	"compress/lzw"
 	"compress/zlib"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
 )
 
 var (
 	errNotImplemented        = errors.New("Not implemented")
 	errChunkExists           = errors.New("Chunk already exists")
+	errPreconditionFailed    = errors.New("Precondition failed")
 	errInvalidChunkID        = errors.New("Invalid chunk ID")
 	errCompressionNotManaged = errors.New("Compression mode not managed")
+	errChecksumNotManaged    = errors.New("Checksum algorithm not managed")
+	errChecksumMismatch      = errors.New("Checksum mismatch")
 	errMissingHeader         = errors.New("Missing mandatory header")
 	errInvalidHeader         = errors.New("Invalid header")
+	errInvalidBody           = errors.New("Invalid request body")
 	errInvalidRange          = errors.New("Invalid range")
 	errRangeNotSatisfiable   = errors.New("Range not satisfiable")
 	errListMarker            = errors.New("Invalid listing marker")
 	errListPrefix            = errors.New("Invalid listing prefix")
 	errContentLength         = errors.New("Invalid content length")
+	errChunkTooLarge         = errors.New("Chunk too large")
+	errNoSpace               = errors.New("Not enough space on the volume")
+	errOverloaded            = errors.New("Too many concurrent requests")
+	errTooManyRequests       = errors.New("Rate limit exceeded")
+	errForbidden             = errors.New("Client not allowed")
+	errReadTimeout           = errors.New("Client too slow to send the request")
+	errHeadersTooLarge       = errors.New("Request header too large")
+	errReadOnly              = errors.New("Service in read-only mode")
+	errWriteTimeout          = errors.New("Client too slow to read the reply")
+	errClientGone            = errors.New("Client disconnected")
+	errMethodNotAllowed      = errors.New("Method not allowed")
+	errUnexpectedHost        = errors.New("Unexpected host")
+	errNotModified           = errors.New("Not modified")
 )
 
 type uploadInfo struct {
@@ -90,9 +127,206 @@ func dumpBuffer(dst io.Writer, buf []byte) (written int, err error) {
 	return written, err
 }
 
+// Wraps a Reader and fails with errChunkTooLarge as soon as more than the
+// allowed amount of bytes has been read.
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n, errChunkTooLarge
+	}
+	return n, err
+}
+
+// Wraps the body of a request and fails with errReadTimeout when the client
+// sends nothing during the idle timeout. The deadline of the whole request
+// still applies.
+type idleReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	idle    time.Duration
+	expires time.Time
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(ir.idle)
+	if !ir.expires.IsZero() && ir.expires.Before(deadline) {
+		deadline = ir.expires
+	}
+	// The deadline cannot be set on all the connections (e.g. HTTP/2)
+	_ = ir.rc.SetReadDeadline(deadline)
+	n, err := ir.r.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = errReadTimeout
+	}
+	return n, err
+}
+
+// Wraps the reply and fails with errWriteTimeout when the client reads
+// nothing during the idle timeout. The deadline of the whole reply still
+// applies. The data sent by the HTTP server itself (e.g. with sendfile())
+// is sent by steps, so that the deadline is renewed.
+type idleWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	idle    time.Duration
+	expires time.Time
+	step    int64
+}
+
+func (iw *idleWriter) renew() {
+	deadline := time.Now().Add(iw.idle)
+	if !iw.expires.IsZero() && iw.expires.Before(deadline) {
+		deadline = iw.expires
+	}
+	_ = iw.rc.SetWriteDeadline(deadline)
+}
+
+func (iw *idleWriter) Write(p []byte) (int, error) {
+	iw.renew()
+	n, err := iw.w.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = errWriteTimeout
+	}
+	return n, err
+}
+
+func (iw *idleWriter) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		iw.renew()
+		n, err := io.CopyN(iw.w, r, iw.step)
+		total += n
+		if err == io.EOF {
+			return total, nil
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			return total, errWriteTimeout
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Wraps the body of a request and fails with errClientGone as soon as the
+// client disconnected, without waiting for the data already received to be
+// consumed.
+type contextReader struct {
+	r   io.Reader
+	ctx context.Context
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if cr.ctx.Err() != nil {
+		return 0, errClientGone
+	}
+	n, err := cr.r.Read(p)
+	if err != nil && err != io.EOF && cr.ctx.Err() != nil {
+		err = errClientGone
+	}
+	return n, err
+}
+
+// Wraps the reply and fails with errClientGone as soon as the client
+// disconnected. The data sent by the HTTP server itself is sent by steps, so
+// that the disconnection is checked in between.
+type contextWriter struct {
+	w    io.Writer
+	ctx  context.Context
+	step int64
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if cw.ctx.Err() != nil {
+		return 0, errClientGone
+	}
+	n, err := cw.w.Write(p)
+	if err != nil && cw.ctx.Err() != nil {
+		err = errClientGone
+	}
+	return n, err
+}
+
+func (cw *contextWriter) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		if cw.ctx.Err() != nil {
+			return total, errClientGone
+		}
+		n, err := io.CopyN(cw.w, r, cw.step)
+		total += n
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			if cw.ctx.Err() != nil {
+				err = errClientGone
+			}
+			return total, err
+		}
+	}
+}
+
+// Tell if the client announced the data is already compressed, or if the
+// extension of the content is known for data already compressed.
+func (rr *rawxRequest) incompressible() bool {
+	if GetBool(rr.req.Header.Get(HeaderNameIncompressible), false) {
+		return true
+	}
+	ext := strings.TrimPrefix(path.Ext(rr.chunk.ContentPath), ".")
+	return ext != "" && rr.rawx.incompressibleExt[strings.ToLower(ext)]
+}
+
+// Tell if an upload is large enough to be compressed. When its size is
+// unknown, up to min bytes are read ahead in a buffer of the pool, and the
+// returned reader replays them before the rest of the upload. The buffer is
+// returned too, it must be released once the upload is done. min must not
+// exceed the size of the buffers of the pool.
+func worthCompression(in io.Reader, length, min int64, pool bufferPool) (bool, io.Reader, []byte, error) {
+	if min <= 0 {
+		return true, in, nil, nil
+	}
+	if length >= 0 {
+		return length >= min, in, nil, nil
+	}
+	buf := pool.Acquire()
+	if int64(len(buf)) > min {
+		buf = buf[:min]
+	}
+	n, err := io.ReadFull(in, buf)
+	in = io.MultiReader(bytes.NewReader(buf[:n]), in)
+	switch err {
+	case nil:
+		return true, in, buf, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return false, in, buf, nil
+	default:
+		return false, in, buf, err
+	}
+}
+
+// Counts the bytes actually written, e.g. behind a compression filter
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
 type UploadFinal func(int64) error
 
-func copyReadWriteBuffer(dst io.Writer, src io.Reader, h hash.Hash, pool bufferPool, cb UploadFinal) error {
+// Copy the upload to the repository through a pooled buffer, while computing
+// its checksums when h is not nil. io.CopyBuffer is not used on purpose: the
+// reads are batched until the buffer is full to save syscalls, and the final
+// hook is interleaved before the write of the last block.
+func copyReadWriteBuffer(dst io.Writer, src io.Reader, h io.Writer, pool bufferPool, cb UploadFinal) error {
 	var written int64
 	var err error
 
@@ -103,7 +337,7 @@ func copyReadWriteBuffer(dst io.Writer, src io.Reader, h hash.Hash, pool bufferP
 		// Fill the buffer
 		totalr, er := fillBuffer(src, buf)
 
-		if totalr > 0 {
+		if totalr > 0 && h != nil {
 			h.Write(buf[:totalr])
 		}
 
@@ -144,6 +378,139 @@ func copyReadWriteBuffer(dst io.Writer, src io.Reader, h hash.Hash, pool bufferP
 	}
 }
 
+// Copy the data while computing its checksum. The last block is held back
+// until the checksum is validated against the expected value, so that the
+// client never receives the whole content of a corrupted chunk.
+func copyVerify(dst io.Writer, src io.Reader, h hash.Hash, expected string, pool bufferPool) (int64, error) {
+	var written int64
+	var pending []byte
+
+	bufs := [2][]byte{pool.Acquire(), pool.Acquire()}
+	defer pool.Release(bufs[0])
+	defer pool.Release(bufs[1])
+
+	for i := 0; ; i = 1 - i {
+		buf := bufs[i]
+		nr, er := fillBuffer(src, buf)
+		if nr > 0 {
+			h.Write(buf[:nr])
+		}
+		if er != nil && er != io.EOF {
+			return written, er
+		}
+
+		// The previous block is not the last, it may be sent
+		if len(pending) > 0 {
+			nw, ew := dumpBuffer(dst, pending)
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+		}
+		pending = buf[:nr]
+
+		if er == io.EOF {
+			actual := hex.EncodeToString(h.Sum(nil))
+			if !strings.EqualFold(actual, expected) {
+				return written, errChecksumMismatch
+			}
+			nw, ew := dumpBuffer(dst, pending)
+			return written + int64(nw), ew
+		}
+	}
+}
+
+// Castagnoli's polynomial, computed by the CPU when it has the instructions
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Build the hash computing the checksum of the chunks with the given algorithm.
+// An empty algorithm stands for the chunks saved before it was configurable.
+func newChecksum(algo string) (hash.Hash, error) {
+	switch algo {
+	case "", checksumAlgoMD5:
+		return md5.New(), nil
+	case checksumAlgoSHA256:
+		return sha256.New(), nil
+	case checksumAlgoSHA512:
+		return sha512.New(), nil
+	case checksumAlgoCRC32C:
+		return crc32.New(crc32cTable), nil
+	default:
+		return nil, errChecksumNotManaged
+	}
+}
+
+// Build the hash computing the secondary checksum, nil if not configured
+func (rr *rawxRequest) secondaryChecksum() hash.Hash {
+	if rr.rawx.checksumSecondaryAlgo == "" {
+		return nil
+	}
+	h, _ := newChecksum(rr.rawx.checksumSecondaryAlgo)
+	return h
+}
+
+// Resume the hash of the whole object with the state sent by the client, nil
+// if the client sent none. The state is the base64 of the binary state of the
+// hash, as replied to the upload of the previous chunk. Without state, the
+// hash starts with the chunk.
+func (rr *rawxRequest) objectChecksum() (hash.Hash, error) {
+	algo := rr.req.Header.Get(HeaderNameObjectChecksumAlgo)
+	state := rr.req.Header.Get(HeaderNameObjectChecksumState)
+	if algo == "" && state == "" {
+		return nil, nil
+	}
+	h, err := newChecksum(algo)
+	if err != nil {
+		return nil, errInvalidHeader
+	}
+	if state != "" {
+		u, ok := h.(encoding.BinaryUnmarshaler)
+		raw, err := base64.StdEncoding.DecodeString(state)
+		if !ok || err != nil || u.UnmarshalBinary(raw) != nil {
+			return nil, errInvalidHeader
+		}
+	}
+	return h, nil
+}
+
+// Reply the state of the hash of the whole object, and its current value
+func (rr *rawxRequest) replyObjectChecksum(h hash.Hash) {
+	if h == nil {
+		return
+	}
+	if m, ok := h.(encoding.BinaryMarshaler); ok {
+		if state, err := m.MarshalBinary(); err == nil {
+			rr.rep.Header().Set(HeaderNameObjectChecksumState, base64.StdEncoding.EncodeToString(state))
+		}
+	}
+	rr.rep.Header().Set(HeaderNameObjectChecksum, strings.ToUpper(hex.EncodeToString(h.Sum(nil))))
+}
+
+// Feed all the checksums at once, whichever is nil
+func checksumsWriter(hashes ...hash.Hash) io.Writer {
+	var writers []io.Writer
+	for _, h := range hashes {
+		if h != nil {
+			writers = append(writers, h)
+		}
+	}
+	switch len(writers) {
+	case 0:
+		return nil
+	case 1:
+		return writers[0]
+	}
+	return io.MultiWriter(writers...)
+}
+
+func (rr *rawxRequest) saveSecondaryChecksum(chunk *chunkInfo, h2 hash.Hash) {
+	chunk.secondaryHash, chunk.secondaryAlgo = "", ""
+	if h2 != nil {
+		chunk.secondaryHash = strings.ToUpper(hex.EncodeToString(h2.Sum(nil)))
+		chunk.secondaryAlgo = rr.rawx.checksumSecondaryAlgo
+	}
+}
+
 func (rr *rawxRequest) checksumRequired() bool {
 	return rr.rawx.checksumMode == checksumAlways || (rr.rawx.checksumMode == checksumSmart && !strings.HasPrefix(rr.chunk.ContentStgPol, "ec/"))
 }
@@ -153,56 +520,165 @@ func (rr *rawxRequest) uploadChunk() {
 	var out fileWriter
 	var h hash.Hash
 
+	// Whatever the outcome, tell the client the trailers it may send
+	rr.rep.Header().Set(HeaderNameAcceptTrailers, uploadTrailers)
+
 	if rr.chunk, err = retrieveHeaders(&rr.req.Header, rr.chunkID); err != nil {
 		rr.replyError("uploadChunk()", err)
-		// Discard request body
-		io.Copy(ioutil.Discard, rr.req.Body)
+		rr.discardBody()
+		return
+	}
+	// The hash of the whole object, resumed from the previous chunks
+	h3, err := rr.objectChecksum()
+	if err != nil {
+		rr.replyError("uploadChunk()", err)
+		rr.discardBody()
 		return
 	}
 
-	// Attempt a PUT in the repository
-	out, err = rr.rawx.repo.put(rr.chunkID)
+	// Fail early when the announced size is already too large, without
+	// reading the body: the connection will be closed.
+	max := rr.rawx.chunkSizeMax
+	if max > 0 && rr.req.ContentLength > max {
+		rr.replyError("uploadChunk()", errChunkTooLarge)
+		return
+	}
+
+	if GetBool(rr.req.Header.Get(HeaderNameDryRun), false) {
+		rr.dryRunUpload()
+		return
+	}
+
+	// The signature, when required, has already been checked
+	authenticated := rr.rawx.signer != nil || (rr.req.TLS != nil && len(rr.req.TLS.VerifiedChains) > 0)
+	client := rr.rawx.uploadLimiter.identify(rr.req, authenticated)
+	if ok, delay := rr.rawx.uploadLimiter.allow(client); !ok {
+		rr.rep.Header().Set("Retry-After", retryAfter(delay))
+		rr.replyError("", errTooManyRequests)
+		rr.discardBody()
+		return
+	}
+
+	if !rr.rawx.freeSpace.okPolicy(rr.rawx.repo, rr.chunk.ContentStgPol) {
+		rr.replyError("uploadChunk()", errNoSpace)
+		rr.discardBody()
+		return
+	}
+
+	// Attempt a PUT in the repository. The chunks are never overwritten, a
+	// client may tell it expects that with "If-None-Match: *". Unless the
+	// client tells which chunk it replaces with "If-Match".
+	if rr.req.Header.Get("If-Match") != "" {
+		if err = rr.checkIfMatch(); err == nil {
+			out, err = rr.repo().replacePolicy(rr.chunk.ContentStgPol, rr.chunkID)
+		} else if err == os.ErrNotExist {
+			err = errPreconditionFailed
+		}
+	} else {
+		out, err = rr.repo().putPolicy(rr.chunk.ContentStgPol, rr.chunkID)
+	}
 	if err != nil {
+		if err == errChunkExists && rr.req.Header.Get("If-None-Match") == "*" {
+			err = errPreconditionFailed
+		}
 		rr.replyError("uploadChunk()", err)
-		// Discard request body
-		io.Copy(ioutil.Discard, rr.req.Body)
+		rr.discardBody()
 		return
 	}
 
-	// In specific cases where the final chunk size is known, it might be useful to prepare a space on disk.
+	// When the final chunk size is known, its space is reserved at once: the
+	// file is less fragmented, and a volume too full fails the upload before
+	// any data is read.
 	if rr.req.ContentLength > 0 {
-		out.Extend(rr.req.ContentLength)
+		if err = out.preallocate(rr.req.ContentLength); err != nil {
+			out.abort()
+			rr.replyError("uploadChunk()", err)
+			rr.discardBody()
+			return
+		}
 	}
 
 	// Trigger the checksum only if configured so
 	if rr.checksumRequired() {
-		h = md5.New()
+		h, _ = newChecksum(rr.rawx.checksumAlgo)
+		rr.chunk.hashAlgo = rr.rawx.checksumAlgo
 	}
+	// The secondary checksum is always computed, when configured
+	h2 := rr.secondaryChecksum()
 
 	var ul uploadInfo
 
+	// All the pre-flight checks passed. If the client expects it, the
+	// "100 Continue" is sent by the HTTP server upon the first read.
+	//
+	// The limit applies on the clear data, whatever the compression
+	var in io.Reader = &contextReader{r: rr.req.Body, ctx: rr.req.Context()}
+	if rr.rawx.timeoutReadIdle > 0 {
+		ir := &idleReader{r: in, rc: http.NewResponseController(rr.rep), idle: rr.rawx.timeoutReadIdle}
+		if rr.rawx.timeoutReadRequest > 0 {
+			ir.expires = rr.startTime.Add(rr.rawx.timeoutReadRequest)
+		}
+		in = ir
+	}
+	if max > 0 {
+		in = &maxSizeReader{r: in, remaining: max}
+	}
+
+	// The small chunks and the already compressed data are not worth a
+	// compression
+	compression := rr.rawx.compression
+	if compression != "" && compression != compressionOff {
+		worth := !rr.incompressible()
+		if worth {
+			var head []byte
+			worth, in, head, err = worthCompression(in, rr.req.ContentLength, rr.rawx.compressionMinSize,
+				rr.rawx.dataBufferPool)
+			if head != nil {
+				defer rr.rawx.dataBufferPool.Release(head)
+			}
+			if err != nil {
+				rr.replyError("uploadChunk()", err)
+				out.abort()
+				return
+			}
+		}
+		if !worth {
+			compression = compressionOff
+		}
+	}
+
 	// Maybe intercept the upload with a compression filter
 	var z io.WriteCloser
-	switch rr.rawx.compression {
+	stored := &countingWriter{w: out}
+	switch compression {
 	case compressionZlib:
-		z = zlib.NewWriter(out)
+		z, err = zlib.NewWriterLevel(stored, rr.rawx.zlibLevel)
 	case compressionDeflate:
-		z, err = flate.NewWriter(out, 1)
+		z, err = flate.NewWriter(stored, 1)
 	case compressionLzw:
-		z = lzw.NewWriter(out, lzw.MSB, 8)
+		z = lzw.NewWriter(stored, lzw.MSB, 8)
+	case compressionZstd:
+		z, err = zstd.NewWriter(stored, zstd.WithEncoderConcurrency(1))
+	case compressionLz4:
+		z = lz4.NewWriter(stored)
 	case "", compressionOff:
 		z = nil
 	default:
 		err = errCompressionNotManaged
 	}
-	rr.chunk.compression = rr.rawx.compression
+	rr.chunk.compression = compression
 
 	// Destined to be called before the last chunk is written;
 	final := func(written int64) error {
 		ul.length = written
+		// A truncated body must not be committed
+		if rr.req.ContentLength >= 0 && written != rr.req.ContentLength {
+			return errContentLength
+		}
 		if h != nil {
 			ul.hash = strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
 		}
+		rr.saveSecondaryChecksum(&rr.chunk, h2)
 		// If a hash has been sent, it must match the hash computed
 		e := rr.chunk.patchWithTrailers(&rr.req.Trailer, ul)
 		// If everything went well, finish with the chunks XATTR management
@@ -215,33 +691,94 @@ func (rr *rawxRequest) uploadChunk() {
 
 	// Upload, and maybe manage compression
 	if z != nil {
-		err = copyReadWriteBuffer(z, rr.req.Body, h, rr.rawx.uploadBufferPool, final)
+		err = copyReadWriteBuffer(z, in, checksumsWriter(h, h2, h3), rr.rawx.dataBufferPool, final)
 		errClose := z.Close()
 		if err == nil {
 			err = errClose
 		}
 	} else if err == nil {
-		err = copyReadWriteBuffer(out, rr.req.Body, h, rr.rawx.uploadBufferPool, final)
+		err = copyReadWriteBuffer(stored, in, checksumsWriter(h, h2, h3), rr.rawx.dataBufferPool, final)
+	}
+	if err == io.ErrUnexpectedEOF {
+		// The client sent less than the announced Content-Length
+		err = errContentLength
 	}
 	rr.bytesIn = uint64(ul.length)
+	rr.bytesStored = uint64(stored.written)
+	rr.rawx.uploadLimiter.charge(client, ul.length)
 
 	// Then reply
-	if err != nil {
-		// Discard request body
-		io.Copy(ioutil.Discard, rr.req.Body)
+	if err == errClientGone {
+		// Nobody to reply to, nor any body left to discard
+		atomic.AddUint64(&counters.ReqAborted, 1)
+		LogWarning("Upload of %s aborted after %d bytes, the client disconnected (reqid=%s)",
+			rr.chunkID, ul.length, rr.reqid)
+		rr.replyError("", err)
+		out.abort()
+	} else if err != nil {
+		// Discard request body, unless it is known to be too large
+		if err != errChunkTooLarge {
+			io.Copy(ioutil.Discard, rr.req.Body)
+		}
 		rr.replyError("uploadChunk()", err)
 		out.abort()
+	} else if err = rr.commitIfMatch(out); err != nil {
+		// commit() already cleaned the temporary file
+		rr.replyError("uploadChunk()", err)
 	} else {
-		out.commit()
 		//rr.rep.Header().Set("Content-Length", "0")
 		rr.rep.Header().Set("Connection", "keep-alive")
 		rr.req.Close = false
 		rr.chunk.fillHeadersLight(rr.rep.Header())
-		rr.replyCode(http.StatusCreated)
+		rr.rep.Header().Set(HeaderNameClearSize, itoa64(ul.length))
+		rr.rep.Header().Set(HeaderNameStoredSize, itoa64(stored.written))
+		rr.replyObjectChecksum(h3)
+		rr.replyCreated(rr.chunkID)
 		rr.rawx.notifier.notifyNew(rr.reqid, rr.chunk)
 	}
 }
 
+// Reply what an upload would, after the checks of its headers, without its
+// data: the body is left unread and nothing is written.
+func (rr *rawxRequest) dryRunUpload() {
+	var err error
+	if !rr.rawx.freeSpace.okPolicy(rr.rawx.repo, rr.chunk.ContentStgPol) {
+		err = errNoSpace
+	} else if rr.req.Header.Get("If-Match") != "" {
+		if err = rr.checkIfMatch(); err == os.ErrNotExist {
+			err = errPreconditionFailed
+		}
+	} else if in, errGet := rr.repo().get(rr.chunkID); errGet == nil {
+		in.Close()
+		err = errChunkExists
+		if rr.req.Header.Get("If-None-Match") == "*" {
+			err = errPreconditionFailed
+		}
+	} else if errGet != os.ErrNotExist {
+		err = errGet
+	}
+	if err != nil {
+		rr.replyError("uploadChunk()", err)
+		return
+	}
+	rr.replyCode(http.StatusNoContent)
+}
+
+// Reply "201 Created" with the URL of the new chunk. The host is the one
+// the client contacted, already checked to designate this service.
+func (rr *rawxRequest) replyCreated(chunkID string) {
+	scheme := "http"
+	if rr.req.TLS != nil {
+		scheme = "https"
+	}
+	host := rr.req.Host
+	if host == "" {
+		host = rr.rawx.url
+	}
+	rr.rep.Header().Set("Location", scheme+"://"+host+"/"+chunkID)
+	rr.replyCode(http.StatusCreated)
+}
+
 func (rr *rawxRequest) copyChunk() {
 	var err error
 	if rr.chunk, err = retrieveDestinationHeader(&rr.req.Header, rr.rawx, rr.chunkID); err != nil {
@@ -253,8 +790,18 @@ func (rr *rawxRequest) copyChunk() {
 		return
 	}
 
+	// A subrange of the source cannot be linked, it is copied
+	if spec := rr.req.Header.Get(HeaderNameCopySourceRange); spec != "" {
+		if err = rr.copyChunkRange(spec); err != nil {
+			rr.replyError("copyChunk()", err)
+		} else {
+			rr.replyCreated(rr.chunk.ChunkID)
+		}
+		return
+	}
+
 	// Attempt a LINK in the repository
-	op, err := rr.rawx.repo.link(rr.chunkID, rr.chunk.ChunkID)
+	op, err := rr.repo().link(rr.chunkID, rr.chunk.ChunkID)
 	if err != nil {
 		rr.replyError("copyChunk()", err)
 	} else {
@@ -268,13 +815,100 @@ func (rr *rawxRequest) copyChunk() {
 		} else {
 			// The link already exists and has an xattr. Commit is a matter of sync.
 			_ = op.commit()
-			rr.replyCode(http.StatusCreated)
+			rr.replyCreated(rr.chunk.ChunkID)
 		}
 	}
 }
 
+// Write a new chunk out of a range of the source chunk. The XATTR of the
+// source are kept, but the hash and the size that are computed on the range,
+// and the identity of the new chunk. The new chunk is stored uncompressed.
+func (rr *rawxRequest) copyChunkRange(spec string) error {
+	dst := rr.chunk
+
+	inChunk, err := rr.repo().get(rr.chunkID)
+	if err != nil {
+		return err
+	}
+	defer inChunk.Close()
+
+	if rr.chunk, err = loadAttr(inChunk, rr.chunkID, rr.reqid); err != nil {
+		return err
+	}
+	rr.patchUnknownSize(inChunk)
+	if rr.chunk.size < 0 {
+		return errRangeNotSatisfiable
+	}
+
+	spec, ok := hasPrefix(spec, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return errInvalidHeader
+	}
+	ri, ok, err := parseRangeSpec(spec, rr.chunk.size)
+	if !ok {
+		return errInvalidHeader
+	} else if err != nil {
+		return err
+	}
+
+	if !rr.rawx.freeSpace.okPolicy(rr.rawx.repo, rr.chunk.ContentStgPol) {
+		return errNoSpace
+	}
+
+	in, filter, err := rr.getChunkReader(inChunk, rr.chunk.size, ri)
+	if filter != nil {
+		defer filter.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	h, err := newChecksum(rr.chunk.hashAlgo)
+	if err != nil {
+		return err
+	}
+	h2 := rr.secondaryChecksum()
+
+	// The copy keeps the storage policy of the source
+	out, err := rr.repo().putPolicy(rr.chunk.ContentStgPol, dst.ChunkID)
+	if err != nil {
+		return err
+	}
+	// The size of the copy is known, its space is reserved at once as for
+	// the uploads
+	if err = out.preallocate(ri.size); err != nil {
+		out.abort()
+		return err
+	}
+
+	chunk := rr.chunk
+	chunk.ChunkID = dst.ChunkID
+	chunk.ContentFullpath = dst.ContentFullpath
+	chunk.ContainerID = dst.ContainerID
+	chunk.ContentPath = dst.ContentPath
+	chunk.ContentVersion = dst.ContentVersion
+	chunk.ContentID = dst.ContentID
+	chunk.compression = compressionOff
+	chunk.OioVersion = OioVersion
+	final := func(written int64) error {
+		if written != ri.size {
+			return io.ErrUnexpectedEOF
+		}
+		chunk.ChunkSize = strconv.FormatInt(written, 10)
+		chunk.ChunkHash = strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+		rr.saveSecondaryChecksum(&chunk, h2)
+		return chunk.saveAttr(out)
+	}
+	if err = copyReadWriteBuffer(out, in, checksumsWriter(h, h2), rr.rawx.dataBufferPool, final); err != nil {
+		out.abort()
+		return err
+	}
+	rr.chunk = chunk
+	return out.commit()
+}
+
 func (rr *rawxRequest) checkChunk() {
-	chunkIn, err := rr.rawx.repo.get(rr.chunkID)
+	chunkIn, err := rr.repo().get(rr.chunkID)
 	if err != nil {
 		rr.replyError("checkChunk()", err)
 		return
@@ -287,16 +921,18 @@ func (rr *rawxRequest) checkChunk() {
 		rr.replyError("", err)
 		return
 	}
+	rr.patchUnknownSize(chunkIn)
 
-	// FIXME(jfs): generalize the check of chunkInfo
-	if rr.chunk.ChunkHash == "" {
-		rr.replyError("checkChunk()", errMissingXattr(AttrNameChunkChecksum, nil))
-		return
-	}
-
+	// Missing XATTR are tolerated, the reply exposes what has been loaded,
+	// unless the hash has to be checked against the stored value.
 	if GetBool(rr.req.Header.Get(HeaderNameCheckHash), false) {
 		expected_hash := rr.req.Header.Get(HeaderNameChunkChecksum)
 		if expected_hash == "" {
+			// FIXME(jfs): generalize the check of chunkInfo
+			if rr.chunk.ChunkHash == "" {
+				rr.replyError("checkChunk()", errMissingXattr(AttrNameChunkChecksum, nil))
+				return
+			}
 			expected_hash = rr.chunk.ChunkHash
 		}
 		expected_hash = strings.ToUpper(expected_hash)
@@ -313,7 +949,11 @@ func (rr *rawxRequest) checkChunk() {
 			defer filter.Close()
 		}
 
-		h := md5.New()
+		var h hash.Hash
+		if h, err = newChecksum(rr.chunk.hashAlgo); err != nil {
+			rr.replyError("checkChunk()", err)
+			return
+		}
 		if _, err = io.Copy(h, in); err == nil {
 			actual_hash := strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
 			if expected_hash != actual_hash {
@@ -331,28 +971,83 @@ func (rr *rawxRequest) checkChunk() {
 
 	headers := rr.rep.Header()
 	rr.chunk.fillHeaders(headers)
-	headers.Set("Content-Length", strconv.FormatUint(uint64(rr.chunk.size), 10))
 	headers.Set("Accept-Ranges", "bytes")
-	rr.replyCode(http.StatusOK)
-}
 
-func (rr *rawxRequest) getRange(chunkSize int64) (rangeInfo, error) {
-	ri := rangeInfo{}
-	headerRange := rr.req.Header.Get("Range")
-	if headerRange == "" || chunkSize == 0 {
-		return ri, nil
+	// The range is checked as a GET would serve it. Several ranges are
+	// answered as the whole chunk: the multipart reply is only built upon a
+	// GET, its length is unknown beforehand.
+	ranges, err := rr.getRanges(rr.chunk.size)
+	if err != nil {
+		if err == errRangeNotSatisfiable {
+			headers.Set("Content-Range", "bytes */"+itoa64(rr.chunk.size))
+		}
+		rr.replyError("checkChunk()", err)
+		return
+	}
+	if len(ranges) == 1 {
+		ri := ranges[0]
+		headers.Set("Content-Range", packRangeHeader(ri.offset, ri.last, rr.chunk.size))
+		headers.Set("Content-Length", strconv.FormatUint(uint64(ri.size), 10))
+		rr.replyCode(http.StatusPartialContent)
+		return
+	}
+	// As a GET would, announce the trailer instead of the length
+	if acceptsTrailers(rr.req) {
+		if _, err = newChecksum(rr.chunk.hashAlgo); err == nil {
+			headers.Set("Trailer", HeaderNameComputedChecksum)
+			rr.replyCode(http.StatusOK)
+			return
+		}
 	}
+	if rr.chunk.size >= 0 {
+		headers.Set("Content-Length", strconv.FormatUint(uint64(rr.chunk.size), 10))
+	}
+	rr.replyCode(http.StatusOK)
+}
 
+// Parse a single range specification of a "Range" header, i.e. one of the
+// comma-separated items after "bytes=", and compute the offset and the size
+// of the range given the size of the chunk. Closed ("500-999"), open-ended
+// ("500-") and suffix ("-500") ranges are managed. A malformed specification
+// is reported with ok set to false, a valid but unsatisfiable one with
+// errRangeNotSatisfiable.
+func parseRangeSpec(spec string, chunkSize int64) (ri rangeInfo, ok bool, err error) {
 	var offset int64
 	var last int64
-	if nb, err := fmt.Sscanf(headerRange, "bytes=%d-%d", &offset, &last); err != nil || nb != 2 {
-		return ri, nil
+	spec = strings.TrimSpace(spec)
+	if suffix, isSuffix := hasPrefix(spec, "-"); isSuffix {
+		// Suffix range, i.e. the last bytes of the chunk. Whether the data
+		// is compressed or not, the offsets are computed on the clear data.
+		length, err := strconv.ParseInt(suffix, 10, 64)
+		if err != nil || length < 0 {
+			return ri, false, nil
+		}
+		if length == 0 {
+			return ri, true, errRangeNotSatisfiable
+		}
+		if length > chunkSize {
+			length = chunkSize
+		}
+		offset = chunkSize - length
+		last = chunkSize - 1
+	} else if start, isOpen := hasSuffix(spec, "-"); isOpen {
+		// Open-ended range, from the offset to the end of the chunk
+		var err error
+		if offset, err = strconv.ParseInt(start, 10, 64); err != nil {
+			return ri, false, nil
+		}
+		last = chunkSize - 1
+		if offset >= chunkSize {
+			return ri, true, errRangeNotSatisfiable
+		}
+	} else if nb, err := fmt.Sscanf(spec, "%d-%d", &offset, &last); err != nil || nb != 2 {
+		return ri, false, nil
 	}
 	if offset < 0 || last < 0 || offset > last {
-		return ri, nil
+		return ri, false, nil
 	}
 	if offset >= chunkSize {
-		return ri, errInvalidRange
+		return ri, true, errRangeNotSatisfiable
 	}
 	if last >= chunkSize {
 		last = chunkSize - 1
@@ -360,11 +1055,43 @@ func (rr *rawxRequest) getRange(chunkSize int64) (rangeInfo, error) {
 	ri.offset = offset
 	ri.last = last
 	ri.size = last - offset + 1
-	return ri, nil
+	return ri, true, nil
+}
+
+// Load the ranges asked in the request. A malformed "Range" header is ignored
+// as a whole, while unsatisfiable items are only an error if no other item
+// can be served.
+func (rr *rawxRequest) getRanges(chunkSize int64) ([]rangeInfo, error) {
+	headerRange := rr.req.Header.Get("Range")
+	if headerRange == "" || chunkSize <= 0 {
+		return nil, nil
+	}
+	specs, ok := hasPrefix(headerRange, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	ranges := make([]rangeInfo, 0, 1)
+	unsatisfiable := false
+	for _, spec := range strings.Split(specs, ",") {
+		ri, ok, err := parseRangeSpec(spec, chunkSize)
+		if !ok {
+			return nil, nil
+		}
+		if err != nil {
+			unsatisfiable = true
+		} else {
+			ranges = append(ranges, ri)
+		}
+	}
+	if len(ranges) <= 0 && unsatisfiable {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
 }
 
 func (rr *rawxRequest) downloadChunk() {
-	inChunk, err := rr.rawx.repo.get(rr.chunkID)
+	inChunk, err := rr.repo().get(rr.chunkID)
 	if err != nil {
 		rr.replyError("downloadChunk()", err)
 		return
@@ -375,6 +1102,52 @@ func (rr *rawxRequest) downloadChunk() {
 		rr.replyError("downloadChunk()", err)
 		return
 	}
+	rr.patchUnknownSize(inChunk)
+
+	mtime := inChunk.mtime()
+	if !mtime.IsZero() {
+		rr.rep.Header().Set("Last-Modified", mtime.UTC().Format(http.TimeFormat))
+	}
+	// The entity tag is the hash of the clear content, whatever the range
+	if etag := rr.chunk.etag(); etag != "" {
+		rr.rep.Header().Set("ETag", etag)
+		if etagMatches(rr.req.Header.Get("If-None-Match"), etag) {
+			rr.replyErrorCode(http.StatusNotModified, errNotModified)
+			return
+		}
+	}
+	// If-Modified-Since is ignored when If-None-Match is present
+	if rr.req.Header.Get("If-None-Match") == "" && !mtime.IsZero() &&
+		notModifiedSince(rr.req.Header.Get("If-Modified-Since"), mtime) {
+		rr.replyErrorCode(http.StatusNotModified, errNotModified)
+		return
+	}
+
+	// An empty chunk is a legit empty object, there is nothing to read
+	// unless the (empty) data has to be hashed.
+	if rr.chunk.size == 0 && !rr.rawx.verifyRead && !acceptsTrailers(rr.req) {
+		headers := rr.rep.Header()
+		rr.chunk.fillHeaders(headers)
+		headers.Set("Content-Length", "0")
+		rr.replyCode(http.StatusOK)
+		return
+	}
+
+	// A compressed chunk is sent as is to the clients able to decode it,
+	// unless a range of the clear data is requested.
+	if encoding := contentEncoding(rr.chunk.compression); encoding != "" {
+		rr.rep.Header().Set("Vary", "Accept-Encoding")
+		if rr.req.Header.Get("Range") == "" && acceptsEncoding(rr.req, encoding) {
+			rr.downloadEncoded(inChunk, encoding)
+			return
+		}
+	} else if rr.rawx.gzipDownload {
+		rr.rep.Header().Set("Vary", "Accept-Encoding")
+		if rr.req.Header.Get("Range") == "" && acceptsEncoding(rr.req, "gzip") && rr.gzipWorth() {
+			rr.downloadGzip(inChunk)
+			return
+		}
+	}
 
 	var rangeInf rangeInfo
 	// A potential decompression filter
@@ -383,12 +1156,32 @@ func (rr *rawxRequest) downloadChunk() {
 	var in *io.LimitedReader
 
 	// Load the range, with the specific case of the compression
-	rangeInf, err = rr.getRange(rr.chunk.size)
+	ranges, err := rr.getRanges(rr.chunk.size)
 	if err != nil {
+		if err == errRangeNotSatisfiable {
+			rr.rep.Header().Set("Content-Range", "bytes */"+itoa64(rr.chunk.size))
+		}
 		rr.replyError("downloadChunk()", err)
 		return
 	}
 
+	// Multiple ranges are served in a multipart reply, unless the norm allows
+	// us to answer a "200 OK" with the complete content because it is cheaper:
+	// i.e. when the ranges cover the whole chunk or when the chunk is
+	// compressed and should be decompressed from its start for each range.
+	if len(ranges) > 1 {
+		var total int64
+		for _, ri := range ranges {
+			total += ri.size
+		}
+		if total < rr.chunk.size && !rr.chunk.compressed() {
+			rr.downloadRanges(inChunk, ranges)
+			return
+		}
+	} else if len(ranges) == 1 {
+		rangeInf = ranges[0]
+	}
+
 	in, filter, err = rr.getChunkReader(inChunk, rr.chunk.size, rangeInf)
 	if filter != nil {
 		defer filter.Close()
@@ -398,38 +1191,306 @@ func (rr *rawxRequest) downloadChunk() {
 		return
 	}
 
+	// The checksum of the data is computed while it is sent, either to verify
+	// the chunk or to let the client verify what it received.
+	var h hash.Hash
+	verify := rr.rawx.verifyRead && rr.chunk.ChunkHash != "" && rangeInf.isVoid()
+	trailer := rangeInf.isVoid() && acceptsTrailers(rr.req)
+	if verify || trailer {
+		if h, err = newChecksum(rr.chunk.hashAlgo); err != nil {
+			LogWarning(msgErrorAction("newChecksum()", rr.reqid, err))
+			verify, trailer = false, false
+		}
+	}
+
 	// Prepare the headers of the reply
 	headers := rr.rep.Header()
 	rr.chunk.fillHeaders(headers)
+	if trailer {
+		headers.Set("Trailer", HeaderNameComputedChecksum)
+	}
 	if !rangeInf.isVoid() {
 		headers.Set("Content-Range", packRangeHeader(rangeInf.offset, rangeInf.last, rr.chunk.size))
 		headers.Set("Content-Length", strconv.FormatUint(uint64(rangeInf.size), 10))
 		rr.replyCode(http.StatusPartialContent)
 	} else {
-		headers.Set("Content-Length", strconv.FormatUint(uint64(rr.chunk.size), 10))
+		// An unknown length makes the reply use the chunked transfer encoding,
+		// the only one able to carry trailers.
+		if rr.chunk.size >= 0 && !trailer {
+			headers.Set("Content-Length", strconv.FormatUint(uint64(rr.chunk.size), 10))
+		}
 		rr.replyCode(http.StatusOK)
 	}
 
 	// Now transmit the clear data to the client
-	nb, err := io.Copy(rr.rep, in)
+	var nb int64
+	if verify {
+		nb, err = copyVerify(rr.guardWrites(rr.rep), in, h, rr.chunk.ChunkHash, rr.rawx.dataBufferPool)
+		rr.checkStalled(nb, err)
+		if err == errChecksumMismatch {
+			LogError("Corrupted chunk %s, download aborted (reqid=%s)", rr.chunkID, rr.reqid)
+			// The reply is interrupted so that the client cannot mistake the
+			// truncated data for a complete chunk, but only once the request
+			// is counted and logged.
+			rr.err = err
+			rr.abort = true
+			return
+		}
+	} else {
+		if rr.rawx.verifyRead && !rangeInf.isVoid() {
+			LogDebug("Checksum not verified on a range download of %s (reqid=%s)", rr.chunkID, rr.reqid)
+		}
+		if h != nil {
+			nb, err = rr.sendData(rr.rep, io.TeeReader(in, h), false)
+		} else {
+			nb, err = rr.sendData(rr.rep, in, filter == nil)
+		}
+	}
 	if err == nil {
 		rr.bytesOut = rr.bytesOut + uint64(nb)
+		if trailer {
+			headers.Set(HeaderNameComputedChecksum, strings.ToUpper(hex.EncodeToString(h.Sum(nil))))
+		}
 	} else {
 		LogError(msgErrorAction("Write()", rr.reqid, err))
 	}
 }
 
+type writerOnly struct {
+	io.Writer
+}
+
+// Copy the data to the client through a buffer of the configured size. The
+// plain content of a file is rather sent by the HTTP server itself, with the
+// help of sendfile() whenever possible.
+func (rr *rawxRequest) sendData(dst io.Writer, in io.Reader, plain bool) (nb int64, err error) {
+	dst = rr.guardWrites(dst)
+	defer func() { rr.checkStalled(nb, err) }()
+	if plain {
+		return io.Copy(dst, in)
+	}
+	buf := rr.rawx.dataBufferPool.Acquire()
+	defer rr.rawx.dataBufferPool.Release(buf)
+	// Hide a potential ReaderFrom that would ignore the buffer
+	return io.CopyBuffer(writerOnly{dst}, in, buf)
+}
+
+// Protect the writes of the reply against the clients that stop reading or
+// that disconnect
+func (rr *rawxRequest) guardWrites(dst io.Writer) io.Writer {
+	step := int64(rr.rawx.bufferSize)
+	if step <= 0 {
+		step = uploadBufferSizeDefault
+	}
+	if rr.rawx.timeoutWriteIdle > 0 {
+		iw := &idleWriter{
+			w:    dst,
+			rc:   http.NewResponseController(rr.rep),
+			idle: rr.rawx.timeoutWriteIdle,
+			step: step,
+		}
+		if rr.rawx.timeoutWrite > 0 {
+			iw.expires = rr.startTime.Add(rr.rawx.timeoutWrite)
+		}
+		dst = iw
+	}
+	return &contextWriter{w: dst, ctx: rr.req.Context(), step: step}
+}
+
+// Account for the downloads cut because the client stopped reading or
+// disconnected
+func (rr *rawxRequest) checkStalled(sent int64, err error) {
+	switch err {
+	case errWriteTimeout:
+		atomic.AddUint64(&counters.RepStalled, 1)
+		rr.req.Close = true
+		LogWarning("Download of %s truncated after %d bytes, the client stopped reading (reqid=%s)",
+			rr.chunkID, sent, rr.reqid)
+	case errClientGone:
+		atomic.AddUint64(&counters.RepAborted, 1)
+		LogWarning("Download of %s aborted after %d bytes, the client disconnected (reqid=%s)",
+			rr.chunkID, sent, rr.reqid)
+	}
+}
+
+// Tell if the client announced it accepts trailers in a chunked reply
+func acceptsTrailers(req *http.Request) bool {
+	for _, v := range req.Header[textproto.CanonicalMIMEHeaderKey("TE")] {
+		for _, t := range strings.Split(v, ",") {
+			if i := strings.IndexByte(t, ';'); i >= 0 {
+				t = t[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(t), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Send the compressed content of the chunk without decoding it. The checksum
+// of the chunk, computed on the clear data, cannot be verified.
+func (rr *rawxRequest) downloadEncoded(inChunk fileReader, encoding string) {
+	headers := rr.rep.Header()
+	rr.chunk.fillHeaders(headers)
+	headers.Set("Content-Encoding", encoding)
+	headers.Set("Content-Length", itoa64(inChunk.size()))
+	// The representation differs from the clear content
+	if etag := rr.chunk.etag(); etag != "" {
+		headers.Set("ETag", "W/"+etag)
+	}
+	rr.replyCode(http.StatusOK)
+
+	nb, err := rr.sendData(rr.rep, chunkData(inChunk), true)
+	rr.bytesOut = rr.bytesOut + uint64(nb)
+	if err != nil {
+		LogError(msgErrorAction("Write()", rr.reqid, err))
+	}
+}
+
+// Tell if an uncompressed chunk is worth a compression on the fly, judging by
+// its size and its type
+func (rr *rawxRequest) gzipWorth() bool {
+	if rr.chunk.compressed() || rr.chunk.size < rr.rawx.gzipMinSize {
+		return false
+	}
+	t, _, err := mime.ParseMediaType(rr.chunk.contentType())
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(t, "text/") || strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml") {
+		return true
+	}
+	switch t {
+	case "application/json", "application/xml", "application/javascript", "application/x-ndjson":
+		return true
+	}
+	return false
+}
+
+// Compress the clear content of the chunk on the fly. The length of the reply
+// is unknown, the chunked transfer encoding applies.
+func (rr *rawxRequest) downloadGzip(inChunk fileReader) {
+	headers := rr.rep.Header()
+	rr.chunk.fillHeaders(headers)
+	headers.Set("Content-Encoding", "gzip")
+	// The representation differs from the clear content
+	if etag := rr.chunk.etag(); etag != "" {
+		headers.Set("ETag", "W/"+etag)
+	}
+	rr.replyCode(http.StatusOK)
+
+	buf := rr.rawx.dataBufferPool.Acquire()
+	defer rr.rawx.dataBufferPool.Release(buf)
+	sent := &countingWriter{w: rr.guardWrites(rr.rep)}
+	z, _ := gzip.NewWriterLevel(sent, gzip.BestSpeed)
+	_, err := io.CopyBuffer(z, inChunk, buf)
+	if errClose := z.Close(); err == nil {
+		err = errClose
+	}
+	rr.bytesOut = rr.bytesOut + uint64(sent.written)
+	rr.checkStalled(sent.written, err)
+	if err != nil {
+		LogError(msgErrorAction("Write()", rr.reqid, err))
+	}
+}
+
+// The HTTP content coding matching the compression of a chunk, if any.
+// The "deflate" coding is actually the zlib format.
+func contentEncoding(compression string) string {
+	switch compression {
+	case compressionZlib:
+		return "deflate"
+	case compressionZstd:
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// Tell if the client announced it accepts the given content coding
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, v := range req.Header[textproto.CanonicalMIMEHeaderKey("Accept-Encoding")] {
+		for _, t := range strings.Split(v, ",") {
+			params := ""
+			if i := strings.IndexByte(t, ';'); i >= 0 {
+				t, params = t[:i], t[i+1:]
+			}
+			if !strings.EqualFold(strings.TrimSpace(t), encoding) {
+				continue
+			}
+			// An explicit "q=0" refuses the coding
+			q := strings.Replace(strings.TrimSpace(params), " ", "", -1)
+			return !strings.HasPrefix(q, "q=0") || strings.Trim(q[2:], "0.") != ""
+		}
+	}
+	return false
+}
+
+// When the XATTR telling the size of the chunk is missing, the size of the file
+// is authoritative for uncompressed chunks. For compressed chunks the size
+// remains unknown and the data will be streamed until its end.
+func (rr *rawxRequest) patchUnknownSize(inChunk fileReader) {
+	if rr.chunk.size < 0 && !rr.chunk.compressed() {
+		rr.chunk.size = inChunk.size()
+	}
+}
+
+// Serve several ranges of an uncompressed chunk in a "multipart/byteranges"
+// reply. The total length is not computed, the reply is chunked.
+func (rr *rawxRequest) downloadRanges(inChunk fileReader, ranges []rangeInfo) {
+	mw := multipart.NewWriter(rr.rep)
+
+	headers := rr.rep.Header()
+	rr.chunk.fillHeaders(headers)
+	headers.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	rr.replyCode(http.StatusPartialContent)
+
+	for _, ri := range ranges {
+		partHeaders := textproto.MIMEHeader{}
+		partHeaders.Set("Content-Type", rr.chunk.contentType())
+		partHeaders.Set("Content-Range", packRangeHeader(ri.offset, ri.last, rr.chunk.size))
+		part, err := mw.CreatePart(partHeaders)
+		if err == nil {
+			var in *io.LimitedReader
+			if in, _, err = rr.getChunkReader(inChunk, rr.chunk.size, ri); err == nil {
+				var nb int64
+				if nb, err = rr.sendData(part, in, false); err == nil {
+					rr.bytesOut = rr.bytesOut + uint64(nb)
+				}
+			}
+		}
+		if err != nil {
+			LogError(msgErrorAction("Write()", rr.reqid, err))
+			return
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		LogError(msgErrorAction("Write()", rr.reqid, err))
+	}
+}
+
 func (rr *rawxRequest) getChunkReader(inChunk fileReader, cs int64, ri rangeInfo) (in *io.LimitedReader, filter io.ReadCloser, err error) {
-	// !!!(jfs): we do not manage requests on multiple ranges
-	// TODO(jfs): is a multiple range is encountered, we should follow the norm
-	// that allows us to answer a "200 OK" with the complete content.
+	if cs < 0 {
+		cs = math.MaxInt64
+	}
+
 	switch rr.chunk.compression {
 	case compressionZlib:
-		filter, err = zlib.NewReader(inChunk.File())
+		filter, err = zlib.NewReader(chunkData(inChunk))
 	case compressionLzw:
-		filter = lzw.NewReader(inChunk.File(), lzw.MSB, 8)
+		filter = lzw.NewReader(chunkData(inChunk), lzw.MSB, 8)
 	case compressionDeflate:
-		filter = flate.NewReader(inChunk.File())
+		filter = flate.NewReader(chunkData(inChunk))
+	case compressionZstd:
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(chunkData(inChunk), zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			filter = d.IOReadCloser()
+		}
+	case compressionLz4:
+		filter = ioutil.NopCloser(lz4.NewReader(chunkData(inChunk)))
 	case "", compressionOff:
 		filter = nil
 	default:
@@ -447,7 +1508,7 @@ func (rr *rawxRequest) getChunkReader(inChunk fileReader, cs int64, ri rangeInfo
 			}
 		} else {
 			// No compression, we can serve the raw file
-			in = &io.LimitedReader{R: inChunk.File(), N: cs}
+			in = &io.LimitedReader{R: chunkData(inChunk), N: cs}
 			if !ri.isVoid() {
 				err = inChunk.seek(ri.offset)
 				in.N = ri.size
@@ -458,13 +1519,35 @@ func (rr *rawxRequest) getChunkReader(inChunk fileReader, cs int64, ri rangeInfo
 	return in, filter, err
 }
 
-func (rr *rawxRequest) removeChunk() {
+func (rr *rawxRequest) patchChunk() {
 	var err error
+	if rr.chunk, err = retrievePatchHeaders(&rr.req.Header, rr.chunkID); err != nil {
+		rr.replyError("patchChunk()", err)
+		return
+	}
+
+	err = rr.chunk.savePatchedAttr(chunkDecorator{repo: rr.repo(), name: rr.chunkID})
+	if err != nil {
+		rr.replyError("patchChunk()", err)
+	} else {
+		rr.replyCode(http.StatusNoContent)
+	}
+}
+
+// Delete the chunk from the repository and notify its deletion. Unless
+// ifMatch is empty, the chunk must match it. The chunk cannot be replaced
+// between the check and the deletion.
+func (rr *rawxRequest) deleteChunk(chunkID, ifMatch string) (chunkInfo, error) {
+	defer rr.rawx.chunkLocks.lock(chunkID)()
+	if err := rr.matchHash(chunkID, ifMatch); err != nil {
+		return chunkInfo{}, err
+	}
+
 	tmp := xattrBufferPool.Acquire()
 	defer xattrBufferPool.Release(tmp)
 
 	getter := func(name, key string) (string, error) {
-		nb, err := rr.rawx.repo.getAttr(name, key, tmp)
+		nb, err := rr.repo().getAttr(name, key, tmp)
 		if nb <= 0 || err != nil {
 			return "", err
 		} else {
@@ -473,29 +1556,105 @@ func (rr *rawxRequest) removeChunk() {
 	}
 
 	// Load only the fullpath in an attempt to spare syscalls
-	rr.chunk, err = loadFullPath(getter, rr.chunkID)
+	chunk, err := loadFullPath(getter, chunkID)
 	if err != nil {
-		rr.replyError("removeChunk()", err)
-		return
+		return chunk, err
+	}
+
+	if err = rr.repo().del(chunkID); err != nil {
+		return chunk, err
+	}
+	rr.rawx.notifier.notifyDel(rr.reqid, chunk)
+	return chunk, nil
+}
+
+// Check the "If-Match" precondition against the hash stored with the chunk.
+// A chunk without hash matches nothing but "*".
+func (rr *rawxRequest) checkIfMatch() error {
+	return rr.matchHash(rr.chunkID, rr.req.Header.Get("If-Match"))
+}
+
+func (rr *rawxRequest) matchHash(chunkID, header string) error {
+	if header == "" {
+		return nil
 	}
+	buf := xattrBufferPool.Acquire()
+	defer xattrBufferPool.Release(buf)
 
-	err = rr.rawx.repo.del(rr.chunkID)
+	var hash string
+	nb, err := rr.repo().getAttr(chunkID, AttrNameChunkChecksum, buf)
+	if err == nil && nb > 0 {
+		hash = string(buf[:nb])
+	} else if err != nil && err != syscall.ENODATA {
+		return err
+	}
+	if !hashMatches(header, hash) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// Commit the upload, unless the chunk it replaces has been replaced or
+// deleted meanwhile. The check and the commit are atomic.
+func (rr *rawxRequest) commitIfMatch(out fileWriter) error {
+	if rr.req.Header.Get("If-Match") == "" {
+		return out.commit()
+	}
+	defer rr.rawx.chunkLocks.lock(rr.chunkID)()
+	if err := rr.checkIfMatch(); err != nil {
+		out.abort()
+		if err == os.ErrNotExist {
+			err = errPreconditionFailed
+		}
+		return err
+	}
+	return out.commit()
+}
+
+func (rr *rawxRequest) removeChunk() {
+	var err error
+	rr.chunk, err = rr.deleteChunk(rr.chunkID, rr.req.Header.Get("If-Match"))
 	if err != nil {
 		rr.replyError("removeChunk()", err)
 	} else {
 		rr.replyCode(http.StatusNoContent)
-		rr.rawx.notifier.notifyDel(rr.reqid, rr.chunk)
 	}
 }
 
-func (rr *rawxRequest) serveChunk() {
-	if !isHexaString(rr.req.URL.Path[1:], 64) {
-		rr.replyError("", errInvalidChunkID)
-		return
+// Tell the client which methods are allowed on the chunks and which trailers
+// may end an upload, and answer to the CORS preflight requests when
+// configured so.
+func (rr *rawxRequest) describeChunk() {
+	headers := rr.rep.Header()
+	headers.Set("Allow", rr.rawx.chunkMethods())
+	headers.Set(HeaderNameAcceptTrailers, uploadTrailers)
+	if origin := rr.rawx.corsAllowOrigin; origin != "" {
+		headers.Set("Access-Control-Allow-Origin", origin)
+		headers.Set("Access-Control-Allow-Methods", rr.rawx.chunkMethods())
+		if h := rr.req.Header.Get("Access-Control-Request-Headers"); h != "" {
+			headers.Set("Access-Control-Allow-Headers", h)
+		}
+		if origin != "*" {
+			headers.Add("Vary", "Origin")
+		}
 	}
-	rr.chunkID = strings.ToUpper(rr.req.URL.Path[1:])
+	rr.replyCode(http.StatusNoContent)
+}
 
+func (rr *rawxRequest) dispatchChunk() uint64 {
 	var spent uint64
+	if rr.rawx.disabledMethods[rr.req.Method] {
+		if err := rr.drain(); err != nil {
+			rr.replyError("", err)
+		} else {
+			rr.replyNotAllowed(rr.rawx.chunkMethods())
+		}
+		return IncrementStatReqOther(rr)
+	}
+	if isMutation(rr.req.Method) && rr.rawx.isReadOnly() {
+		rr.replyError("", errReadOnly)
+		return IncrementStatReqOther(rr)
+	}
 	switch rr.req.Method {
 	case "GET":
 		if err := rr.drain(); err != nil {
@@ -505,7 +1664,7 @@ func (rr *rawxRequest) serveChunk() {
 		}
 		spent = IncrementStatReqGet(rr)
 	case "PUT":
-		rr.uploadChunk()
+		rr.uploadChunkOnce()
 		spent = IncrementStatReqPut(rr)
 	case "DELETE":
 		if err := rr.drain(); err != nil {
@@ -528,16 +1687,65 @@ func (rr *rawxRequest) serveChunk() {
 			rr.copyChunk()
 		}
 		spent = IncrementStatReqCopy(rr)
+	case "PATCH":
+		if err := rr.drain(); err != nil {
+			rr.replyError("", err)
+		} else {
+			rr.patchChunk()
+		}
+		spent = IncrementStatReqPatch(rr)
+	case "VERIFY":
+		if err := rr.drain(); err != nil {
+			rr.replyError("", err)
+		} else {
+			rr.verifyChunk()
+		}
+		spent = IncrementStatReqOther(rr)
+	case "OPTIONS":
+		if err := rr.drain(); err != nil {
+			rr.replyError("", err)
+		} else {
+			rr.describeChunk()
+		}
+		spent = IncrementStatReqOther(rr)
 	default:
 		if err := rr.drain(); err != nil {
 			rr.replyError("", err)
 		} else {
-			rr.replyCode(http.StatusMethodNotAllowed)
+			rr.replyNotAllowed(rr.rawx.chunkMethods())
 		}
 		spent = IncrementStatReqOther(rr)
 	}
+	return spent
+}
 
-	if shouldAccessLog(rr.status, rr.req.Method) {
+func (rr *rawxRequest) serveChunk() {
+	if !isValidChunkID(rr.req.URL.Path[1:]) {
+		rr.replyError("", errInvalidChunkID)
+		return
+	}
+	rr.chunkID = strings.ToUpper(rr.req.URL.Path[1:])
+
+	var spent uint64
+	limit := rr.rawx.concurrencyLimit(rr.req.Method)
+	// A COPY also signs where the chunk is copied
+	target := rr.chunkID
+	if rr.req.Method == "COPY" {
+		target = target + " " + rr.req.Header.Get("Destination")
+	}
+	if !rr.rawx.clientAllowed(rr.req) || !rr.rawx.signer.verify(rr.req, target, time.Now()) {
+		rr.replyError("", errForbidden)
+		spent = IncrementStatReqOther(rr)
+	} else if !limit.acquire() {
+		rr.rep.Header().Set("Retry-After", overloadRetryAfter)
+		rr.replyError("", errOverloaded)
+		spent = IncrementStatReqOther(rr)
+	} else {
+		defer limit.release()
+		spent = rr.dispatchChunk()
+	}
+
+	if rr.abort || shouldAccessLog(rr.status, rr.req.Method) {
 		LogHttp(AccessLogEvent{
 			status:    rr.status,
 			timeSpent: spent,
@@ -549,8 +1757,12 @@ func (rr *rawxRequest) serveChunk() {
 			path:      rr.req.URL.Path,
 			reqId:     rr.reqid,
 			tls:       rr.req.TLS != nil,
+			err:       rr.err,
 		})
 	}
+	if rr.abort {
+		panic(http.ErrAbortHandler)
+	}
 }
 
 func packRangeHeader(start, last, size int64) string {
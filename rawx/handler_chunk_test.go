@@ -0,0 +1,611 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T) (*rawxService, func()) {
+	fr, cleanup := newTestRepository(t)
+	rawx := &rawxService{
+		repo:           &chunkRepository{sub: *fr},
+		dataBufferPool: newBufferPool(1024*1024, 64*1024),
+	}
+	return rawx, cleanup
+}
+
+// Serve a request on the chunk of the test
+func serveTestChunk(rawx *rawxService, req *http.Request, action func(rr *rawxRequest)) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	rr := &rawxRequest{rawx: rawx, req: req, rep: rec, chunkID: testChunkID}
+	action(rr)
+	return rec
+}
+
+// The total of Content-Range is the size of the chunk, whatever the range
+func TestContentRangeMidChunk(t *testing.T) {
+	ri, ok, err := parseRangeSpec("10-19", 100)
+	if !ok || err != nil {
+		t.Fatalf("valid range refused: %v", err)
+	}
+	if h := packRangeHeader(ri.offset, ri.last, 100); h != "bytes 10-19/100" {
+		t.Errorf("unexpected Content-Range: %s", h)
+	}
+}
+
+// The bounds of Content-Range are inclusive, Content-Length is the size of
+// the range
+func TestContentRangeBounds(t *testing.T) {
+	cases := []struct {
+		spec   string
+		size   int64
+		header string
+	}{
+		{"0-0", 1, "bytes 0-0/100"},
+		{"99-99", 1, "bytes 99-99/100"},
+		{"-1", 1, "bytes 99-99/100"},
+		{"0-99", 100, "bytes 0-99/100"},
+		{"0-", 100, "bytes 0-99/100"},
+		{"0-1000", 100, "bytes 0-99/100"},
+		{"-1000", 100, "bytes 0-99/100"},
+	}
+	for _, c := range cases {
+		ri, ok, err := parseRangeSpec(c.spec, 100)
+		if !ok || err != nil {
+			t.Errorf("%s: valid range refused: %v", c.spec, err)
+			continue
+		}
+		if ri.size != c.size {
+			t.Errorf("%s: expected a length of %d, got %d", c.spec, c.size, ri.size)
+		}
+		if h := packRangeHeader(ri.offset, ri.last, 100); h != c.header {
+			t.Errorf("%s: expected %s, got %s", c.spec, c.header, h)
+		}
+	}
+}
+
+// Without the size of the clear data, a compressed chunk is streamed
+// without Content-Length, i.e. with the chunked transfer encoding.
+func TestDownloadUnknownLength(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+
+	clear := bytes.Repeat([]byte("compressible "), 100)
+	packed := bytes.Buffer{}
+	z := zlib.NewWriter(&packed)
+	z.Write(clear)
+	z.Close()
+
+	out, err := rawx.repo.put(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(packed.Bytes())
+	out.setAttr(AttrNameCompression, []byte(compressionZlib))
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(rr *rawxRequest) { rr.downloadChunk() }
+	rec := serveTestChunk(rawx, httptest.NewRequest("GET", "/"+testChunkID, nil), download)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("unexpected Content-Length %s", cl)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), clear) {
+		t.Error("unexpected body")
+	}
+
+	// The length is announced when known
+	rawx.repo.setAttr(testChunkID, AttrNameChunkSize, []byte(strconv.Itoa(len(clear))))
+	rec = serveTestChunk(rawx, httptest.NewRequest("GET", "/"+testChunkID, nil), download)
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(len(clear)) {
+		t.Errorf("unexpected Content-Length %s", cl)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), clear) {
+		t.Error("unexpected body")
+	}
+}
+
+// A client that stops sending its body is cut after the idle timeout
+func TestIdleReaderTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rep http.ResponseWriter, req *http.Request) {
+		ir := &idleReader{r: req.Body, rc: http.NewResponseController(rep), idle: 100 * time.Millisecond}
+		_, err := ioutil.ReadAll(ir)
+		errs <- err
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PUT / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nab"))
+
+	select {
+	case err = <-errs:
+		if err != errReadTimeout {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the silent client was not cut")
+	}
+}
+
+// A client that stops reading the reply is cut after the idle timeout
+func TestIdleWriterTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rep http.ResponseWriter, req *http.Request) {
+		iw := &idleWriter{w: rep, rc: http.NewResponseController(rep), idle: 100 * time.Millisecond, step: 65536}
+		// Far more than the buffers of the sockets
+		_, err := iw.ReadFrom(io.LimitReader(zeroReader{}, 1024*1024*1024))
+		errs <- err
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+
+	select {
+	case err = <-errs:
+		if err != errWriteTimeout {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("the stalled client was not cut")
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// The disabled methods are refused, and no more announced as allowed
+func TestDisabledMethods(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	rawx.disabledMethods = map[string]bool{"PUT": true, "DELETE": true}
+	dispatch := func(rr *rawxRequest) { rr.dispatchChunk() }
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		rec := serveTestChunk(rawx, httptest.NewRequest(method, "/"+testChunkID, nil), dispatch)
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: unexpected status %d", method, rec.Code)
+		}
+		if allow := rec.Header().Get("Allow"); allow != "COPY, PATCH, HEAD, GET, VERIFY, OPTIONS" {
+			t.Errorf("%s: unexpected Allow %q", method, allow)
+		}
+	}
+	rec := serveTestChunk(rawx, httptest.NewRequest("OPTIONS", "/"+testChunkID, nil), dispatch)
+	if allow := rec.Header().Get("Allow"); rec.Code != http.StatusNoContent || allow != "COPY, PATCH, HEAD, GET, VERIFY, OPTIONS" {
+		t.Errorf("OPTIONS: unexpected reply %d %q", rec.Code, allow)
+	}
+	rec = serveTestChunk(rawx, httptest.NewRequest("GET", "/"+testChunkID, nil), dispatch)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET: unexpected status %d", rec.Code)
+	}
+}
+
+// The mutations are refused in read-only mode, the reads still served
+func TestReadOnly(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	dispatch := func(rr *rawxRequest) { rr.dispatchChunk() }
+
+	rawx.setReadOnly(true)
+	for _, method := range []string{"PUT", "COPY", "PATCH", "DELETE"} {
+		rec := serveTestChunk(rawx, httptest.NewRequest(method, "/"+testChunkID, nil), dispatch)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: unexpected status %d", method, rec.Code)
+		}
+	}
+	rec := serveTestChunk(rawx, httptest.NewRequest("GET", "/"+testChunkID, nil), dispatch)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET: unexpected status %d", rec.Code)
+	}
+
+	rawx.setReadOnly(false)
+	rec = serveTestChunk(rawx, httptest.NewRequest("DELETE", "/"+testChunkID, nil), dispatch)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE: unexpected status %d", rec.Code)
+	}
+}
+
+func TestNewChecksum(t *testing.T) {
+	cases := map[string]string{
+		"":                 "25F9E794323B453885F5181F1B624D0B",
+		checksumAlgoMD5:    "25F9E794323B453885F5181F1B624D0B",
+		checksumAlgoSHA256: "15E2B0D3C33891EBB0F1EF609EC419420C20E320CE94C65FBC8C3312448EB225",
+		checksumAlgoCRC32C: "E3069283",
+	}
+	for algo, expected := range cases {
+		h, err := newChecksum(algo)
+		if err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+		h.Write([]byte("123456789"))
+		if sum := strings.ToUpper(hex.EncodeToString(h.Sum(nil))); sum != expected {
+			t.Errorf("%s: unexpected checksum %s", algo, sum)
+		}
+	}
+	if _, err := newChecksum("crc32"); err != errChecksumNotManaged {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// The secondary checksum is computed along with the primary one
+func TestSecondaryChecksum(t *testing.T) {
+	rr := &rawxRequest{rawx: &rawxService{}}
+	if rr.secondaryChecksum() != nil || checksumsWriter(nil, nil) != nil {
+		t.Error("unexpected secondary checksum")
+	}
+
+	rr.rawx.checksumSecondaryAlgo = checksumAlgoCRC32C
+	h, _ := newChecksum(checksumAlgoMD5)
+	h2 := rr.secondaryChecksum()
+	checksumsWriter(h, h2).Write([]byte("123456789"))
+	if sum := strings.ToUpper(hex.EncodeToString(h.Sum(nil))); sum != "25F9E794323B453885F5181F1B624D0B" {
+		t.Errorf("unexpected primary checksum %s", sum)
+	}
+
+	chunk := chunkInfo{secondaryHash: "stale", secondaryAlgo: "stale"}
+	rr.saveSecondaryChecksum(&chunk, h2)
+	if chunk.secondaryHash != "E3069283" || chunk.secondaryAlgo != checksumAlgoCRC32C {
+		t.Errorf("unexpected secondary checksum %s %s", chunk.secondaryAlgo, chunk.secondaryHash)
+	}
+	headers := http.Header{}
+	chunk.fillHeadersLight(headers)
+	if headers.Get(HeaderNameChunkChecksumSecondary) != "E3069283" {
+		t.Error("secondary checksum not exposed")
+	}
+	rr.saveSecondaryChecksum(&chunk, nil)
+	if chunk.secondaryHash != "" || chunk.secondaryAlgo != "" {
+		t.Error("stale secondary checksum kept")
+	}
+}
+
+// The hash of an object is computed across the uploads of its chunks
+func TestObjectChecksum(t *testing.T) {
+	objectChecksum := func(algo, state string) (hash.Hash, error) {
+		req := httptest.NewRequest("PUT", "/"+testChunkID, nil)
+		req.Header.Set(HeaderNameObjectChecksumAlgo, algo)
+		req.Header.Set(HeaderNameObjectChecksumState, state)
+		rr := &rawxRequest{req: req, rep: httptest.NewRecorder()}
+		return rr.objectChecksum()
+	}
+
+	h, err := objectChecksum(checksumAlgoMD5, "")
+	if err != nil || h == nil {
+		t.Fatalf("hash not started: %v", err)
+	}
+	h.Write([]byte("12345"))
+	rec := httptest.NewRecorder()
+	rr := &rawxRequest{rep: rec}
+	rr.replyObjectChecksum(h)
+	state := rec.Header().Get(HeaderNameObjectChecksumState)
+
+	if h, err = objectChecksum(checksumAlgoMD5, state); err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("6789"))
+	rec = httptest.NewRecorder()
+	rr = &rawxRequest{rep: rec}
+	rr.replyObjectChecksum(h)
+	if sum := rec.Header().Get(HeaderNameObjectChecksum); sum != "25F9E794323B453885F5181F1B624D0B" {
+		t.Errorf("unexpected object checksum %s", sum)
+	}
+
+	if _, err = objectChecksum(checksumAlgoSHA256, state); err != errInvalidHeader {
+		t.Errorf("state of another algorithm accepted: %v", err)
+	}
+	if _, err = objectChecksum(checksumAlgoMD5, "not base64!"); err != errInvalidHeader {
+		t.Errorf("invalid state accepted: %v", err)
+	}
+	if h, err = objectChecksum("", ""); h != nil || err != nil {
+		t.Errorf("unexpected object checksum: %v", err)
+	}
+}
+
+// A HEAD with a range tells what a GET would reply, without the data
+func TestCheckChunkRange(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	putVerifiedChunk(t, rawx, strings.Repeat("x", 100), nil)
+
+	check := func(rr *rawxRequest) { rr.checkChunk() }
+	head := func(spec string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", "/"+testChunkID, nil)
+		req.Header.Set("Range", spec)
+		return serveTestChunk(rawx, req, check)
+	}
+
+	rec := head("bytes=10-19")
+	if rec.Code != http.StatusPartialContent || rec.Body.Len() != 0 ||
+		rec.Header().Get("Content-Range") != "bytes 10-19/100" || rec.Header().Get("Content-Length") != "10" {
+		t.Errorf("unexpected reply %d %v", rec.Code, rec.Header())
+	}
+	rec = head("bytes=200-")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */100" {
+		t.Errorf("unexpected reply %d %v", rec.Code, rec.Header())
+	}
+	rec = head("bytes=0-9,20-29")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "100" {
+		t.Errorf("unexpected reply %d %v", rec.Code, rec.Header())
+	}
+	if rec = head(""); rec.Code != http.StatusOK || rec.Header().Get("Content-Range") != "" {
+		t.Errorf("unexpected reply %d %v", rec.Code, rec.Header())
+	}
+}
+
+// The textual chunks are compressed on the fly for the clients accepting it
+func TestDownloadGzip(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	rawx.gzipDownload = true
+	rawx.gzipMinSize = 10
+	data := strings.Repeat("text ", 100)
+	putVerifiedChunk(t, rawx, data, map[string]string{
+		AttrNameChunkChecksum:   "0123",
+		AttrNameContentMimeType: "text/plain; charset=utf-8",
+	})
+
+	download := func(rr *rawxRequest) { rr.downloadChunk() }
+	get := func(encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/"+testChunkID, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		return serveTestChunk(rawx, req, download)
+	}
+
+	rec := get("gzip, deflate")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" ||
+		rec.Header().Get("Content-Length") != "" || rec.Header().Get("ETag") != `W/"0123"` {
+		t.Fatalf("unexpected reply %d %v", rec.Code, rec.Header())
+	}
+	z, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clear, err := ioutil.ReadAll(z); err != nil || string(clear) != data {
+		t.Errorf("unexpected content: %v", err)
+	}
+
+	if rec = get("identity"); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != data {
+		t.Errorf("unexpected reply %v", rec.Header())
+	}
+
+	// Not worth it
+	rawx.gzipMinSize = 1000
+	if rec = get("gzip"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("unexpected reply %v", rec.Header())
+	}
+	rawx.gzipMinSize = 10
+	rawx.repo.setAttr(testChunkID, AttrNameContentMimeType, []byte("image/png"))
+	if rec = get("gzip"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("unexpected reply %v", rec.Header())
+	}
+}
+
+// A dry run replies what the upload would, without storing anything
+func TestDryRunUpload(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	rawx.freeSpace = newFreeSpaceChecker(0, 0)
+
+	upload := func(rr *rawxRequest) { rr.uploadChunk() }
+	put := func(header map[string]string) int {
+		req := httptest.NewRequest("PUT", "/"+testChunkID, strings.NewReader("never read"))
+		req.Header.Set(HeaderNameDryRun, "true")
+		req.Header.Set(HeaderNameContentStgPol, "SINGLE")
+		req.Header.Set(HeaderNameContentChunkMethod, "plain/nb_copy=1")
+		req.Header.Set(HeaderNameChunkPosition, "0")
+		req.Header.Set(HeaderNameFullpath, "acct/cont/obj/1/0123456789ABCDEF")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		return serveTestChunk(rawx, req, upload).Code
+	}
+
+	if code := put(nil); code != http.StatusNoContent {
+		t.Errorf("unexpected status %d", code)
+	}
+	if _, err := rawx.repo.get(testChunkID); err != os.ErrNotExist {
+		t.Errorf("chunk stored by a dry run: %v", err)
+	}
+	if code := put(map[string]string{HeaderNameChunkPosition: ""}); code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d", code)
+	}
+
+	putVerifiedChunk(t, rawx, "data", nil)
+	if code := put(nil); code != http.StatusConflict {
+		t.Errorf("unexpected status %d", code)
+	}
+	if code := put(map[string]string{"If-None-Match": "*"}); code != http.StatusPreconditionFailed {
+		t.Errorf("unexpected status %d", code)
+	}
+}
+
+// Sends some data, then tells the client disconnected
+type leavingReader struct {
+	cancel context.CancelFunc
+}
+
+func (lr leavingReader) Read(p []byte) (int, error) {
+	lr.cancel()
+	return copy(p, "data"), nil
+}
+
+// The transfers stop as soon as the client disconnected
+func TestClientGone(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	rawx.freeSpace = newFreeSpaceChecker(0, 0)
+	rawx.uploadLimiter = newRateLimiter(0, 0, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("PUT", "/"+testChunkID, leavingReader{cancel: cancel}).WithContext(ctx)
+	req.Header.Set(HeaderNameContentStgPol, "SINGLE")
+	req.Header.Set(HeaderNameContentChunkMethod, "plain/nb_copy=1")
+	req.Header.Set(HeaderNameChunkPosition, "0")
+	req.Header.Set(HeaderNameFullpath, "acct/cont/obj/1/0123456789ABCDEF")
+	aborted := atomic.LoadUint64(&counters.ReqAborted)
+	rec := serveTestChunk(rawx, req, func(rr *rawxRequest) { rr.uploadChunk() })
+	if rec.Code != statusClientClosed || atomic.LoadUint64(&counters.ReqAborted) != aborted+1 {
+		t.Errorf("upload not aborted: %d", rec.Code)
+	}
+	if _, err := rawx.repo.get(testChunkID); err != os.ErrNotExist {
+		t.Errorf("aborted chunk stored: %v", err)
+	}
+
+	cw := &contextWriter{w: ioutil.Discard, ctx: ctx, step: 65536}
+	if n, err := cw.ReadFrom(io.LimitReader(zeroReader{}, 1024*1024)); n != 0 || err != errClientGone {
+		t.Errorf("download not aborted: %d %v", n, err)
+	}
+	if _, err := cw.Write([]byte("data")); err != errClientGone {
+		t.Errorf("download not aborted: %v", err)
+	}
+}
+
+// The trailers are announced, those accepted on an upload and those sent on
+// a download
+func TestAnnounceTrailers(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	putVerifiedChunk(t, rawx, "data", nil)
+
+	req := httptest.NewRequest("OPTIONS", "/"+testChunkID, nil)
+	rec := serveTestChunk(rawx, req, func(rr *rawxRequest) { rr.describeChunk() })
+	if h := rec.Header().Get(HeaderNameAcceptTrailers); h != uploadTrailers {
+		t.Errorf("unexpected trailers accepted: %q", h)
+	}
+
+	req = httptest.NewRequest("HEAD", "/"+testChunkID, nil)
+	req.Header.Set("TE", "trailers")
+	rec = serveTestChunk(rawx, req, func(rr *rawxRequest) { rr.checkChunk() })
+	if rec.Header().Get("Trailer") != HeaderNameComputedChecksum || rec.Header().Get("Content-Length") != "" {
+		t.Errorf("unexpected reply %d %v", rec.Code, rec.Header())
+	}
+}
+
+// The data of an upload of unknown size is read ahead in a pooled buffer,
+// then replayed
+func TestWorthCompression(t *testing.T) {
+	pool := newBufferPool(1024, 64)
+	for _, data := range []string{"short", strings.Repeat("x", 100)} {
+		worth, in, head, err := worthCompression(strings.NewReader(data), -1, 16, pool)
+		if err != nil || worth != (len(data) >= 16) {
+			t.Errorf("%d bytes: unexpected verdict %v %v", len(data), worth, err)
+		}
+		if cap(head) != 64 {
+			t.Errorf("buffer not taken from the pool: %d", cap(head))
+		}
+		if replayed, _ := ioutil.ReadAll(in); string(replayed) != data {
+			t.Errorf("unexpected data %q", replayed)
+		}
+		pool.Release(head)
+	}
+}
+
+// The chunks uploaded through each compression filter come back intact
+func TestCompressionRoundTrip(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	rawx.freeSpace = newFreeSpaceChecker(0, 0)
+	rawx.uploadLimiter = newRateLimiter(0, 0, "")
+	rawx.zlibLevel = zlib.DefaultCompression
+	defer func(allowed bool) { notifAllowed = allowed }(notifAllowed)
+	notifAllowed = false
+
+	clear := strings.Repeat("compressible ", 100)
+	upload := func(rr *rawxRequest) { rr.uploadChunk() }
+	download := func(rr *rawxRequest) { rr.downloadChunk() }
+	for _, compression := range []string{compressionZlib, compressionDeflate, compressionLzw, compressionZstd, compressionLz4} {
+		rawx.compression = compression
+		req := httptest.NewRequest("PUT", "/"+testChunkID, strings.NewReader(clear))
+		req.Header.Set(HeaderNameContentStgPol, "SINGLE")
+		req.Header.Set(HeaderNameContentChunkMethod, "plain/nb_copy=1")
+		req.Header.Set(HeaderNameChunkPosition, "0")
+		req.Header.Set(HeaderNameFullpath, "acct/cont/obj/1/0123456789ABCDEF")
+		if rec := serveTestChunk(rawx, req, upload); rec.Code != http.StatusCreated {
+			t.Fatalf("%s: unexpected status %d", compression, rec.Code)
+		}
+
+		buf := make([]byte, 64)
+		n, err := rawx.repo.getAttr(testChunkID, AttrNameCompression, buf)
+		if err != nil || string(buf[:n]) != compression {
+			t.Errorf("%s: unexpected compression %q %v", compression, buf[:n], err)
+		}
+		in, err := rawx.repo.get(testChunkID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in.size() >= int64(len(clear)) {
+			t.Errorf("%s: data not compressed", compression)
+		}
+		in.Close()
+
+		// The clear content bears the strong tag, an encoded one the weak tag
+		rec := serveTestChunk(rawx, httptest.NewRequest("GET", "/"+testChunkID, nil), download)
+		if rec.Code != http.StatusOK || rec.Body.String() != clear {
+			t.Errorf("%s: unexpected reply %d", compression, rec.Code)
+		}
+		etag := rec.Header().Get("ETag")
+		if etag == "" || strings.HasPrefix(etag, "W/") {
+			t.Errorf("%s: unexpected tag %s", compression, etag)
+		}
+		if encoding := contentEncoding(compression); encoding != "" {
+			req = httptest.NewRequest("GET", "/"+testChunkID, nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			rec = serveTestChunk(rawx, req, download)
+			if rec.Header().Get("Content-Encoding") != encoding || rec.Header().Get("ETag") != "W/"+etag {
+				t.Errorf("%s: unexpected encoded reply %v", compression, rec.Header())
+			}
+		}
+		if err = rawx.repo.del(testChunkID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
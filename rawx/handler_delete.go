@@ -0,0 +1,136 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Deletes many chunks at once, e.g. on behalf of a garbage collector. The body
+of the request is a JSON array of chunk IDs, the reply tells the outcome of
+the deletion of each chunk:
+	["0123...", "4567..."]
+	{"0123...": "deleted", "4567...": "not-found"}
+A failure on a chunk never aborts the deletion of the others.
+*/
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	bulkDeleted  = "deleted"
+	bulkNotFound = "not-found"
+	bulkInvalid  = "invalid"
+
+	// Target of the signature of the bulk deletions
+	bulkDeleteTarget = "delete"
+)
+
+func (rr *rawxRequest) bulkDelete() {
+	body, err := ioutil.ReadAll(io.LimitReader(rr.req.Body, bulkDeleteMaxBodySize+1))
+	if err != nil || len(body) > bulkDeleteMaxBodySize {
+		rr.req.Close = true
+		rr.replyError("", errInvalidBody)
+		return
+	}
+	// The signature covers the list of chunks, and cannot be replayed
+	if rr.rawx.signer != nil && !rr.rawx.signer.verifyBody(rr.req, bulkDeleteTarget, body, time.Now()) {
+		rr.replyError("", errForbidden)
+		return
+	}
+	if rr.rawx.isReadOnly() {
+		rr.replyError("", errReadOnly)
+		return
+	}
+
+	var ids []string
+	if err := json.Unmarshal(body, &ids); err != nil {
+		rr.replyError("", errInvalidBody)
+		return
+	}
+	if len(ids) > bulkDeleteMaxChunks {
+		rr.replyError("", errInvalidBody)
+		return
+	}
+
+	result := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if !isValidChunkID(id) {
+			result[id] = bulkInvalid
+			continue
+		}
+		chunkID := strings.ToUpper(id)
+		if _, err := rr.deleteChunk(chunkID, ""); err == nil {
+			result[id] = bulkDeleted
+		} else if err == os.ErrNotExist {
+			result[id] = bulkNotFound
+		} else {
+			LogWarning(msgErrorAction("bulkDelete() "+chunkID, rr.reqid, err))
+			result[id] = "error: " + err.Error()
+		}
+	}
+
+	rr.rep.Header().Set("Content-Type", "application/json")
+	rr.replyCode(http.StatusOK)
+	json.NewEncoder(rr.rep).Encode(result)
+}
+
+func (rr *rawxRequest) serveBulkDelete() {
+	var spent uint64
+	// The bulk deletion is disabled with the deletion of single chunks
+	allowed := bulkAllowedMethods
+	if rr.rawx.disabledMethods["DELETE"] {
+		allowed = ""
+	}
+	switch {
+	case rr.req.Method == "POST" && allowed != "":
+		// The signature of the body is checked once it is read
+		if !rr.rawx.clientAllowed(rr.req) {
+			rr.replyError("", errForbidden)
+		} else {
+			rr.bulkDelete()
+		}
+		spent = IncrementStatReqDel(rr)
+	default:
+		if err := rr.drain(); err != nil {
+			rr.replyError("", err)
+		} else {
+			rr.replyNotAllowed(allowed)
+		}
+		spent = IncrementStatReqOther(rr)
+	}
+
+	if shouldAccessLog(rr.status, rr.req.Method) {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.req.Host,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+			tls:       rr.req.TLS != nil,
+			err:       rr.err,
+		})
+	}
+}
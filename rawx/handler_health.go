@@ -0,0 +1,87 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Lightweight checks for the load balancers and the orchestrators:
+	/health replies 200 if the volume is writable and not full,
+	/ready also requires the queue of events to accept new events.
+The reply is 503 otherwise, and the body tells the failed checks.
+*/
+
+import (
+	"bytes"
+	"net/http"
+)
+
+func doGetHealth(rr *rawxRequest, readiness bool) {
+	bb := bytes.Buffer{}
+	if err := rr.rawx.repo.writable(); err != nil {
+		bb.WriteString("volume ")
+		bb.WriteString(err.Error())
+		bb.WriteRune('\n')
+	} else if _, _, err := rr.rawx.repo.statfs(); err != nil {
+		bb.WriteString("volume ")
+		bb.WriteString(err.Error())
+		bb.WriteRune('\n')
+	}
+	if !rr.rawx.freeSpace.ok(rr.rawx.repo) {
+		bb.WriteString("space full\n")
+	}
+	if readiness && rr.rawx.notifier != nil && rr.rawx.notifier.clogged() {
+		bb.WriteString("events clogged\n")
+	}
+
+	if bb.Len() > 0 {
+		rr.replyCode(http.StatusServiceUnavailable)
+	} else {
+		bb.WriteString("ok\n")
+		rr.replyCode(http.StatusOK)
+	}
+	rr.rep.Write(bb.Bytes())
+}
+
+func (rr *rawxRequest) serveHealth(readiness bool) {
+	if err := rr.drain(); err != nil {
+		rr.replyError("", err)
+		return
+	}
+
+	var spent uint64
+	switch rr.req.Method {
+	case "GET", "HEAD":
+		doGetHealth(rr, readiness)
+		spent = IncrementStatReqInfo(rr)
+	default:
+		rr.replyNotAllowed(serviceAllowedMethods)
+		spent = IncrementStatReqOther(rr)
+	}
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.req.Host,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+			tls:       rr.req.TLS != nil,
+		})
+	}
+}
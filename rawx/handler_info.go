@@ -19,8 +19,17 @@ package main
 import (
 	"bytes"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 )
 
+func writeInfoLine(bb *bytes.Buffer, key, value string) {
+	bb.WriteString(key)
+	bb.WriteRune(' ')
+	bb.WriteString(value)
+	bb.WriteRune('\n')
+}
+
 func doGetInfo(rr *rawxRequest) {
 	bb := bytes.Buffer{}
 	bb.WriteString("namespace ")
@@ -40,6 +49,49 @@ func doGetInfo(rr *rawxRequest) {
 		bb.WriteRune('\n')
 	}
 
+	// The space not available to the rawx is accounted as used
+	if total, avail, err := rr.rawx.repo.statfs(); err == nil {
+		writeInfoLine(&bb, "volume_total", utoa(total))
+		writeInfoLine(&bb, "volume_used", utoa(total-avail))
+		writeInfoLine(&bb, "volume_free", utoa(avail))
+	}
+
+	compression := rr.rawx.compression
+	if compression == "" {
+		compression = compressionOff
+	}
+	writeInfoLine(&bb, "compression", compression)
+	if compression == compressionZlib {
+		writeInfoLine(&bb, "compression_zlib_level", itoa(rr.rawx.zlibLevel))
+	}
+	writeInfoLine(&bb, "checksum_algo", rr.rawx.checksumAlgo)
+	if rr.rawx.checksumSecondaryAlgo != "" {
+		writeInfoLine(&bb, "checksum_secondary_algo", rr.rawx.checksumSecondaryAlgo)
+	}
+	writeInfoLine(&bb, "buffer_size", itoa(rr.rawx.bufferSize))
+	syncFile, syncDir := rr.rawx.repo.durability()
+	writeInfoLine(&bb, "fsync_file", strconv.FormatBool(syncFile))
+	writeInfoLine(&bb, "fsync_dir", strconv.FormatBool(syncDir))
+	writeInfoLine(&bb, "inflight_reads", itoa(int(rr.rawx.readLimit.inflight())))
+	writeInfoLine(&bb, "inflight_writes", itoa(int(rr.rawx.writeLimit.inflight())))
+	if rr.rawx.scrubber != nil {
+		status := rr.rawx.scrubber.status()
+		writeInfoLine(&bb, "scrub_passes", itoa(status.passes))
+		writeInfoLine(&bb, "scrub_position", status.position)
+		writeInfoLine(&bb, "scrub_checked", utoa(atomic.LoadUint64(&counters.ScrubChecked)))
+		writeInfoLine(&bb, "scrub_corrupted", utoa(atomic.LoadUint64(&counters.ScrubCorrupted)))
+		writeInfoLine(&bb, "scrub_last_error", status.lastError)
+	}
+
+	// The settings that may change at runtime
+	settings := rr.rawx.getSettings()
+	writeInfoLine(&bb, "read_only", strconv.FormatBool(*settings.ReadOnly))
+	writeInfoLine(&bb, "log_level", *settings.LogLevel)
+	writeInfoLine(&bb, "max_concurrent_reads", itoa(int(*settings.MaxConcurrentReads)))
+	writeInfoLine(&bb, "max_concurrent_writes", itoa(int(*settings.MaxConcurrentWrites)))
+	writeInfoLine(&bb, "free_space_min_bytes", itoa64(*settings.FreeSpaceMinBytes))
+	writeInfoLine(&bb, "free_space_min_percent", itoa(*settings.FreeSpaceMinPercent))
+
 	rr.replyCode(http.StatusOK)
 	rr.rep.Write(bb.Bytes())
 }
@@ -56,7 +108,7 @@ func (rr *rawxRequest) serveInfo() {
 		doGetInfo(rr)
 		spent = IncrementStatReqInfo(rr)
 	default:
-		rr.replyCode(http.StatusMethodNotAllowed)
+		rr.replyNotAllowed(serviceAllowedMethods)
 		spent = IncrementStatReqOther(rr)
 	}
 	if isVerbose() {
@@ -0,0 +1,180 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Enumerates the chunks of the volume, e.g. on behalf of the rebuild and audit
+tools. The listing is paginated, in the lexical order of the chunk IDs:
+	GET /list?prefix=01AB&marker=<last ID of the previous page>&max=1000
+	{"chunks": ["01AB...", ...], "truncated": true, "next_marker": "01AB..."}
+Only the directories are read, never the chunks themselves. Some metadata
+may be requested for each chunk, as a comma-separated list:
+	GET /list?meta=size,fullpath
+	{"chunks": [...], "metadata": {"01AB...": {"size": 1024, "fullpath": "..."}}}
+The size of the file comes with the walk, it is cheap. The fullpath of the
+content costs a read of the XATTR of each chunk, it is much slower.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Target of the signature of the listings
+const listTarget = "list"
+
+// Metadata that may be requested on each chunk
+const (
+	listMetaSize     = "size"
+	listMetaFullpath = "fullpath"
+)
+
+type listedMeta struct {
+	Size     *int64 `json:"size,omitempty"`
+	Fullpath string `json:"fullpath,omitempty"`
+}
+
+type listReply struct {
+	Chunks     []string              `json:"chunks"`
+	Metadata   map[string]listedMeta `json:"metadata,omitempty"`
+	Truncated  bool                  `json:"truncated"`
+	NextMarker string                `json:"next_marker,omitempty"`
+}
+
+// Load the fullpath of the content of the chunk. A chunk without fullpath
+// (e.g. of a former release) is still listed.
+func (rr *rawxRequest) listedFullpath(id string, buf []byte) string {
+	nb, err := rr.repo().getAttr(id, xattrKey(id), buf)
+	if err != nil || nb <= 0 {
+		return ""
+	}
+	return string(buf[:nb])
+}
+
+func (rr *rawxRequest) listChunks() {
+	query := rr.req.URL.Query()
+
+	prefix := strings.ToUpper(query.Get("prefix"))
+	if len(prefix) > chunkIDLength || !isHexaString(prefix, 0) {
+		rr.replyError("", errListPrefix)
+		return
+	}
+	marker := strings.ToUpper(query.Get("marker"))
+	if marker != "" && !isValidChunkID(marker) {
+		rr.replyError("", errListMarker)
+		return
+	}
+	max := listDefaultMaxChunks
+	if v := query.Get("max"); v != "" {
+		var err error
+		if max, err = strconv.Atoi(v); err != nil || max <= 0 {
+			rr.replyError("", errInvalidHeader)
+			return
+		}
+		if max > listMaxChunks {
+			max = listMaxChunks
+		}
+	}
+
+	var withSize, withFullpath bool
+	if v := query.Get("meta"); v != "" {
+		for _, meta := range strings.Split(v, ",") {
+			switch strings.TrimSpace(meta) {
+			case listMetaSize:
+				withSize = true
+			case listMetaFullpath:
+				withFullpath = true
+			default:
+				rr.replyError("", errInvalidHeader)
+				return
+			}
+		}
+	}
+
+	chunks, truncated, err := rr.repo().list(prefix, marker, max)
+	if err != nil {
+		rr.replyError("list()", err)
+		return
+	}
+	reply := listReply{Chunks: make([]string, len(chunks)), Truncated: truncated}
+	for i, c := range chunks {
+		reply.Chunks[i] = c.id
+	}
+	if truncated {
+		reply.NextMarker = reply.Chunks[len(chunks)-1]
+	}
+
+	if withSize || withFullpath {
+		buf := xattrBufferPool.Acquire()
+		defer xattrBufferPool.Release(buf)
+		reply.Metadata = make(map[string]listedMeta, len(chunks))
+		for i := range chunks {
+			var meta listedMeta
+			if withSize {
+				meta.Size = &chunks[i].size
+			}
+			if withFullpath {
+				meta.Fullpath = rr.listedFullpath(chunks[i].id, buf)
+			}
+			reply.Metadata[chunks[i].id] = meta
+		}
+	}
+
+	rr.rep.Header().Set("Content-Type", "application/json")
+	rr.replyCode(http.StatusOK)
+	json.NewEncoder(rr.rep).Encode(reply)
+}
+
+func (rr *rawxRequest) serveList() {
+	if err := rr.drain(); err != nil {
+		rr.replyError("", err)
+		return
+	}
+
+	var spent uint64
+	switch rr.req.Method {
+	case "GET":
+		if !rr.rawx.clientAllowed(rr.req) || !rr.rawx.signer.verify(rr.req, listTarget, time.Now()) {
+			rr.replyError("", errForbidden)
+		} else {
+			rr.listChunks()
+		}
+		spent = IncrementStatReqOther(rr)
+	default:
+		rr.replyNotAllowed(listAllowedMethods)
+		spent = IncrementStatReqOther(rr)
+	}
+
+	if shouldAccessLog(rr.status, rr.req.Method) {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.req.Host,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+			tls:       rr.req.TLS != nil,
+			err:       rr.err,
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Exposes the counters of the service in the text format of Prometheus, along
+with the latency histograms of the requests and the count of the replies by
+status code.
+*/
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// Upper bounds (in microseconds) of the buckets of the latency histograms
+var latencyBuckets = []uint64{
+	1000, 5000, 10000, 25000, 50000, 100000, 250000, 500000,
+	1000000, 2500000, 5000000, 10000000,
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]uint64, len(latencyBuckets))}
+}
+
+// The buckets are not cumulative here, they are summed on output
+func (h *histogram) observe(spent uint64) {
+	for i, bound := range latencyBuckets {
+		if spent <= bound {
+			atomic.AddUint64(&h.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, spent)
+}
+
+// Latency histograms by kind of request, the map itself is never modified
+var latencies = map[string]*histogram{
+	"put":   newHistogram(),
+	"copy":  newHistogram(),
+	"patch": newHistogram(),
+	"get":   newHistogram(),
+	"head":  newHistogram(),
+	"del":   newHistogram(),
+	"stat":  newHistogram(),
+	"info":  newHistogram(),
+	"other": newHistogram(),
+}
+
+// Order of the output of the kinds of request
+var latencyKinds = []string{"put", "copy", "patch", "get", "head", "del", "stat", "info", "other"}
+
+// Count of the replies, indexed by status code
+var statusCounts [600]uint64
+
+func countStatus(status int) {
+	if status >= 100 && status < len(statusCounts) {
+		atomic.AddUint64(&statusCounts[status], 1)
+	}
+}
+
+func seconds(micros uint64) string {
+	return strconv.FormatFloat(float64(micros)/1000000, 'g', -1, 64)
+}
+
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (mw *metricsWriter) header(name, kind, help string) {
+	mw.WriteString("# HELP " + name + " " + help + "\n")
+	mw.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func (mw *metricsWriter) sample(name, labels, value string) {
+	mw.WriteString(name)
+	if labels != "" {
+		mw.WriteString("{" + labels + "}")
+	}
+	mw.WriteString(" " + value + "\n")
+}
+
+func (mw *metricsWriter) counter(name, help string, value *uint64) {
+	mw.header(name, "counter", help)
+	mw.sample(name, "", utoa(atomic.LoadUint64(value)))
+}
+
+func doGetMetrics(rr *rawxRequest) {
+	mw := metricsWriter{}
+
+	mw.header("rawx_requests_total", "counter", "Requests served, by kind")
+	for _, kind := range latencyKinds {
+		mw.sample("rawx_requests_total", `kind="`+kind+`"`,
+			utoa(atomic.LoadUint64(&latencies[kind].count)))
+	}
+
+	mw.header("rawx_request_duration_seconds", "histogram", "Time spent on the requests, by kind")
+	for _, kind := range latencyKinds {
+		h := latencies[kind]
+		var cumulated uint64
+		for i, bound := range latencyBuckets {
+			cumulated += atomic.LoadUint64(&h.buckets[i])
+			mw.sample("rawx_request_duration_seconds_bucket",
+				`kind="`+kind+`",le="`+seconds(bound)+`"`, utoa(cumulated))
+		}
+		count := atomic.LoadUint64(&h.count)
+		mw.sample("rawx_request_duration_seconds_bucket", `kind="`+kind+`",le="+Inf"`, utoa(count))
+		mw.sample("rawx_request_duration_seconds_sum", `kind="`+kind+`"`, seconds(atomic.LoadUint64(&h.sum)))
+		mw.sample("rawx_request_duration_seconds_count", `kind="`+kind+`"`, utoa(count))
+	}
+
+	mw.header("rawx_replies_total", "counter", "Replies sent, by status code")
+	for status := range statusCounts {
+		if count := atomic.LoadUint64(&statusCounts[status]); count > 0 {
+			mw.sample("rawx_replies_total", `code="`+strconv.Itoa(status)+`"`, utoa(count))
+		}
+	}
+
+	mw.counter("rawx_bytes_in_total", "Bytes of chunk data received", &counters.RepBwritten)
+	mw.counter("rawx_bytes_stored_total", "Bytes of chunk data written on disk, after compression", &counters.RepBstored)
+	mw.counter("rawx_bytes_out_total", "Bytes of chunk data sent", &counters.RepBread)
+	mw.counter("rawx_notifications_dropped_total", "Events that could not be delivered", &counters.NotifDropped)
+	mw.counter("rawx_downloads_stalled_total", "Downloads cut because the client stopped reading", &counters.RepStalled)
+	mw.counter("rawx_uploads_aborted_total", "Uploads cut because the client disconnected", &counters.ReqAborted)
+	mw.counter("rawx_downloads_aborted_total", "Downloads cut because the client disconnected", &counters.RepAborted)
+	mw.counter("rawx_scrub_chunks_total", "Chunks verified by the scrubber", &counters.ScrubChecked)
+	mw.counter("rawx_scrub_corrupted_total", "Corrupted chunks found by the scrubber", &counters.ScrubCorrupted)
+
+	rr.rep.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rr.replyCode(http.StatusOK)
+	rr.rep.Write(mw.Bytes())
+}
+
+func (rr *rawxRequest) serveMetrics() {
+	if err := rr.drain(); err != nil {
+		rr.replyError("", err)
+		return
+	}
+
+	var spent uint64
+	switch rr.req.Method {
+	case "GET", "HEAD":
+		doGetMetrics(rr)
+		spent = IncrementStatReqStat(rr)
+	default:
+		rr.replyNotAllowed(serviceAllowedMethods)
+		spent = IncrementStatReqOther(rr)
+	}
+
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.req.Host,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+			tls:       rr.req.TLS != nil,
+		})
+	}
+}
@@ -0,0 +1,45 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	h := newHistogram()
+	// One sample on a bound, one between two bounds, one beyond the last
+	h.observe(1000)
+	h.observe(30000)
+	h.observe(20000000)
+
+	if h.count != 3 {
+		t.Errorf("expected 3 samples, got %d", h.count)
+	}
+	if h.sum != 20031000 {
+		t.Errorf("expected a sum of 20031000, got %d", h.sum)
+	}
+	for i, bound := range latencyBuckets {
+		var expected uint64
+		if bound == 1000 || bound == 50000 {
+			expected = 1
+		}
+		if h.buckets[i] != expected {
+			t.Errorf("bucket %d: expected %d, got %d", bound, expected, h.buckets[i])
+		}
+	}
+}
@@ -28,6 +28,7 @@ type statInfo struct {
 	ReqTimeAll   uint64 `tag:"req.time"`
 	ReqTimePut   uint64 `tag:"req.time.put"`
 	ReqTimeCopy  uint64 `tag:"req.time.copy"`
+	ReqTimePatch uint64 `tag:"req.time.patch"`
 	ReqTimeGet   uint64 `tag:"req.time.get"`
 	ReqTimeHead  uint64 `tag:"req.time.head"`
 	ReqTimeDel   uint64 `tag:"req.time.del"`
@@ -39,6 +40,7 @@ type statInfo struct {
 	ReqHitsAll   uint64 `tag:"req.hits"`
 	ReqHitsPut   uint64 `tag:"req.hits.put"`
 	ReqHitsCopy  uint64 `tag:"req.hits.copy"`
+	ReqHitsPatch uint64 `tag:"req.hits.patch"`
 	ReqHitsGet   uint64 `tag:"req.hits.get"`
 	ReqHitsHead  uint64 `tag:"req.hits.head"`
 	ReqHitsDel   uint64 `tag:"req.hits.del"`
@@ -56,6 +58,22 @@ type statInfo struct {
 
 	RepBread    uint64 `tag:"rep.bread"`
 	RepBwritten uint64 `tag:"rep.bwritten"`
+	// Bytes written on disk by the uploads, after compression
+	RepBstored uint64 `tag:"rep.bstored"`
+
+	// Events that could not be delivered to the notifier backends
+	NotifDropped uint64 `tag:"notif.dropped"`
+
+	// Downloads cut because the client stopped reading
+	RepStalled uint64 `tag:"rep.stalled"`
+
+	// Uploads and downloads cut because the client disconnected
+	ReqAborted uint64 `tag:"req.aborted"`
+	RepAborted uint64 `tag:"rep.aborted"`
+
+	// Chunks verified by the scrubber, and found corrupted among them
+	ScrubChecked   uint64 `tag:"scrub.checked"`
+	ScrubCorrupted uint64 `tag:"scrub.corrupted"`
 }
 
 var counters statInfo
@@ -64,6 +82,7 @@ func incrementStatReq(rr *rawxRequest) uint64 {
 	spent := uint64(time.Since(rr.startTime).Nanoseconds() / 1000)
 	atomic.AddUint64(&counters.ReqTimeAll, spent)
 	atomic.AddUint64(&counters.ReqHitsAll, 1)
+	countStatus(rr.status)
 
 	if rr.status == 0 {
 		atomic.AddUint64(&counters.RepHitsOther, 1)
@@ -93,7 +112,9 @@ func IncrementStatReqPut(rr *rawxRequest) uint64 {
 	spent := incrementStatReq(rr)
 	atomic.AddUint64(&counters.ReqTimePut, spent)
 	atomic.AddUint64(&counters.ReqHitsPut, 1)
+	latencies["put"].observe(spent)
 	atomic.AddUint64(&counters.RepBwritten, rr.bytesIn)
+	atomic.AddUint64(&counters.RepBstored, rr.bytesStored)
 	return spent
 }
 
@@ -101,6 +122,15 @@ func IncrementStatReqCopy(rr *rawxRequest) uint64 {
 	spent := incrementStatReq(rr)
 	atomic.AddUint64(&counters.ReqTimeCopy, spent)
 	atomic.AddUint64(&counters.ReqHitsCopy, 1)
+	latencies["copy"].observe(spent)
+	return spent
+}
+
+func IncrementStatReqPatch(rr *rawxRequest) uint64 {
+	spent := incrementStatReq(rr)
+	atomic.AddUint64(&counters.ReqTimePatch, spent)
+	atomic.AddUint64(&counters.ReqHitsPatch, 1)
+	latencies["patch"].observe(spent)
 	return spent
 }
 
@@ -108,6 +138,7 @@ func IncrementStatReqHead(rr *rawxRequest) uint64 {
 	spent := incrementStatReq(rr)
 	atomic.AddUint64(&counters.ReqTimeHead, spent)
 	atomic.AddUint64(&counters.ReqHitsHead, 1)
+	latencies["head"].observe(spent)
 	return spent
 }
 
@@ -115,6 +146,7 @@ func IncrementStatReqGet(rr *rawxRequest) uint64 {
 	spent := incrementStatReq(rr)
 	atomic.AddUint64(&counters.ReqTimeGet, spent)
 	atomic.AddUint64(&counters.ReqHitsGet, 1)
+	latencies["get"].observe(spent)
 	atomic.AddUint64(&counters.RepBread, rr.bytesOut)
 	return spent
 }
@@ -123,6 +155,7 @@ func IncrementStatReqDel(rr *rawxRequest) uint64 {
 	spent := incrementStatReq(rr)
 	atomic.AddUint64(&counters.ReqTimeDel, spent)
 	atomic.AddUint64(&counters.ReqHitsDel, 1)
+	latencies["del"].observe(spent)
 	return spent
 }
 
@@ -130,6 +163,7 @@ func IncrementStatReqStat(rr *rawxRequest) uint64 {
 	spent := incrementStatReq(rr)
 	atomic.AddUint64(&counters.ReqTimeStat, spent)
 	atomic.AddUint64(&counters.ReqHitsStat, 1)
+	latencies["stat"].observe(spent)
 	return spent
 }
 
@@ -137,6 +171,7 @@ func IncrementStatReqInfo(rr *rawxRequest) uint64 {
 	spent := incrementStatReq(rr)
 	atomic.AddUint64(&counters.ReqTimeInfo, spent)
 	atomic.AddUint64(&counters.ReqHitsInfo, 1)
+	latencies["info"].observe(spent)
 	return spent
 }
 
@@ -144,6 +179,7 @@ func IncrementStatReqOther(rr *rawxRequest) uint64 {
 	spent := incrementStatReq(rr)
 	atomic.AddUint64(&counters.ReqTimeOther, spent)
 	atomic.AddUint64(&counters.ReqHitsOther, 1)
+	latencies["other"].observe(spent)
 	return spent
 }
 
@@ -187,7 +223,7 @@ func (rr *rawxRequest) serveStat() {
 		doGetStats(rr)
 		spent = IncrementStatReqStat(rr)
 	default:
-		rr.replyCode(http.StatusMethodNotAllowed)
+		rr.replyNotAllowed(serviceAllowedMethods)
 		spent = IncrementStatReqOther(rr)
 	}
 
@@ -0,0 +1,137 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Verifies the integrity of a chunk without sending its data: a VERIFY request
+on the chunk makes the rawx read it, compute its checksum with the algorithm
+saved in its XATTR, and compare it with the saved checksum. The secondary
+checksum, when present, is verified along. The reply tells both values:
+	{"chunk_id": "0123...", "valid": false,
+	 "hash_algo": "md5", "expected_hash": "...", "actual_hash": "..."}
+with a "200 OK" when the chunk is intact, a "422 Unprocessable Entity" when
+it is corrupted.
+*/
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type verifyReport struct {
+	ChunkID           string `json:"chunk_id"`
+	Valid             bool   `json:"valid"`
+	HashAlgo          string `json:"hash_algo"`
+	ExpectedHash      string `json:"expected_hash"`
+	ActualHash        string `json:"actual_hash"`
+	SecondaryAlgo     string `json:"secondary_hash_algo,omitempty"`
+	SecondaryExpected string `json:"secondary_expected_hash,omitempty"`
+	SecondaryActual   string `json:"secondary_actual_hash,omitempty"`
+}
+
+// Read the whole data of the chunk, and compare its checksums with the
+// values saved in its XATTR.
+func verifyChunkData(rr *rawxRequest, chunkIn fileReader) (verifyReport, error) {
+	report := verifyReport{ChunkID: rr.chunkID}
+
+	if rr.chunk.ChunkHash == "" {
+		return report, errMissingXattr(AttrNameChunkChecksum, nil)
+	}
+	report.HashAlgo = rr.chunk.hashAlgo
+	if report.HashAlgo == "" {
+		report.HashAlgo = checksumAlgoDefault
+	}
+	report.ExpectedHash = strings.ToUpper(rr.chunk.ChunkHash)
+	h, err := newChecksum(rr.chunk.hashAlgo)
+	if err != nil {
+		return report, err
+	}
+
+	var h2 hash.Hash
+	if rr.chunk.secondaryHash != "" {
+		if h2, err = newChecksum(rr.chunk.secondaryAlgo); err != nil {
+			return report, err
+		}
+		report.SecondaryAlgo = rr.chunk.secondaryAlgo
+		report.SecondaryExpected = strings.ToUpper(rr.chunk.secondaryHash)
+	}
+
+	// Data that cannot be decompressed is corrupted, unlike data that cannot
+	// be read from the volume
+	failed := func(err error) (verifyReport, error) {
+		var pathErr *os.PathError
+		if rr.chunk.compressed() && !errors.As(err, &pathErr) {
+			return report, nil
+		}
+		return report, err
+	}
+	in, filter, err := rr.getChunkReader(chunkIn, rr.chunk.size, rangeInfo{})
+	if filter != nil {
+		defer filter.Close()
+	}
+	if err != nil {
+		return failed(err)
+	}
+	if _, err = io.Copy(checksumsWriter(h, h2), in); err != nil {
+		return failed(err)
+	}
+
+	report.ActualHash = strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+	report.Valid = report.ActualHash == report.ExpectedHash
+	if h2 != nil {
+		report.SecondaryActual = strings.ToUpper(hex.EncodeToString(h2.Sum(nil)))
+		report.Valid = report.Valid && report.SecondaryActual == report.SecondaryExpected
+	}
+	return report, nil
+}
+
+func (rr *rawxRequest) verifyChunk() {
+	chunkIn, err := rr.repo().get(rr.chunkID)
+	if err != nil {
+		rr.replyError("verifyChunk()", err)
+		return
+	}
+	defer chunkIn.Close()
+
+	if rr.chunk, err = loadAttr(chunkIn, rr.chunkID, rr.reqid); err != nil {
+		rr.replyError("verifyChunk()", err)
+		return
+	}
+	rr.patchUnknownSize(chunkIn)
+
+	report, err := verifyChunkData(rr, chunkIn)
+	if err != nil {
+		rr.replyError("verifyChunk()", err)
+		return
+	}
+
+	rr.rep.Header().Set("Content-Type", "application/json")
+	if report.Valid {
+		rr.replyCode(http.StatusOK)
+	} else {
+		LogError("Corrupted chunk %s, expected %s, got %s (reqid=%s)",
+			rr.chunkID, report.ExpectedHash, report.ActualHash, rr.reqid)
+		rr.replyCode(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(rr.rep).Encode(report)
+}
@@ -0,0 +1,120 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func putVerifiedChunk(t *testing.T, rawx *rawxService, data string, attrs map[string]string) {
+	out, err := rawx.repo.put(testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte(data))
+	for k, v := range attrs {
+		out.setAttr(k, []byte(v))
+	}
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func verifyTestChunk(t *testing.T, rawx *rawxService) (int, verifyReport) {
+	var report verifyReport
+	verify := func(rr *rawxRequest) { rr.verifyChunk() }
+	rec := serveTestChunk(rawx, httptest.NewRequest("VERIFY", "/"+testChunkID, nil), verify)
+	if rec.Code == http.StatusOK || rec.Code == http.StatusUnprocessableEntity {
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, report
+}
+
+func TestVerifyChunk(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+
+	// MD5 and CRC32C of "123456789"
+	putVerifiedChunk(t, rawx, "123456789", map[string]string{
+		AttrNameChunkChecksum:              "25f9e794323b453885f5181f1b624d0b",
+		AttrNameChunkChecksumSecondary:     "E3069283",
+		AttrNameChunkChecksumSecondaryAlgo: checksumAlgoCRC32C,
+	})
+	status, report := verifyTestChunk(t, rawx)
+	if status != http.StatusOK || !report.Valid || report.HashAlgo != checksumAlgoMD5 ||
+		report.ActualHash != "25F9E794323B453885F5181F1B624D0B" || report.SecondaryActual != "E3069283" {
+		t.Errorf("unexpected reply %d %+v", status, report)
+	}
+
+	// The data changed behind the rawx
+	rawx.repo.del(testChunkID)
+	putVerifiedChunk(t, rawx, "123456780", map[string]string{
+		AttrNameChunkChecksum: "25F9E794323B453885F5181F1B624D0B",
+	})
+	status, report = verifyTestChunk(t, rawx)
+	if status != http.StatusUnprocessableEntity || report.Valid ||
+		report.ExpectedHash != "25F9E794323B453885F5181F1B624D0B" || report.ActualHash == report.ExpectedHash {
+		t.Errorf("unexpected reply %d %+v", status, report)
+	}
+
+	// The compressed data cannot be decompressed anymore
+	rawx.repo.del(testChunkID)
+	putVerifiedChunk(t, rawx, "not zlib at all", map[string]string{
+		AttrNameChunkChecksum: "25F9E794323B453885F5181F1B624D0B",
+		AttrNameCompression:   compressionZlib,
+	})
+	if status, report = verifyTestChunk(t, rawx); status != http.StatusUnprocessableEntity || report.Valid {
+		t.Errorf("unexpected reply %d %+v", status, report)
+	}
+
+	// Nothing to compare with
+	rawx.repo.del(testChunkID)
+	putVerifiedChunk(t, rawx, "123456789", nil)
+	if status, _ = verifyTestChunk(t, rawx); status == http.StatusOK || status == http.StatusUnprocessableEntity {
+		t.Errorf("unexpected status %d", status)
+	}
+}
+
+// A download of a corrupted chunk is interrupted, once counted
+func TestDownloadCorrupted(t *testing.T) {
+	InitNoopLogger()
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	rawx.verifyRead = true
+	putVerifiedChunk(t, rawx, "123456780", map[string]string{
+		AttrNameChunkChecksum: "25F9E794323B453885F5181F1B624D0B",
+	})
+
+	hits := atomic.LoadUint64(&counters.ReqHitsGet)
+	var aborted interface{}
+	serveTestChunk(rawx, httptest.NewRequest("GET", "/"+testChunkID, nil), func(rr *rawxRequest) {
+		defer func() { aborted = recover() }()
+		rr.serveChunk()
+	})
+	if aborted != http.ErrAbortHandler {
+		t.Errorf("download not aborted: %v", aborted)
+	}
+	if atomic.LoadUint64(&counters.ReqHitsGet) != hits+1 {
+		t.Error("aborted download not counted")
+	}
+}
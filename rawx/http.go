@@ -37,7 +37,8 @@ func Run(srv *http.Server, tlsSrv *http.Server,
 		// Starting HTTPS server
 		go func() {
 			log.Printf("Starting HTTPS service on %s ...", tlsSrv.Addr)
-			if err := tlsSrv.ListenAndServeTLS(opts["tls_cert_file"], opts["tls_key_file"]); err != nil {
+			// The certificate is provided by the TLS configuration
+			if err := tlsSrv.ListenAndServeTLS("", ""); err != nil {
 				errs <- err
 			}
 		}()
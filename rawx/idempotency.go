@@ -0,0 +1,160 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Remembers for a while the successful uploads carrying an idempotency key, so
+that a retry with the same key on the same chunk gets the original reply
+instead of being processed again. A retry arriving while the original upload
+is still in progress waits for its outcome. The failed uploads are forgotten
+at once, their retries are processed as new uploads. The dry runs store
+nothing and are never remembered.
+*/
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type uploadOutcome struct {
+	// Closed once the upload is done, the fields below are then set
+	done    chan struct{}
+	status  int
+	headers http.Header
+	expires time.Time
+}
+
+type idempotencyEntry struct {
+	key     string
+	outcome *uploadOutcome
+}
+
+type idempotencyCache struct {
+	ttl time.Duration
+	max int
+
+	lock    sync.Mutex
+	entries map[string]*uploadOutcome
+	// The entries by age, the oldest first. An entry may have been replaced
+	// or removed from the map meanwhile.
+	order []idempotencyEntry
+}
+
+// A nil cache is returned when the TTL or the capacity is not positive
+func newIdempotencyCache(ttl time.Duration, max int) *idempotencyCache {
+	if ttl <= 0 || max <= 0 {
+		return nil
+	}
+	return &idempotencyCache{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[string]*uploadOutcome),
+	}
+}
+
+// Forget the oldest entries, either expired or beyond the capacity. The
+// uploads in progress are never forgotten, their retries wait for them: the
+// capacity may be exceeded by as many entries.
+func (c *idempotencyCache) evict(now time.Time) {
+	for n := len(c.order); n > 0; n-- {
+		e := c.order[0]
+		if o, ok := c.entries[e.key]; ok && o == e.outcome {
+			if o.expires.IsZero() {
+				// In progress, checked again later
+				c.order = append(c.order[1:], e)
+				continue
+			}
+			if !now.After(o.expires) && len(c.entries) < c.max {
+				return
+			}
+			delete(c.entries, e.key)
+		}
+		c.order = c.order[1:]
+	}
+}
+
+// Return the outcome of the upload with the given key, and tell if the
+// caller is the first to ask for it, i.e. if it must serve the upload and
+// then call finish().
+func (c *idempotencyCache) begin(key string) (*uploadOutcome, bool) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evict(now)
+	if o, ok := c.entries[key]; ok {
+		return o, false
+	}
+	o := &uploadOutcome{done: make(chan struct{})}
+	c.entries[key] = o
+	c.order = append(c.order, idempotencyEntry{key: key, outcome: o})
+	return o, true
+}
+
+// Record the reply of an upload that stored the chunk, forget the others
+func (c *idempotencyCache) finish(key string, o *uploadOutcome, status int, headers http.Header) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if status == http.StatusCreated {
+		o.status = status
+		o.headers = headers.Clone()
+		o.expires = time.Now().Add(c.ttl)
+	} else if c.entries[key] == o {
+		delete(c.entries, key)
+	}
+	close(o.done)
+}
+
+// Serve the upload, unless it retries an upload done with the same
+// idempotency key: the original reply is then sent again and the body of the
+// retry is discarded.
+func (rr *rawxRequest) uploadChunkOnce() {
+	key := rr.req.Header.Get(HeaderNameIdempotencyKey)
+	cache := rr.rawx.idempotency
+	// A dry run stores nothing, it must not be replayed to the real upload
+	if key == "" || cache == nil || GetBool(rr.req.Header.Get(HeaderNameDryRun), false) {
+		rr.uploadChunk()
+		return
+	}
+	key = rr.chunkID + "/" + key
+
+	for {
+		o, first := cache.begin(key)
+		if first {
+			rr.uploadChunk()
+			cache.finish(key, o, rr.status, rr.rep.Header())
+			return
+		}
+		select {
+		case <-o.done:
+		case <-rr.req.Context().Done():
+			rr.replyError("uploadChunkOnce()", rr.req.Context().Err())
+			return
+		}
+		// The original upload failed, this one is the first retry
+		if o.status == 0 {
+			continue
+		}
+		rr.discardBody()
+		headers := rr.rep.Header()
+		for k, v := range o.headers {
+			headers[k] = v
+		}
+		rr.replyCode(o.status)
+		return
+	}
+}
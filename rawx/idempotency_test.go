@@ -0,0 +1,85 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	if newIdempotencyCache(0, 10) != nil {
+		t.Error("cache enabled without TTL")
+	}
+	c := newIdempotencyCache(time.Hour, 2)
+
+	o, first := c.begin("a")
+	if !first {
+		t.Fatal("unexpected outcome")
+	}
+	// A retry waits for the original upload
+	waiting := make(chan *uploadOutcome)
+	go func() {
+		retry, first := c.begin("a")
+		if first {
+			retry = nil
+		} else {
+			<-retry.done
+		}
+		waiting <- retry
+	}()
+	h := http.Header{}
+	h.Set(HeaderNameChunkChecksum, "0123")
+	c.finish("a", o, http.StatusCreated, h)
+	if retry := <-waiting; retry == nil || retry.status != http.StatusCreated ||
+		retry.headers.Get(HeaderNameChunkChecksum) != "0123" {
+		t.Errorf("unexpected outcome %+v", retry)
+	}
+
+	// A failed upload is forgotten, a dry run too
+	for _, status := range []int{http.StatusInternalServerError, http.StatusNoContent} {
+		o, _ = c.begin("b")
+		c.finish("b", o, status, http.Header{})
+		if _, first = c.begin("b"); !first {
+			t.Errorf("upload replied %d remembered", status)
+		}
+		delete(c.entries, "b")
+	}
+
+	// Bounded, the oldest are forgotten first
+	o, _ = c.begin("b")
+	c.finish("b", o, http.StatusCreated, http.Header{})
+	c.begin("c")
+	if _, first = c.begin("a"); !first {
+		t.Error("oldest upload still remembered")
+	}
+	if len(c.entries) > 2 {
+		t.Errorf("too many entries: %d", len(c.entries))
+	}
+
+	// But the uploads in progress are never forgotten
+	if _, first = c.begin("d"); !first {
+		t.Error("new upload not served")
+	}
+	if _, ok := c.entries["a"]; !ok {
+		t.Error("upload in progress forgotten")
+	}
+	if _, ok := c.entries["c"]; !ok {
+		t.Error("upload in progress forgotten")
+	}
+}
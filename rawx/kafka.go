@@ -0,0 +1,85 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Publishes the events to a Kafka topic. The endpoint is configured as
+	kafka://broker1:9092,broker2:9092/topic
+where the topic is optional.
+*/
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// How long a Kafka backend may take to publish an event
+const kafkaNotifierTimeout = 5 * time.Second
+
+type kafkaBackend struct {
+	w       *kafka.Writer
+	brokers []string
+	topic   string
+}
+
+func makeKafkaBackend(endpoint string) (*kafkaBackend, error) {
+	backend := kafkaBackend{topic: kafkaNotifierDefaultTopic}
+	if i := strings.IndexByte(endpoint, '/'); i >= 0 {
+		if topic := endpoint[i+1:]; topic != "" {
+			backend.topic = topic
+		}
+		endpoint = endpoint[:i]
+	}
+	for _, broker := range strings.Split(endpoint, ",") {
+		if broker != "" {
+			backend.brokers = append(backend.brokers, broker)
+		}
+	}
+	if len(backend.brokers) == 0 {
+		return nil, errNoBroker
+	}
+	return &backend, nil
+}
+
+func (backend *kafkaBackend) push(event []byte) error {
+	// Lazy connection, the writer then manages the reconnections itself
+	if backend.w == nil {
+		backend.w = kafka.NewWriter(kafka.WriterConfig{
+			Brokers: backend.brokers,
+			Topic:   backend.topic,
+			// Each worker sends its events one by one, don't wait for
+			// a batch to be filled.
+			BatchSize:    1,
+			MaxAttempts:  kafkaNotifierMaxAttempts,
+			WriteTimeout: kafkaNotifierTimeout,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaNotifierTimeout)
+	defer cancel()
+	return backend.w.WriteMessages(ctx, kafka.Message{Value: event})
+}
+
+func (backend *kafkaBackend) close() {
+	if backend.w != nil {
+		backend.w.Close()
+		backend.w = nil
+	}
+}
@@ -17,6 +17,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/syslog"
@@ -24,26 +26,31 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type oioLogger interface {
 	close()
 	writeAccess(message string)
-	writeInfo(message string)
-	writeError(message string)
+	writeLog(severity syslog.Priority, message string)
 }
 
 var accessLogGet = configAccessLogDefaultGet
 var accessLogPut = configAccessLogDefaultPut
 var accessLogDel = configAccessLogDefaultDelete
 
+// Emit the access log lines as JSON objects instead of plain text
+var accessLogJSON = false
+
 // Activate the extreme verbosity on the RAWX. This is has to be set at the
 // startup of the service.
 var logExtremeVerbosity = false
 
 // The high severity (a.k.a. log level) that will be logged by the application.
-var logDefaultSeverity = syslog.LOG_NOTICE
+// Both may change at runtime (signals, settings) while they are read by all
+// the coroutines: they are only accessed atomically.
+var logDefaultSeverity = int32(syslog.LOG_NOTICE)
 
 // When using
 var logSeverity = logDefaultSeverity
@@ -66,6 +73,7 @@ type AccessLogEvent struct {
 	path      string
 	reqId     string
 	tls       bool
+	err       error
 }
 
 type NoopLogger struct{}
@@ -78,41 +86,74 @@ func isVerbose() bool {
 	return logExtremeVerbosity && severityAllowed(syslog.LOG_DEBUG)
 }
 
+func currentSeverity() syslog.Priority {
+	return syslog.Priority(atomic.LoadInt32(&logSeverity))
+}
+
 func severityAllowed(severity syslog.Priority) bool {
-	return severity <= logSeverity
+	return severity <= currentSeverity()
 }
 
 func initVerbosity(severity syslog.Priority) {
-	logDefaultSeverity = severity
-	logSeverity = severity
+	atomic.StoreInt32(&logDefaultSeverity, int32(severity))
+	atomic.StoreInt32(&logSeverity, int32(severity))
 }
 
 func maximizeVerbosity() {
 	logExtremeVerbosity = true
-	logDefaultSeverity = syslog.LOG_DEBUG
-	logSeverity = syslog.LOG_DEBUG
+	initVerbosity(syslog.LOG_DEBUG)
 }
 
 func increaseVerbosity() {
-	if logSeverity < syslog.LOG_DEBUG {
-		logSeverity = logSeverity + 1
+	for {
+		severity := atomic.LoadInt32(&logSeverity)
+		if severity >= int32(syslog.LOG_DEBUG) ||
+			atomic.CompareAndSwapInt32(&logSeverity, severity, severity+1) {
+			return
+		}
 	}
 }
 
 func resetVerbosity() {
-	logSeverity = logDefaultSeverity
+	atomic.StoreInt32(&logSeverity, atomic.LoadInt32(&logDefaultSeverity))
+}
+
+// The names of the log levels, as configured
+var severityNames = map[string]syslog.Priority{
+	"debug":   syslog.LOG_DEBUG,
+	"info":    syslog.LOG_INFO,
+	"notice":  syslog.LOG_NOTICE,
+	"warning": syslog.LOG_WARNING,
+	"error":   syslog.LOG_ERR,
 }
 
-func getSeverity(priority syslog.Priority) (bool, string) {
+// Parse the name of a log level, whatever its case
+func parseSeverity(name string) (syslog.Priority, bool) {
+	severity, ok := severityNames[strings.ToLower(name)]
+	return severity, ok
+}
+
+// Name the current log level
+func severityName() string {
+	current := currentSeverity()
+	for name, severity := range severityNames {
+		if severity == current {
+			return name
+		}
+	}
+	return itoa(int(current))
+}
+
+func getSeverity(priority syslog.Priority) string {
 	switch priority {
 	case syslog.LOG_EMERG, syslog.LOG_CRIT, syslog.LOG_ERR:
-		return true, "ERR"
+		return "ERR"
 	case syslog.LOG_WARNING:
-		return false, "WRN"
+		return "WRN"
 	case syslog.LOG_NOTICE, syslog.LOG_INFO:
-		return false, "INF"
+		return "INF"
 	default:
-		return false, "DBG"
+		return "DBG"
 	}
 }
 
@@ -120,7 +161,7 @@ func writeLogFmt(pri syslog.Priority, format string, v ...interface{}) {
 	if !severityAllowed(pri) {
 		return
 	}
-	erroneous, severityName := getSeverity(pri)
+	severityName := getSeverity(pri)
 	sb := strings.Builder{}
 	sb.Grow(256)
 	sb.WriteString(strPid)
@@ -128,15 +169,11 @@ func writeLogFmt(pri syslog.Priority, format string, v ...interface{}) {
 	sb.WriteString(severityName)
 	sb.WriteString(" - ")
 	sb.WriteString(fmt.Sprintf(format, v...))
-	if erroneous {
-		logger.writeError(sb.String())
-	} else {
-		logger.writeInfo(sb.String())
-	}
+	logger.writeLog(pri, sb.String())
 }
 
 func LogFatal(format string, v ...interface{}) {
-	writeLogFmt(syslog.LOG_ERR, format, v...)
+	writeLogFmt(syslog.LOG_CRIT, format, v...)
 	log.Fatalf(format, v...)
 }
 
@@ -189,18 +226,58 @@ func (evt AccessLogEvent) String() string {
 	return sb.String()
 }
 
+// The JSON payload bears the same fields as the text, plus the error that
+// caused the failure of the request, if any.
+func (evt AccessLogEvent) JSON() string {
+	payload := struct {
+		Local     string `json:"local"`
+		Peer      string `json:"peer"`
+		Method    string `json:"method"`
+		Status    int    `json:"status"`
+		TimeSpent uint64 `json:"time_spent"`
+		BytesOut  uint64 `json:"bytes_out"`
+		BytesIn   uint64 `json:"bytes_in"`
+		ReqId     string `json:"request_id"`
+		Path      string `json:"path"`
+		Scheme    string `json:"scheme"`
+		Error     string `json:"error,omitempty"`
+	}{
+		Local:     evt.local,
+		Peer:      evt.peer,
+		Method:    evt.method,
+		Status:    evt.status,
+		TimeSpent: evt.timeSpent,
+		BytesOut:  evt.bytesOut,
+		BytesIn:   evt.bytesIn,
+		ReqId:     evt.reqId,
+		Path:      evt.path,
+		Scheme:    "http",
+	}
+	if evt.tls {
+		payload.Scheme = "https"
+	}
+	if evt.err != nil {
+		payload.Error = evt.err.Error()
+	}
+	encoded, _ := json.Marshal(payload)
+	return strPid + " access INF - " + string(encoded)
+}
+
 func LogHttp(evt AccessLogEvent) {
-	logger.writeAccess(evt.String())
+	if accessLogJSON {
+		logger.writeAccess(evt.JSON())
+	} else {
+		logger.writeAccess(evt.String())
+	}
 }
 
 func InitNoopLogger() {
 	logger = &NoopLogger{}
 }
 
-func (*NoopLogger) writeAccess(string) {}
-func (*NoopLogger) writeInfo(string)   {}
-func (*NoopLogger) writeError(string)  {}
-func (*NoopLogger) close()             {}
+func (*NoopLogger) writeAccess(string)               {}
+func (*NoopLogger) writeLog(syslog.Priority, string) {}
+func (*NoopLogger) close()                           {}
 
 func InitStderrLogger() {
 	initVerbosity(syslog.LOG_DEBUG)
@@ -215,58 +292,166 @@ func (l *StderrLogger) writeAll(m string) {
 	l.logger.Println(fmt.Sprintf("%v.%06d", now.Unix(), (now.UnixNano()/1000)%1000000), m)
 }
 
-func (l *StderrLogger) writeAccess(m string) { l.writeAll(m) }
-func (l *StderrLogger) writeInfo(m string)   { l.writeAll(m) }
-func (l *StderrLogger) writeError(m string)  { l.writeAll(m) }
-func (l *StderrLogger) close()               {}
+func (l *StderrLogger) writeAccess(m string)                 { l.writeAll(m) }
+func (l *StderrLogger) writeLog(_ syslog.Priority, m string) { l.writeAll(m) }
+func (l *StderrLogger) close()                               {}
+
+// A line waiting for the syslog goroutine, either an access log line or a
+// leveled message
+type syslogLine struct {
+	access   bool
+	severity syslog.Priority
+	message  string
+}
 
+// The access log lines and the leveled messages share one bounded queue, so
+// that the request goroutines never wait for the syslog daemon: beyond the
+// capacity of the queue, the lines are dropped.
 type SysLogger struct {
-	queue         chan string
+	queue         chan syslogLine
 	wg            sync.WaitGroup
 	running       bool
 	syslogID      string
 	alertThrottle PeriodicThrottle
 	loggerAccess  *syslog.Writer
-	loggerInfo    *syslog.Writer
-	loggerError   *syslog.Writer
+	loggerLog     *syslog.Writer
 }
 
-func InitSysLogger(syslogID string) {
+// Where the logs are sent to syslog. The facilities bear no severity, the
+// severity of each message is preserved.
+type syslogTarget struct {
+	// Either "udp", "tcp" or "unix", empty for the local syslog daemon
+	network string
+	addr    string
+	// Facility of the messages, and of the access log
+	facility       syslog.Priority
+	facilityAccess syslog.Priority
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+var errSyslogFacility = errors.New("Unknown syslog facility")
+var errSyslogAddr = errors.New("Invalid syslog address")
+
+func parseSyslogFacility(name string) (syslog.Priority, error) {
+	if facility, ok := syslogFacilities[strings.ToLower(name)]; ok {
+		return facility, nil
+	}
+	return 0, errSyslogFacility
+}
+
+// Parse the address of a syslog daemon, either "host:port" (UDP), or
+// prefixed with the network, e.g. "tcp://host:port" or "unix:///dev/log".
+// An empty address designates the local daemon.
+func parseSyslogAddr(v string) (string, string, error) {
+	if v == "" {
+		return "", "", nil
+	}
+	network, addr := "udp", v
+	if i := strings.Index(v, "://"); i >= 0 {
+		network, addr = v[:i], v[i+3:]
+	}
+	switch network {
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return "", "", errSyslogAddr
+	}
+	if addr == "" {
+		return "", "", errSyslogAddr
+	}
+	return network, addr, nil
+}
+
+func InitSysLogger(syslogID string, target syslogTarget) error {
+	la, err := syslog.Dial(target.network, target.addr, target.facilityAccess|syslog.LOG_INFO, syslogID)
+	if err != nil {
+		return err
+	}
+	ll, err := syslog.Dial(target.network, target.addr, target.facility|syslog.LOG_INFO, syslogID)
+	if err != nil {
+		la.Close()
+		return err
+	}
+
 	initVerbosity(syslog.LOG_INFO)
 	l := &SysLogger{}
 	l.alertThrottle = PeriodicThrottle{period: 1000000000}
-	l.queue = make(chan string, configAccessLogQueueDefaultLength)
+	l.queue = make(chan syslogLine, configAccessLogQueueDefaultLength)
 	l.running = true
 	l.syslogID = syslogID
-	l.loggerAccess, _ = syslog.New(syslog.LOG_LOCAL1|syslog.LOG_INFO, syslogID)
-	l.loggerInfo, _ = syslog.New(syslog.LOG_LOCAL0|syslog.LOG_INFO, syslogID)
-	l.loggerError, _ = syslog.New(syslog.LOG_LOCAL0|syslog.LOG_ERR, syslogID)
+	l.loggerAccess = la
+	l.loggerLog = ll
 	l.wg.Add(1)
 	go func() {
 		for evt := range l.queue {
-			l.loggerAccess.Info(evt)
+			if evt.access {
+				l.loggerAccess.Info(evt.message)
+			} else {
+				l.send(evt.severity, evt.message)
+			}
 		}
 		l.wg.Done()
 	}()
 	logger = l
+	return nil
 }
 
-func (l *SysLogger) writeAccess(m string) {
+func (l *SysLogger) push(line syslogLine) {
 	select {
-	case l.queue <- m: // no-blocking call, everything is fine
+	case l.queue <- line: // no-blocking call, everything is fine
 	default:
+		// The warning would be dropped as well if queued
 		if l.alertThrottle.Ok() {
-			LogWarning("syslog clogged")
+			l.loggerLog.Warning("syslog clogged")
 		}
 		// FIXME(jfs): Uncomment this upon an absolute necessity
-		// l.queue <- m
+		// l.queue <- line
+	}
+}
+
+func (l *SysLogger) writeAccess(m string) {
+	l.push(syslogLine{access: true, message: m})
+}
+
+func (l *SysLogger) writeLog(severity syslog.Priority, m string) {
+	if severity < syslog.LOG_ERR {
+		// The process exits at once, the queue would never be drained
+		l.send(severity, m)
+		return
+	}
+	l.push(syslogLine{severity: severity, message: m})
+}
+
+func (l *SysLogger) send(severity syslog.Priority, m string) {
+	switch severity {
+	case syslog.LOG_EMERG, syslog.LOG_ALERT, syslog.LOG_CRIT, syslog.LOG_ERR:
+		l.loggerLog.Err(m)
+	case syslog.LOG_WARNING:
+		l.loggerLog.Warning(m)
+	case syslog.LOG_NOTICE:
+		l.loggerLog.Notice(m)
+	case syslog.LOG_INFO:
+		l.loggerLog.Info(m)
+	default:
+		l.loggerLog.Debug(m)
 	}
 }
 
-func (l *SysLogger) writeInfo(m string)  { l.loggerInfo.Info(m) }
-func (l *SysLogger) writeError(m string) { l.loggerError.Err(m) }
 func (l *SysLogger) close() {
 	l.running = false
 	close(l.queue)
 	l.wg.Wait()
+	l.loggerAccess.Close()
+	l.loggerLog.Close()
 }
@@ -0,0 +1,111 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSeverity(t *testing.T) {
+	defer initVerbosity(currentSeverity())
+	for name, expected := range severityNames {
+		severity, ok := parseSeverity(name)
+		if !ok || severity != expected {
+			t.Errorf("%s: unexpected severity %v", name, severity)
+		}
+		initVerbosity(severity)
+		if severityName() != name {
+			t.Errorf("%s: unexpected name %s", name, severityName())
+		}
+	}
+	if severity, ok := parseSeverity("WARNING"); !ok || severity != syslog.LOG_WARNING {
+		t.Error("the case of the level matters")
+	}
+	if _, ok := parseSeverity("verbose"); ok {
+		t.Error("unknown level accepted")
+	}
+	// Below the threshold, the messages are not logged
+	initVerbosity(syslog.LOG_WARNING)
+	if severityAllowed(syslog.LOG_INFO) || !severityAllowed(syslog.LOG_ERR) {
+		t.Error("unexpected threshold")
+	}
+}
+
+func TestParseSyslogAddr(t *testing.T) {
+	cases := []struct {
+		v       string
+		network string
+		addr    string
+		err     error
+	}{
+		{"", "", "", nil},
+		{"logs:514", "udp", "logs:514", nil},
+		{"udp://logs:514", "udp", "logs:514", nil},
+		{"tcp://logs:601", "tcp", "logs:601", nil},
+		{"unix:///dev/log", "unix", "/dev/log", nil},
+		{"http://logs:514", "", "", errSyslogAddr},
+		{"tcp://", "", "", errSyslogAddr},
+	}
+	for _, c := range cases {
+		network, addr, err := parseSyslogAddr(c.v)
+		if network != c.network || addr != c.addr || err != c.err {
+			t.Errorf("%q: unexpected %s %s %v", c.v, network, addr, err)
+		}
+	}
+}
+
+// The messages sent to a remote daemon bear the configured facility and
+// their own severity
+func TestRemoteSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer initVerbosity(currentSeverity())
+	defer InitNoopLogger()
+
+	target := syslogTarget{
+		network:        "udp",
+		addr:           conn.LocalAddr().String(),
+		facility:       syslog.LOG_LOCAL3,
+		facilityAccess: syslog.LOG_LOCAL4,
+	}
+	if err := InitSysLogger("rawx-test", target); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.close()
+	LogWarning("something odd")
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	prefix := fmt.Sprintf("<%d>", syslog.LOG_LOCAL3|syslog.LOG_WARNING)
+	if !strings.HasPrefix(msg, prefix) || !strings.Contains(msg, "rawx-test") ||
+		!strings.Contains(msg, "WRN - something odd") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
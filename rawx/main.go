@@ -22,9 +22,13 @@ http handler.
 */
 
 import (
+	"compress/zlib"
 	"context"
+	"crypto/tls"
 	"flag"
+	"io/ioutil"
 	"log"
+	"log/syslog"
 	"net"
 	"net/http"
 	"os"
@@ -32,6 +36,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -52,11 +57,29 @@ func checkNS(ns string) {
 	}
 }
 
-func installSigHandlers(srv *http.Server) {
+// Stop the server gracefully: the listeners are closed at once, then the
+// in-flight requests are given some time to complete. The connections still
+// active at the deadline are closed, so that the uploads running on them fail
+// and are aborted.
+func shutdown(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		LogWarning("graceful shutdown error: %v", err)
+		srv.Close()
+	}
+}
+
+// The returned channel is closed once all the servers have been shut down.
+// SIGHUP triggers the reload hook, if any.
+func installSigHandlers(timeout time.Duration, reload func(), servers ...*http.Server) <-chan struct{} {
+	stopped := make(chan struct{})
+	var once sync.Once
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan,
 		syscall.SIGUSR1,
 		syscall.SIGUSR2,
+		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM)
 
@@ -71,14 +94,25 @@ func installSigHandlers(srv *http.Server) {
 				}()
 			case syscall.SIGUSR2:
 				resetVerbosity()
+			case syscall.SIGHUP:
+				if reload != nil {
+					reload()
+				}
 			case syscall.SIGINT, syscall.SIGTERM:
-				ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-				if err := srv.Shutdown(ctx); err != nil {
-					LogWarning("graceful shutdown error: %v", err)
+				var wg sync.WaitGroup
+				for _, srv := range servers {
+					wg.Add(1)
+					go func(srv *http.Server) {
+						defer wg.Done()
+						shutdown(srv, timeout)
+					}(srv)
 				}
+				wg.Wait()
+				once.Do(func() { close(stopped) })
 			}
 		}
 	}()
+	return stopped
 }
 
 func main() {
@@ -100,34 +134,73 @@ func main() {
 	}
 
 	var opts optionsMap
+	var cfg string
 
 	if len(*confPtr) <= 0 {
 		log.Fatal("Missing configuration file")
-	} else if cfg, err := filepath.Abs(*confPtr); err != nil {
+	} else if cfg, err = filepath.Abs(*confPtr); err != nil {
 		log.Fatalf("Invalid configuration file path: %v", err.Error())
 	} else if opts, err = readConfig(cfg); err != nil {
 		log.Fatalf("Exiting with error: %v", err.Error())
 	}
 
+	syslogID := *syslogIDPtr
+	if syslogID == "" {
+		syslogID = opts["syslog_id"]
+	}
 	if logExtremeVerbosity {
 		InitStderrLogger()
-	} else if *syslogIDPtr != "" {
-		InitSysLogger(*syslogIDPtr)
-	} else if v, ok := opts["syslog_id"]; ok {
-		InitSysLogger(v)
+	} else if syslogID != "" {
+		target := syslogTarget{facility: syslog.LOG_LOCAL0, facilityAccess: syslog.LOG_LOCAL1}
+		if target.network, target.addr, err = parseSyslogAddr(opts["syslog_addr"]); err != nil {
+			log.Fatalf("Invalid syslog address: %v", opts["syslog_addr"])
+		}
+		if v, ok := opts["syslog_facility"]; ok {
+			if target.facility, err = parseSyslogFacility(v); err != nil {
+				log.Fatalf("Invalid syslog facility: %v", v)
+			}
+		}
+		if v, ok := opts["syslog_facility_access"]; ok {
+			if target.facilityAccess, err = parseSyslogFacility(v); err != nil {
+				log.Fatalf("Invalid syslog facility: %v", v)
+			}
+		}
+		if err = InitSysLogger(syslogID, target); err != nil {
+			log.Fatalf("Syslog connection error: %v", err)
+		}
 	} else {
 		InitNoopLogger()
 	}
+	// The command line wins over the configuration
+	if v, ok := opts["log_level"]; ok && !logExtremeVerbosity {
+		if severity, ok := parseSeverity(v); ok {
+			initVerbosity(severity)
+		} else {
+			LogFatal("Invalid log level: %s", v)
+		}
+	}
 
 	chunkrepo := chunkRepository{}
 	namespace := opts["ns"]
 	rawxURL := opts["addr"]
 	rawxID := opts["id"]
 	notifAllowed = opts.getBool("events", configDefaultEvents)
+	notifQueueSize = opts.getInt("events_queue_size", notifierDefaultPipeSize)
+	if notifQueueSize <= 0 {
+		LogFatal("Invalid events queue size: %d", notifQueueSize)
+	}
+	notifRetryDelay = time.Duration(opts.getInt("events_retry_delay", notifierDefaultRetryDelay)) * time.Millisecond
 
 	accessLogPut = opts.getBool("log_access_put", configAccessLogDefaultPut)
 	accessLogGet = opts.getBool("log_access_get", configAccessLogDefaultGet)
 	accessLogDel = opts.getBool("log_access_del", configAccessLogDefaultDelete)
+	switch opts["log_access_format"] {
+	case "", "text":
+	case "json":
+		accessLogJSON = true
+	default:
+		LogFatal("Invalid access log format: %s", opts["log_access_format"])
+	}
 
 	checkNS(namespace)
 	checkURL(rawxURL)
@@ -138,6 +211,12 @@ func main() {
 	}
 	chunkrepo.sub.hashWidth = opts.getInt("hash_width", chunkrepo.sub.hashWidth)
 	chunkrepo.sub.hashDepth = opts.getInt("hash_depth", chunkrepo.sub.hashDepth)
+	chunkrepo.sub.prevHashWidth = opts.getInt("hash_width_previous", 0)
+	chunkrepo.sub.prevHashDepth = opts.getInt("hash_depth_previous", 0)
+	if !validHashLayout(chunkrepo.sub.hashWidth, chunkrepo.sub.hashDepth) ||
+		!validHashLayout(chunkrepo.sub.prevHashWidth, chunkrepo.sub.prevHashDepth) {
+		LogFatal("Invalid directories layout")
+	}
 	chunkrepo.sub.syncFile = opts.getBool("fsync_file", chunkrepo.sub.syncFile)
 	chunkrepo.sub.syncDir = opts.getBool("fsync_dir", chunkrepo.sub.syncDir)
 	chunkrepo.sub.fallocateFile = opts.getBool("fallocate", chunkrepo.sub.fallocateFile)
@@ -149,10 +228,24 @@ func main() {
 		tlsUrl:       opts["tls_rawx_url"],
 		path:         chunkrepo.sub.root,
 		id:           rawxID,
-		repo:         chunkrepo,
+		repo:         &chunkrepo,
 		bufferSize:   1024 * opts.getInt("buffer_size", uploadBufferSizeDefault/1024),
 		checksumMode: checksumAlways,
+		checksumAlgo: opts["checksum_algo"],
 		compression:  opts["compression"],
+		verifyRead:   opts.getBool("verify_read", configDefaultVerifyRead),
+		chunkSizeMax: opts.getInt64("chunk_size_max", configDefaultChunkSizeMax),
+		freeSpace: newFreeSpaceChecker(
+			opts.getInt64("free_space_min_bytes", configDefaultFreeSpaceMinBytes),
+			opts.getInt("free_space_min_percent", configDefaultFreeSpaceMinPercent)),
+		corsAllowOrigin: opts["cors_allow_origin"],
+		uploadLimiter: newRateLimiter(
+			opts.getInt64("upload_rate_requests", configDefaultUploadRateRequests),
+			opts.getInt64("upload_rate_bytes", configDefaultUploadRateBytes),
+			opts["upload_rate_header"]),
+		idempotency: newIdempotencyCache(
+			time.Duration(opts.getInt("idempotency_ttl", configDefaultIdempotencyTTL))*time.Second,
+			opts.getInt("idempotency_max_keys", configDefaultIdempotencyMaxKeys)),
 	}
 
 	// Clamp the buffer size to admitted values
@@ -167,7 +260,57 @@ func main() {
 		rawx.bufferSize = uploadBatchSize
 	}
 
-	rawx.uploadBufferPool = newBufferPool(uploadBufferTotalSizeDefault, rawx.bufferSize)
+	// The data of the uploads of unknown size is read ahead in a buffer
+	rawx.compressionMinSize = opts.getInt64("compression_min_size", configDefaultCompressionMinSize)
+	if rawx.compressionMinSize > int64(rawx.bufferSize) {
+		LogWarning("compression_min_size capped at the buffer_size (%d)", rawx.bufferSize)
+		rawx.compressionMinSize = int64(rawx.bufferSize)
+	}
+	rawx.zlibLevel = opts.getInt("compression_zlib_level", zlib.DefaultCompression)
+	if rawx.zlibLevel != zlib.DefaultCompression &&
+		(rawx.zlibLevel < zlib.BestSpeed || rawx.zlibLevel > zlib.BestCompression) {
+		LogFatal("Invalid compression_zlib_level: %d", rawx.zlibLevel)
+	}
+	rawx.gzipDownload = opts.getBool("gzip_download", configDefaultGzipDownload)
+	rawx.gzipMinSize = opts.getInt64("gzip_min_size", configDefaultGzipMinSize)
+	rawx.incompressibleExt = make(map[string]bool)
+	for _, ext := range strings.Split(opts["compression_skip_extensions"], ",") {
+		if ext = strings.Trim(strings.TrimSpace(ext), "."); ext != "" {
+			rawx.incompressibleExt[strings.ToLower(ext)] = true
+		}
+	}
+
+	// The last value read in the configuration file, so that a reload does
+	// not undo a change made through /admin unless the file changed too
+	fileReadOnly := opts.getBool("read_only", configDefaultReadOnly)
+	rawx.setReadOnly(fileReadOnly)
+
+	rawx.disabledMethods = make(map[string]bool)
+	for _, m := range strings.Split(opts["disabled_methods"], ",") {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m == "" {
+			continue
+		}
+		known := false
+		for _, m0 := range chunkToggledMethods {
+			known = known || m0 == m
+		}
+		if !known {
+			LogFatal("Invalid method in disabled_methods: %s", m)
+		}
+		rawx.disabledMethods[m] = true
+	}
+
+	rawx.readLimit.max = int32(opts.getInt("max_concurrent_reads", configDefaultMaxConcurrentReads))
+	rawx.writeLimit.max = int32(opts.getInt("max_concurrent_writes", configDefaultMaxConcurrentWrites))
+
+	if v, ok := opts["auth_secret_file"]; ok {
+		rawx.signer, err = newRequestSigner(v, opts.getBool("auth_reads", configDefaultAuthReads))
+		if err != nil {
+			LogFatal("Invalid secret: %v", err)
+		}
+	}
+
+	rawx.dataBufferPool = newBufferPool(uploadBufferTotalSizeDefault, rawx.bufferSize)
 
 	// Patch the checksum mode
 	if v, ok := opts["checksum"]; ok {
@@ -180,6 +323,19 @@ func main() {
 		}
 	}
 
+	if rawx.checksumAlgo == "" {
+		rawx.checksumAlgo = checksumAlgoDefault
+	}
+	if _, err := newChecksum(rawx.checksumAlgo); err != nil {
+		LogFatal("Invalid checksum algorithm: %s", rawx.checksumAlgo)
+	}
+	if v, ok := opts["checksum_secondary_algo"]; ok && v != "" {
+		if _, err := newChecksum(v); err != nil {
+			LogFatal("Invalid secondary checksum algorithm: %s", v)
+		}
+		rawx.checksumSecondaryAlgo = v
+	}
+
 	// Patch the fadvise() upon upload
 	if v, ok := opts["fadvise_upload"]; ok {
 		if strings.ToLower(v) == "cache" {
@@ -202,6 +358,45 @@ func main() {
 		}
 	}
 
+	// Volumes dedicated to storage policies, with the settings of the
+	// primary volume, e.g. "SSD=/mnt/ssd/rawx-1,EC=/mnt/hdd/rawx-1"
+	if v := opts["policy_volumes"]; v != "" {
+		chunkrepo.tiers = make(map[string]*fileRepository)
+		for _, item := range strings.Split(v, ",") {
+			tokens := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+				LogFatal("Invalid policy_volumes: %s", v)
+			}
+			tier, err := chunkrepo.sub.sibling(tokens[1])
+			if err != nil {
+				LogFatal("Invalid directory for the policy %s: %v", tokens[0], err)
+			}
+			chunkrepo.tiers[tokens[0]] = tier
+		}
+	}
+
+	if endpoint := opts["s3_endpoint"]; endpoint != "" {
+		secret, err := ioutil.ReadFile(opts["s3_secret_key_file"])
+		if err != nil {
+			LogFatal("Invalid S3 secret key: %v", err)
+		}
+		region := opts["s3_region"]
+		if region == "" {
+			region = configDefaultS3Region
+		}
+		chunkrepo.cold, err = newS3Repository(endpoint, opts["s3_bucket"], opts["s3_prefix"], region, opts["s3_access_key"],
+			strings.TrimSpace(string(secret)), opts.getInt("s3_part_size", configDefaultS3PartSize))
+		if err != nil {
+			LogFatal("Invalid S3 cold storage: %v", err)
+		}
+		chunkrepo.coldPolicies = make(map[string]bool)
+		for _, policy := range strings.Split(opts["s3_policies"], ",") {
+			if policy = strings.TrimSpace(policy); policy != "" {
+				chunkrepo.coldPolicies[policy] = true
+			}
+		}
+	}
+
 	eventAgent := OioGetEventAgent(namespace)
 	if eventAgent == "" {
 		LogFatal("Notifier error: no address")
@@ -216,6 +411,23 @@ func main() {
 	toReadRequest := opts.getInt("timeout_read_request", timeoutReadRequest)
 	toWrite := opts.getInt("timeout_write_reply", timeoutWrite)
 	toIdle := opts.getInt("timeout_idle", timeoutIdle)
+	rawx.timeoutReadRequest = time.Duration(toReadRequest) * time.Second
+	rawx.timeoutReadIdle = time.Duration(opts.getInt("timeout_read_idle", timeoutReadIdle)) * time.Second
+	rawx.timeoutWrite = time.Duration(toWrite) * time.Second
+	rawx.timeoutWriteIdle = time.Duration(opts.getInt("timeout_write_idle", timeoutWriteIdle)) * time.Second
+
+	rawx.headersMaxSize = opts.getInt("headers_buffer_size", headersMaxSizeDefault)
+	rawx.headersMaxCount = opts.getInt("headers_max_count", headersMaxCountDefault)
+
+	userMetaMaxSize = opts.getInt("user_metadata_max_size", configDefaultUserMetaMaxSize)
+	if v, ok := opts["user_metadata_prefix"]; ok {
+		// The prefix must not catch the headers of the chunk attributes
+		attrs, prefix := "x-oio-chunk-meta-", strings.ToLower(v)
+		if prefix == "" || strings.HasPrefix(attrs, prefix) || strings.HasPrefix(prefix, attrs) {
+			LogFatal("Invalid user_metadata_prefix: %s", v)
+		}
+		userMetaPrefix = v
+	}
 
 	/* need to be duplicated for HTTP and HTTPS */
 	srv := http.Server{
@@ -227,19 +439,18 @@ func main() {
 		WriteTimeout:      time.Duration(toWrite) * time.Second,
 		IdleTimeout:       time.Duration(toIdle) * time.Second,
 		// The default is at 1MiB but the RAWX never needs that
-		MaxHeaderBytes: opts.getInt("headers_buffer_size", 65536),
+		MaxHeaderBytes: rawx.headersMaxSize,
 	}
 
 	tlsSrv := http.Server{
 		Addr:              rawx.tlsUrl,
 		Handler:           &rawx,
-		TLSConfig:         nil,
 		ReadHeaderTimeout: time.Duration(toReadHeader) * time.Second,
 		ReadTimeout:       time.Duration(toReadRequest) * time.Second,
 		WriteTimeout:      time.Duration(toWrite) * time.Second,
 		IdleTimeout:       time.Duration(toIdle) * time.Second,
 		// The default is at 1MiB but the RAWX never needs that
-		MaxHeaderBytes: opts.getInt("headers_buffer_size", 65536),
+		MaxHeaderBytes: rawx.headersMaxSize,
 	}
 
 	flagNoDelay := opts.getBool("nodelay", configDefaultNoDelay)
@@ -272,12 +483,45 @@ func main() {
 		}
 	}
 
+	var certs *certReloader
+	if len(rawx.tlsUrl) > 0 {
+		tlsSrv.TLSConfig, certs, err = newTLSConfig(opts)
+		if err != nil {
+			LogFatal("TLS configuration error: %v", err)
+		}
+		rawx.clientAllowlist = parseAllowlist(opts["tls_client_allow"])
+		// A non-nil map prevents the server from enabling HTTP/2
+		if !opts.getBool("tls_http2", configDefaultHTTP2) {
+			tlsSrv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+	}
+
 	keepalive := opts.getBool("keepalive", configDefaultHttpKeepalive)
 	srv.SetKeepAlivesEnabled(keepalive)
 	tlsSrv.SetKeepAlivesEnabled(keepalive)
 
-	installSigHandlers(&srv)
-	installSigHandlers(&tlsSrv)
+	toGraceful := opts.getInt("timeout_graceful", timeoutGraceful)
+	reload := func() {
+		// Only the options that may change at runtime are applied
+		if newOpts, err := readConfig(cfg); err != nil {
+			LogError("Configuration reload error: %v", err)
+		} else {
+			readOnly := newOpts.getBool("read_only", configDefaultReadOnly)
+			if readOnly != fileReadOnly {
+				fileReadOnly = readOnly
+				rawx.setReadOnly(readOnly)
+				LogInfo("Read-only mode: %v", readOnly)
+			}
+		}
+		if certs != nil {
+			if err := certs.reload(); err != nil {
+				LogError("TLS certificate reload error: %v", err)
+			} else {
+				LogInfo("TLS certificate reloaded")
+			}
+		}
+	}
+	stopped := installSigHandlers(time.Duration(toGraceful)*time.Second, reload, &srv, &tlsSrv)
 
 	if !*servicingPtr {
 		id := rawx.id
@@ -289,6 +533,44 @@ func main() {
 		}
 	}
 
+	// Reclaim the space of the uploads interrupted by a crash, while the
+	// service already accepts new uploads. Only the files left long before the
+	// start of the process are removed, the ones of the new uploads are kept.
+	if maxAge := opts.getInt("pending_max_age", configDefaultPendingMaxAge); maxAge > 0 {
+		deadline := time.Now().Add(-time.Duration(maxAge) * time.Second)
+		go func() {
+			count, reclaimed, err := chunkrepo.sweepPending(deadline)
+			if err != nil {
+				LogWarning("Pending files sweep error: %v", err)
+			}
+			LogInfo("Pending files sweep: %d files removed, %d bytes reclaimed", count, reclaimed)
+		}()
+	}
+
+	if opts.getBool("scrub", configDefaultScrub) {
+		rate := opts.getInt("scrub_rate", configDefaultScrubRate)
+		interval := opts.getInt("scrub_interval", configDefaultScrubInterval)
+		if rate <= 0 || interval < 0 {
+			LogFatal("Invalid scrub_rate or scrub_interval")
+		}
+		rawx.scrubber = newScrubber(&rawx, rate,
+			opts.getInt64("scrub_rate_bytes", configDefaultScrubRateBytes),
+			opts.getInt("scrub_max_inflight", configDefaultScrubMaxInflight),
+			time.Duration(interval)*time.Second)
+		rawx.scrubber.start()
+	}
+
+	// Spare the first uploads the creation of their directory
+	if opts.getBool("precreate_dirs", configDefaultPrecreateDirs) {
+		go func() {
+			created, err := chunkrepo.precreateDirs(precreateDirsMax)
+			if err != nil {
+				LogWarning("Directories creation error: %v", err)
+			}
+			LogInfo("Directories creation: %d directories created", created)
+		}()
+	}
+
 	if logExtremeVerbosity {
 		srv.ConnState = func(cnx net.Conn, state http.ConnState) {
 			LogDebug("%v %v %v", cnx.LocalAddr(), cnx.RemoteAddr(), state)
@@ -299,9 +581,20 @@ func main() {
 	}
 
 	if err := Run(&srv, &tlsSrv, opts); err != nil {
-		LogWarning("HTTP Server exiting: %v", err)
+		if err == http.ErrServerClosed {
+			LogInfo("HTTP Server exiting: %v", err)
+			// Let the in-flight requests complete, or fail after the
+			// connections have been closed.
+			<-stopped
+			rawx.inflight.Wait()
+		} else {
+			LogError("HTTP Server exiting: %v", err)
+		}
 	}
 
+	if rawx.scrubber != nil {
+		rawx.scrubber.stop()
+	}
 	rawx.notifier.stop()
 	logger.close()
 }
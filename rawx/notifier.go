@@ -22,14 +22,22 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Tells if the current RAWX service may emit notifications
 var notifAllowed = configDefaultEvents
 
+// Number of events waiting for a backend, beyond which the events are dropped
+var notifQueueSize = notifierDefaultPipeSize
+
+// How long a backend waits before it retries to deliver an event
+var notifRetryDelay = notifierDefaultRetryDelay * time.Millisecond
+
 type notifier struct {
 	queue   chan []byte
+	done    chan struct{}
 	wg      sync.WaitGroup
 	running bool
 	url     string
@@ -37,7 +45,7 @@ type notifier struct {
 }
 
 type notifierBackend interface {
-	push([]byte)
+	push([]byte) error
 	close()
 }
 
@@ -49,20 +57,22 @@ type beanstalkdBackend struct {
 
 var (
 	errExiting      = errors.New("RAWX exiting")
-	errClogged      = errors.New("Beanstalkd clogged")
+	errClogged      = errors.New("Notifier clogged")
+	errNoBroker     = errors.New("No Kafka broker")
 	alertThrottling = PeriodicThrottle{period: 1000000000}
 )
 
 func deadLetter(event []byte, err error) {
+	atomic.AddUint64(&counters.NotifDropped, 1)
 	if err != nil && alertThrottling.Ok() {
-		LogError("Beanstalkd connection error: %v", err)
+		LogError("Notifier connection error: %v", err)
 	}
 	if len(event) > 0 {
 		LogWarning("event %s", string(event))
 	}
 }
 
-func (backend *beanstalkdBackend) push(event []byte) {
+func (backend *beanstalkdBackend) push(event []byte) error {
 	cnxDeadline := time.Now().Add(1 * time.Second)
 
 	// Lazy reconnection
@@ -70,8 +80,7 @@ func (backend *beanstalkdBackend) push(event []byte) {
 		b, err := DialBeanstalkd(backend.endpoint)
 		if err != nil {
 			if time.Now().After(cnxDeadline) {
-				deadLetter(event, err)
-				return
+				return err
 			} else {
 				time.Sleep(time.Second)
 			}
@@ -92,8 +101,8 @@ func (backend *beanstalkdBackend) push(event []byte) {
 	_, err := backend.b.Put(event)
 	if err != nil {
 		backend.close()
-		deadLetter(event, err)
 	}
+	return err
 }
 
 func (backend *beanstalkdBackend) close() {
@@ -110,15 +119,19 @@ func makeSingleBackend(config string) (notifierBackend, error) {
 		out.tube = beanstalkNotifierDefaultTube
 		return out, nil
 	}
+	if endpoint, ok := hasPrefix(config, "kafka://"); ok {
+		return makeKafkaBackend(endpoint)
+	}
 	// TODO(adu): make a ZMQ Notifier
 	// TODO(jfs): make a GRPC Notifier
 	// TODO(jfs): make an HTTP Notifier
-	return nil, errors.New("Unexpected notification endpoint, only `beanstalk://...` is accepted")
+	return nil, errors.New("Unexpected notification endpoint, only `beanstalk://...` and `kafka://...` are accepted")
 }
 
 func MakeNotifier(config string, rawx *rawxService) (*notifier, error) {
 	n := new(notifier)
-	n.queue = make(chan []byte, notifierDefaultPipeSize)
+	n.queue = make(chan []byte, notifQueueSize)
+	n.done = make(chan struct{})
 	n.running = true
 	n.url = rawx.url
 	n.srvid = rawx.id
@@ -149,9 +162,12 @@ func MakeNotifier(config string, rawx *rawxService) (*notifier, error) {
 	n.wg.Add(len(workers))
 	doWork := func(w notifierBackend, input <-chan []byte) {
 		defer n.wg.Done()
+		// The events still queued at the exit are flushed, unless the
+		// backend already failed.
+		healthy := true
 		for event := range input {
-			if n.running {
-				w.push(event)
+			if healthy || n.running {
+				healthy = n.deliver(w, event)
 			} else {
 				deadLetter(event, errExiting)
 			}
@@ -166,18 +182,46 @@ func MakeNotifier(config string, rawx *rawxService) (*notifier, error) {
 	return n, nil
 }
 
-func (n notifier) notifyNew(requestID string, chunk chunkInfo) {
+// Push the event to the backend, and retry until it succeeds while the
+// service is running. Tells if the event has been delivered.
+func (n *notifier) deliver(w notifierBackend, event []byte) bool {
+	for {
+		err := w.push(event)
+		if err == nil {
+			return true
+		}
+		if !n.running {
+			deadLetter(event, err)
+			return false
+		}
+		if alertThrottling.Ok() {
+			LogWarning("Notifier error, retrying: %v", err)
+		}
+		select {
+		case <-n.done:
+		case <-time.After(notifRetryDelay):
+		}
+	}
+}
+
+func (n *notifier) notifyNew(requestID string, chunk chunkInfo) {
 	if notifAllowed {
 		n.asyncNotify(eventTypeNewChunk, requestID, chunk)
 	}
 }
 
-func (n notifier) notifyDel(requestID string, chunk chunkInfo) {
+func (n *notifier) notifyDel(requestID string, chunk chunkInfo) {
 	if notifAllowed {
 		n.asyncNotify(eventTypeDelChunk, requestID, chunk)
 	}
 }
 
+func (n *notifier) notifyCorrupted(requestID string, chunk chunkInfo) {
+	if notifAllowed {
+		n.asyncNotify(eventTypeCorruptedChunk, requestID, chunk)
+	}
+}
+
 type EncodableEvent struct {
 	EventType string       `json:"event"`
 	When      int64        `json:"when"`
@@ -204,7 +248,7 @@ type EventPayload struct {
 	OioVersion     string `json:"oio_version"`
 }
 
-func (n notifier) asyncNotify(eventType, requestID string, chunk chunkInfo) {
+func (n *notifier) asyncNotify(eventType, requestID string, chunk chunkInfo) {
 	sb := bytes.Buffer{}
 	sb.Grow(2048)
 	evt := EncodableEvent{
@@ -247,8 +291,14 @@ func (n notifier) asyncNotify(eventType, requestID string, chunk chunkInfo) {
 	}
 }
 
+// Tell if the queue of events is full, i.e. the new events are dropped
+func (n *notifier) clogged() bool {
+	return len(n.queue) >= cap(n.queue)
+}
+
 func (n *notifier) stop() {
 	n.running = false
+	close(n.done)
 	close(n.queue)
 	n.wg.Wait()
 }
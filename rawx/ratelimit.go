@@ -0,0 +1,184 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Throttles the uploads of each client with token buckets, in requests per
+second and in bytes per second. The bytes of an upload are charged once it
+is done, because the size of a chunked upload is unknown beforehand: a client
+is denied while it is in debt.
+
+The identity sent by a client in a header is trusted only when the client is
+authenticated, with a signature or a certificate. The number of clients
+tracked is bounded, the clients beyond share the same buckets.
+*/
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Idle clients are forgotten after that delay
+const rateLimitIdleDelay = time.Minute
+
+// Maximum number of clients with their own buckets
+const rateLimitMaxClients = 65536
+
+// The clients beyond the maximum share the buckets of that pseudo-client
+const rateLimitOverflow = "*"
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Refill the bucket at the given rate, up to one second of traffic
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens = math.Min(rate, b.tokens+rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+}
+
+// How long before the bucket holds the given amount of tokens
+func (b *tokenBucket) delay(rate, needed float64) time.Duration {
+	return time.Duration((needed - b.tokens) / rate * float64(time.Second))
+}
+
+type clientBuckets struct {
+	requests tokenBucket
+	bytes    tokenBucket
+}
+
+type rateLimiter struct {
+	// Requests per second allowed to each client, 0 means no limit
+	requestRate float64
+	// Bytes per second allowed to each client, 0 means no limit
+	byteRate float64
+	// Header telling the identity of the client, instead of its address
+	header string
+
+	lock      sync.Mutex
+	clients   map[string]*clientBuckets
+	lastPurge time.Time
+}
+
+func newRateLimiter(requestRate, byteRate int64, header string) *rateLimiter {
+	return &rateLimiter{
+		requestRate: float64(requestRate),
+		byteRate:    float64(byteRate),
+		header:      header,
+		clients:     make(map[string]*clientBuckets),
+	}
+}
+
+func (l *rateLimiter) enabled() bool {
+	return l.requestRate > 0 || l.byteRate > 0
+}
+
+// Identify the client by its address, or by the header when it is
+// authenticated
+func (l *rateLimiter) identify(req *http.Request, authenticated bool) string {
+	if l.header != "" && authenticated {
+		if id := req.Header.Get(l.header); id != "" {
+			return id
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (l *rateLimiter) purge(now time.Time) {
+	for k, b := range l.clients {
+		if now.Sub(b.requests.last) > rateLimitIdleDelay && now.Sub(b.bytes.last) > rateLimitIdleDelay {
+			delete(l.clients, k)
+		}
+	}
+	l.lastPurge = now
+}
+
+func (l *rateLimiter) buckets(client string, now time.Time) *clientBuckets {
+	if now.Sub(l.lastPurge) > rateLimitIdleDelay {
+		l.purge(now)
+	}
+	b, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= rateLimitMaxClients {
+			l.purge(now)
+		}
+		if len(l.clients) >= rateLimitMaxClients {
+			client = rateLimitOverflow
+			if b, ok = l.clients[client]; ok {
+				return b
+			}
+		}
+		b = new(clientBuckets)
+		l.clients[client] = b
+	}
+	return b
+}
+
+// Tell if the client may start an upload, otherwise how long it should wait
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	if !l.enabled() {
+		return true, 0
+	}
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.buckets(client, now)
+	if l.byteRate > 0 {
+		b.bytes.refill(l.byteRate, now)
+		if b.bytes.tokens < 0 {
+			return false, b.bytes.delay(l.byteRate, 0)
+		}
+	}
+	if l.requestRate > 0 {
+		b.requests.refill(l.requestRate, now)
+		if b.requests.tokens < 1 {
+			return false, b.requests.delay(l.requestRate, 1)
+		}
+		b.requests.tokens--
+	}
+	return true, 0
+}
+
+// Charge the client for the bytes it uploaded
+func (l *rateLimiter) charge(client string, size int64) {
+	if l.byteRate <= 0 || size <= 0 {
+		return
+	}
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.buckets(client, now)
+	b.bytes.refill(l.byteRate, now)
+	b.bytes.tokens -= float64(size)
+}
+
+// Format a delay for the Retry-After header, in whole seconds
+func retryAfter(d time.Duration) string {
+	return itoa64(int64(math.Max(1, math.Ceil(d.Seconds()))))
+}
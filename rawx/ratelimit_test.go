@@ -0,0 +1,68 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The identity in the header is trusted only from the authenticated clients
+func TestRateLimitIdentify(t *testing.T) {
+	l := newRateLimiter(1, 0, "X-oio-client-id")
+	req := httptest.NewRequest("PUT", "/"+testChunkID, nil)
+	req.RemoteAddr = "10.0.0.1:6000"
+	req.Header.Set("X-oio-client-id", "proxy")
+	if id := l.identify(req, false); id != "10.0.0.1" {
+		t.Errorf("unauthenticated client identified as %s", id)
+	}
+	if id := l.identify(req, true); id != "proxy" {
+		t.Errorf("authenticated client identified as %s", id)
+	}
+}
+
+// The clients beyond the maximum share the same buckets
+func TestRateLimitMaxClients(t *testing.T) {
+	l := newRateLimiter(1, 0, "")
+	for i := 0; i < rateLimitMaxClients; i++ {
+		if ok, _ := l.allow(strconv.Itoa(i)); !ok {
+			t.Fatalf("client %d denied", i)
+		}
+	}
+	if ok, _ := l.allow("new1"); !ok {
+		t.Error("first client beyond the maximum denied")
+	}
+	if ok, _ := l.allow("new2"); ok {
+		t.Error("second client beyond the maximum allowed")
+	}
+	if len(l.clients) != rateLimitMaxClients+1 {
+		t.Errorf("unexpected number of clients: %d", len(l.clients))
+	}
+
+	// The idle clients make room for the new ones
+	l.lock.Lock()
+	for _, b := range l.clients {
+		b.requests.last = b.requests.last.Add(-2 * rateLimitIdleDelay)
+	}
+	l.lastPurge = time.Now()
+	l.lock.Unlock()
+	if ok, _ := l.allow("new2"); !ok {
+		t.Error("new client denied after the idle ones expired")
+	}
+}
@@ -17,10 +17,15 @@
 package main
 
 import (
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/textproto"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,13 +35,141 @@ type rawxService struct {
 	tlsUrl       string
 	path         string
 	id           string
-	repo         chunkRepository
+	repo         repository
 	notifier     *notifier
-	bufferSize   int
 	checksumMode int
+	checksumAlgo string
 	compression  string
+	// Size (in bytes) under which the chunks are not compressed
+	compressionMinSize int64
+	// Level of the zlib compression, from 1 (fastest) to 9 (smallest)
+	zlibLevel int
+	// Extensions (lowercase, without the dot) of the contents never compressed
+	incompressibleExt map[string]bool
 
-	uploadBufferPool bufferPool
+	// Algorithm of the checksum always computed by the rawx, empty for none
+	checksumSecondaryAlgo string
+
+	// Should the checksum of the chunks be verified when they are downloaded
+	verifyRead bool
+
+	// Compress on the fly the downloads of the uncompressed chunks of a
+	// textual type, at least gzipMinSize bytes long, for the clients
+	// accepting gzip
+	gzipDownload bool
+	gzipMinSize  int64
+
+	// Maximum size of an uploaded chunk, 0 means no limit
+	chunkSizeMax int64
+
+	// Deny the uploads when the volume is almost full
+	freeSpace *freeSpaceChecker
+
+	// Methods refused on the chunks, replied with a "405 Method Not Allowed"
+	disabledMethods map[string]bool
+	// Non-zero when the mutations are refused, may change at runtime
+	readOnly int32
+	// Serializes the updates of the settings at runtime
+	adminLock sync.Mutex
+
+	// Verifies the chunks in the background, nil when disabled
+	scrubber *scrubber
+
+	// Value of the Access-Control-Allow-Origin header in the replies to the
+	// OPTIONS requests, CORS headers are not sent when empty
+	corsAllowOrigin string
+
+	// Size of the buffers used to transfer the data of the chunks, on both
+	// uploads and downloads. Each transfer in flight holds at least one such
+	// buffer, so that the memory consumed grows with the number of active
+	// connections: plan bufferSize bytes per connection.
+	bufferSize     int
+	dataBufferPool bufferPool
+
+	// The requests currently served
+	inflight sync.WaitGroup
+
+	// Caps on the chunk operations served at once, reading or writing
+	readLimit  concurrencyLimit
+	writeLimit concurrencyLimit
+
+	// Serialize the deletions and the replacements of a same chunk, with
+	// the check of their "If-Match" precondition
+	chunkLocks chunkLocks
+
+	// Throttles the uploads of each client
+	uploadLimiter *rateLimiter
+	// The uploads with an idempotency key, nil when disabled
+	idempotency *idempotencyCache
+
+	// Names (CN or SAN) of the TLS clients allowed to access the chunks.
+	// Empty means that any client with a valid certificate is allowed.
+	clientAllowlist map[string]bool
+
+	// Checks the signature of the requests, nil if no secret is configured
+	signer *requestSigner
+
+	// Longest silence of a client sending a chunk, 0 means no limit
+	timeoutReadIdle time.Duration
+	// Time granted to a client to send its whole request, 0 means no limit
+	timeoutReadRequest time.Duration
+	// Longest stall of a client reading a chunk, 0 means no limit
+	timeoutWriteIdle time.Duration
+	// Time granted to send a whole reply, 0 means no limit
+	timeoutWrite time.Duration
+
+	// Limits on the header of the requests, 0 means no limit
+	headersMaxSize  int
+	headersMaxCount int
+}
+
+// The methods served on the chunks, as announced in the "Allow" header
+func (rawx *rawxService) chunkMethods() string {
+	if len(rawx.disabledMethods) <= 0 {
+		return chunkAllowedMethods
+	}
+	methods := make([]string, 0, len(chunkToggledMethods)+1)
+	for _, m := range chunkToggledMethods {
+		if !rawx.disabledMethods[m] {
+			methods = append(methods, m)
+		}
+	}
+	methods = append(methods, "OPTIONS")
+	return strings.Join(methods, ", ")
+}
+
+func (rawx *rawxService) isReadOnly() bool {
+	return atomic.LoadInt32(&rawx.readOnly) != 0
+}
+
+func (rawx *rawxService) setReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&rawx.readOnly, v)
+}
+
+// Tell if a method on the chunks alters them
+func isMutation(method string) bool {
+	switch method {
+	case "PUT", "COPY", "PATCH", "DELETE":
+		return true
+	default:
+		return false
+	}
+}
+
+// Tell which limit applies to a request on a chunk, if any
+func (rawx *rawxService) concurrencyLimit(method string) *concurrencyLimit {
+	switch method {
+	case "GET", "HEAD", "VERIFY":
+		return &rawx.readLimit
+	case "PUT", "COPY", "PATCH", "DELETE":
+		return &rawx.writeLimit
+	default:
+		return nil
+	}
 }
 
 type rawxRequest struct {
@@ -53,6 +186,21 @@ type rawxRequest struct {
 	status   int
 	bytesIn  uint64
 	bytesOut uint64
+	// Bytes of the chunk written on disk, after compression
+	bytesStored uint64
+	// The error replied, for the access log
+	err error
+	// The reply must be interrupted once the request is accounted for
+	abort bool
+}
+
+// The repository of the chunks, the requests of which to a remote storage
+// are canceled with the request of the client
+func (rr *rawxRequest) repo() repository {
+	if cr, ok := rr.rawx.repo.(*chunkRepository); ok {
+		return cr.withContext(rr.req.Context())
+	}
+	return rr.rawx.repo
 }
 
 func (rr *rawxRequest) drain() error {
@@ -64,19 +212,122 @@ func (rr *rawxRequest) drain() error {
 	}
 }
 
+// Get rid of the body of a request that failed before its body was read.
+// A client waiting for a "100 Continue" won't send the body after a final
+// status: the connection is closed instead of being drained.
+func (rr *rawxRequest) discardBody() {
+	if strings.EqualFold(rr.req.Header.Get("Expect"), "100-continue") {
+		rr.req.Close = true
+	} else {
+		io.Copy(ioutil.Discard, rr.req.Body)
+	}
+}
+
 func (rr *rawxRequest) replyCode(code int) {
 	rr.status = code
 	rr.rep.WriteHeader(rr.status)
 }
 
-func (rr *rawxRequest) replyError(action string, err error) {
+// Reply a "405 Method Not Allowed" telling the client the methods actually
+// served on the resource.
+func (rr *rawxRequest) replyNotAllowed(allowed string) {
+	rr.rep.Header().Set("Allow", allowed)
+	rr.replyErrorCode(http.StatusMethodNotAllowed, errMethodNotAllowed)
+}
+
+// Map the errors raised by the handlers to the status of the reply.
+// This is the single place where the mapping must be managed.
+func errorToStatus(err error) int {
+	// A permission denied on the volume is a problem of the service, not
+	// of the client: it is left to the default case.
 	if os.IsExist(err) {
-		rr.replyCode(http.StatusConflict)
-	} else if os.IsPermission(err) {
-		rr.replyCode(http.StatusForbidden)
+		return http.StatusConflict
 	} else if os.IsNotExist(err) {
-		rr.replyCode(http.StatusNotFound)
+		return http.StatusNotFound
+	} else if _, ok := err.(*s3Error); ok {
+		// The cold storage failed, not the service
+		return http.StatusServiceUnavailable
+	}
+	switch err {
+	case errChunkExists:
+		return http.StatusConflict
+	case errPreconditionFailed:
+		return http.StatusPreconditionFailed
+	case os.ErrInvalid, errInvalidChunkID, errMissingHeader, errInvalidHeader, errInvalidBody, errContentLength,
+		errListMarker, errListPrefix:
+		return http.StatusBadRequest
+	case errNoSpace:
+		return http.StatusInsufficientStorage
+	case errOverloaded:
+		return http.StatusServiceUnavailable
+	case errTooManyRequests:
+		return http.StatusTooManyRequests
+	case errForbidden, errReadOnly:
+		return http.StatusForbidden
+	case errReadTimeout:
+		return http.StatusRequestTimeout
+	case errChunkTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errHeadersTooLarge:
+		return http.StatusRequestHeaderFieldsTooLarge
+	case errInvalidRange, errRangeNotSatisfiable:
+		return http.StatusRequestedRangeNotSatisfiable
+	case errClientGone:
+		return statusClientClosed
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type errorBody struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	ChunkID   string `json:"chunk_id,omitempty"`
+	RequestID string `json:"request_id"`
+}
+
+// Tell if the client announced it accepts a JSON reply
+func acceptsJSON(req *http.Request) bool {
+	for _, v := range req.Header[textproto.CanonicalMIMEHeaderKey("Accept")] {
+		for _, t := range strings.Split(v, ",") {
+			if i := strings.IndexByte(t, ';'); i >= 0 {
+				t = t[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(t), "application/json") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reply the status of the error, with a JSON body detailing it for the clients
+// asking for one. The details of the internal errors are only logged, they
+// could tell too much about the host. A "304 Not Modified" never has a body.
+func (rr *rawxRequest) replyErrorCode(code int, err error) {
+	if rr.status != 0 || rr.req.Method == "HEAD" || code == http.StatusNotModified || !acceptsJSON(rr.req) {
+		rr.replyCode(code)
+		return
+	}
+	body := errorBody{Code: code, ChunkID: rr.chunkID, RequestID: rr.reqid}
+	if code == http.StatusInternalServerError {
+		body.Message = http.StatusText(code)
 	} else {
+		body.Message = err.Error()
+	}
+	rr.rep.Header().Set("Content-Type", "application/json")
+	rr.replyCode(code)
+	json.NewEncoder(rr.rep).Encode(body)
+}
+
+func (rr *rawxRequest) replyError(action string, err error) {
+	rr.err = err
+	code := errorToStatus(err)
+	switch code {
+	case http.StatusConflict, http.StatusPreconditionFailed, http.StatusNotFound, statusClientClosed:
+		// The request was understood, the connection may be reused
+		rr.replyErrorCode(code, err)
+	default:
 		// A strong error occured, we tend to close the connection
 		// whatever the client has sent in the request, in terms of
 		// connection management.
@@ -92,23 +343,44 @@ func (rr *rawxRequest) replyError(action string, err error) {
 			rr.rep.Header().Set(HeaderNameError, err.Error())
 		}
 
-		// Prepare the most adapted reply status.
-		if err == os.ErrInvalid {
-			rr.replyCode(http.StatusBadRequest)
-		} else {
-			switch err {
-			case errInvalidChunkID, errMissingHeader, errInvalidHeader:
-				rr.replyCode(http.StatusBadRequest)
-			case errInvalidRange:
-				rr.replyCode(http.StatusRequestedRangeNotSatisfiable)
-			default:
-				rr.replyCode(http.StatusInternalServerError)
-			}
+		rr.replyErrorCode(code, err)
+	}
+}
+
+// The HTTP server already caps the size of the header, though loosely (it
+// grants some more bytes) and not for HTTP/2. The limits are enforced here,
+// before any body is read.
+func (rawx *rawxService) checkHeaders(h http.Header) error {
+	count, size := 0, 0
+	for k, values := range h {
+		for _, v := range values {
+			count++
+			// As sent by an HTTP/1.1 client, "Name: value\r\n"
+			size += len(k) + len(v) + 4
 		}
 	}
+	if rawx.headersMaxCount > 0 && count > rawx.headersMaxCount {
+		return errHeadersTooLarge
+	}
+	if rawx.headersMaxSize > 0 && size > rawx.headersMaxSize {
+		return errHeadersTooLarge
+	}
+	return nil
+}
+
+// With an allowlist, the requests received on the plain HTTP listener are
+// refused, their client cannot be authenticated.
+func (rawx *rawxService) clientAllowed(req *http.Request) bool {
+	if len(rawx.clientAllowlist) <= 0 {
+		return true
+	}
+	return req.TLS != nil && peerAllowed(req.TLS, rawx.clientAllowlist)
 }
 
 func (rawx *rawxService) ServeHTTP(rep http.ResponseWriter, req *http.Request) {
+	rawx.inflight.Add(1)
+	defer rawx.inflight.Done()
+
 	rawxreq := rawxRequest{
 		rawx:      rawx,
 		req:       req,
@@ -126,14 +398,17 @@ func (rawx *rawxService) ServeHTTP(rep http.ResponseWriter, req *http.Request) {
 		if len(rawxreq.reqid) > HeaderLenOioReqId {
 			rawxreq.reqid = rawxreq.reqid[0:HeaderLenOioReqId]
 		}
-		rep.Header().Set(HeaderNameOioReqId, rawxreq.reqid)
 	} else {
-		// patch the reqid for pretty access log
-		rawxreq.reqid = "-"
+		// Generate one, so that the logs and the events of the request
+		// can be tied together
+		rawxreq.reqid = newRequestID()
 	}
+	rep.Header().Set(HeaderNameOioReqId, rawxreq.reqid)
 
 	if len(req.Host) > 0 && (req.Host != rawx.id && req.Host != rawx.url && req.Host != rawx.tlsUrl) {
-		rawxreq.replyCode(http.StatusTeapot)
+		rawxreq.replyErrorCode(http.StatusTeapot, errUnexpectedHost)
+	} else if err := rawx.checkHeaders(req.Header); err != nil {
+		rawxreq.replyError("", err)
 	} else {
 		for _dslash(req.URL.Path) {
 			req.URL.Path = req.URL.Path[1:]
@@ -143,6 +418,18 @@ func (rawx *rawxService) ServeHTTP(rep http.ResponseWriter, req *http.Request) {
 			rawxreq.serveInfo()
 		case "/stat":
 			rawxreq.serveStat()
+		case "/metrics":
+			rawxreq.serveMetrics()
+		case "/health":
+			rawxreq.serveHealth(false)
+		case "/ready":
+			rawxreq.serveHealth(true)
+		case "/delete":
+			rawxreq.serveBulkDelete()
+		case "/list":
+			rawxreq.serveList()
+		case "/admin":
+			rawxreq.serveAdmin()
 		default:
 			rawxreq.serveChunk()
 		}
@@ -0,0 +1,156 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestErrorToStatus(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{errInvalidChunkID, http.StatusBadRequest},
+		{errMissingHeader, http.StatusBadRequest},
+		{errInvalidHeader, http.StatusBadRequest},
+		{errInvalidBody, http.StatusBadRequest},
+		{errContentLength, http.StatusBadRequest},
+		{errListMarker, http.StatusBadRequest},
+		{errListPrefix, http.StatusBadRequest},
+		{os.ErrInvalid, http.StatusBadRequest},
+		{errInvalidRange, http.StatusRequestedRangeNotSatisfiable},
+		{errRangeNotSatisfiable, http.StatusRequestedRangeNotSatisfiable},
+		{errChunkExists, http.StatusConflict},
+		{os.ErrExist, http.StatusConflict},
+		{syscall.EEXIST, http.StatusConflict},
+		{errPreconditionFailed, http.StatusPreconditionFailed},
+		{os.ErrNotExist, http.StatusNotFound},
+		{syscall.ENOENT, http.StatusNotFound},
+		// A permission denied on the volume, not a client error
+		{os.ErrPermission, http.StatusInternalServerError},
+		{syscall.EACCES, http.StatusInternalServerError},
+		{syscall.EIO, http.StatusInternalServerError},
+		{errChunkTooLarge, http.StatusRequestEntityTooLarge},
+		{errHeadersTooLarge, http.StatusRequestHeaderFieldsTooLarge},
+		{errReadOnly, http.StatusForbidden},
+		{errNoSpace, http.StatusInsufficientStorage},
+		{errOverloaded, http.StatusServiceUnavailable},
+		{errTooManyRequests, http.StatusTooManyRequests},
+		{errForbidden, http.StatusForbidden},
+		{errReadTimeout, http.StatusRequestTimeout},
+		{errClientGone, statusClientClosed},
+		{errCompressionNotManaged, http.StatusInternalServerError},
+		{errChecksumMismatch, http.StatusInternalServerError},
+		{errors.New("unexpected"), http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		if status := errorToStatus(tc.err); status != tc.status {
+			t.Errorf("%v: expected %d, got %d", tc.err, tc.status, status)
+		}
+	}
+}
+
+func TestCheckHeaders(t *testing.T) {
+	rawx := &rawxService{headersMaxSize: 64, headersMaxCount: 3}
+	h := http.Header{}
+	h.Set("A", "1")
+	h.Add("B", "1")
+	h.Add("B", "2")
+	if err := rawx.checkHeaders(h); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	h.Add("B", "3")
+	if err := rawx.checkHeaders(h); err != errHeadersTooLarge {
+		t.Errorf("too many fields accepted: %v", err)
+	}
+	h = http.Header{}
+	h.Set("A", strings.Repeat("x", 64))
+	if err := rawx.checkHeaders(h); err != errHeadersTooLarge {
+		t.Errorf("too large header accepted: %v", err)
+	}
+	if err := (&rawxService{}).checkHeaders(h); err != nil {
+		t.Errorf("unexpected error without limit: %v", err)
+	}
+}
+
+func TestReplyErrorJSON(t *testing.T) {
+	InitNoopLogger()
+	reply := func(accept string, err error) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/"+testChunkID, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		rr := &rawxRequest{req: req, rep: rec, chunkID: testChunkID, reqid: "req"}
+		rr.replyError("", err)
+		return rec
+	}
+
+	rec := reply("text/plain, application/json;q=0.9", errNoSpace)
+	var body errorBody
+	if rec.Code != http.StatusInsufficientStorage || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected reply: %d %v", rec.Code, rec.Header())
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	expected := errorBody{Code: http.StatusInsufficientStorage, Message: errNoSpace.Error(),
+		ChunkID: testChunkID, RequestID: "req"}
+	if body != expected {
+		t.Errorf("unexpected body: %+v", body)
+	}
+
+	// The internal errors are not detailed
+	rec = reply("application/json", syscall.EIO)
+	body = errorBody{}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body.Code != http.StatusInternalServerError || body.Message != "Internal Server Error" {
+		t.Errorf("unexpected body: %+v", body)
+	}
+
+	if rec = reply("", errNoSpace); rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+		t.Errorf("unexpected body without JSON accepted: %q", rec.Body.String())
+	}
+
+	// The replies outside the errors are detailed as well, but the ones
+	// that cannot have a body
+	req := httptest.NewRequest("PATCH", "/"+testChunkID, nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	rr := &rawxRequest{req: req, rep: rec, chunkID: testChunkID, reqid: "req"}
+	rr.replyNotAllowed("GET, HEAD")
+	body = errorBody{}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if rec.Code != http.StatusMethodNotAllowed || body.Code != http.StatusMethodNotAllowed ||
+		body.Message != errMethodNotAllowed.Error() || rec.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("unexpected reply: %d %+v", rec.Code, body)
+	}
+	rec = httptest.NewRecorder()
+	rr = &rawxRequest{req: req, rep: rec, chunkID: testChunkID, reqid: "req"}
+	rr.replyErrorCode(http.StatusNotModified, errNotModified)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("unexpected reply: %d %q", rec.Code, rec.Body.String())
+	}
+}
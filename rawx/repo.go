@@ -19,8 +19,48 @@ package main
 import (
 	"io"
 	"os"
+	"time"
 )
 
+// The storage of the chunks, as seen by the request handlers. The data of
+// the chunks is exposed as files, so that it may be sent with sendfile().
+type repository interface {
+	get(name string) (fileReader, error)
+	put(name string) (fileWriter, error)
+	// Like put, but on the volume dedicated to the storage policy, if any
+	putPolicy(policy, name string) (fileWriter, error)
+	// Like put, but the existing chunk is replaced upon the commit
+	replace(name string) (fileWriter, error)
+	// Like replace, but the new chunk goes to the volume dedicated to the
+	// storage policy, if any
+	replacePolicy(policy, name string) (fileWriter, error)
+	link(fromName, toName string) (linkOperation, error)
+	del(name string) error
+	// List the chunks, tell if the listing is truncated
+	list(prefix, marker string, max int) ([]listedChunk, bool, error)
+
+	getAttr(name, key string, value []byte) (int, error)
+	setAttr(name, key string, value []byte) error
+
+	// Return the total size and the space available (in bytes)
+	statfs() (uint64, uint64, error)
+	// Name the volume of the chunks of the storage policy
+	volumeOf(policy string) string
+	// Like statfs, but on the volume of the chunks of the storage policy
+	statfsPolicy(policy string) (uint64, uint64, error)
+	writable() error
+	lock(ns, id string) error
+	// Tell if the files and their directory are synced upon a commit
+	durability() (syncFile, syncDir bool)
+}
+
+// A chunk as found by a listing, without opening it
+type listedChunk struct {
+	id string
+	// Size of the file, thus after compression
+	size int64
+}
+
 type decorable interface {
 	setAttr(n string, v []byte) error
 }
@@ -28,12 +68,25 @@ type decorable interface {
 type fileReader interface {
 	io.ReadCloser
 
-	// Return the underlying os.File
+	// Return the underlying os.File, nil when the data is not in a local file
 	File() *os.File
 
 	size() int64
+	// Return the time of the last modification, the zero time if unknown
+	mtime() time.Time
 	seek(int64) error
 	getAttr(key string, value []byte) (int, error)
+	// Return the metadata of the user, nil if there is none
+	userMeta() (map[string]string, error)
+}
+
+// The data of the chunk, as a file whenever possible so that it may be sent
+// with sendfile()
+func chunkData(in fileReader) io.Reader {
+	if f := in.File(); f != nil {
+		return f
+	}
+	return in
 }
 
 type fileWriter interface {
@@ -42,6 +95,11 @@ type fileWriter interface {
 	// Prepare a placeholder for the file, if the underlying implementation allows it.
 	Extend(size int64)
 
+	// Reserve the space for a file of the given size, whatever the settings.
+	// errNoSpace is returned when the volume cannot hold it, nothing when the
+	// underlying implementation cannot reserve space.
+	preallocate(size int64) error
+
 	Write([]byte) (int, error)
 
 	commit() error
@@ -0,0 +1,774 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Stores the chunks in a bucket of an S3-compatible object storage, e.g. the
+cold chunks of a tiered deployment. Each chunk is an object named after its
+ID, under an optional prefix, and its XATTR are the metadata of the object:
+the name of an XATTR is escaped into a lowercase header name, its value is
+URL-encoded. The requests are signed with the AWS Signature Version 4, the
+bucket is addressed in the path of the URLs.
+
+An upload is buffered up to the size of a part. A small chunk is sent with a
+single PUT upon its commit. A larger one is sent as a multipart upload to a
+pending object, copied in place with its metadata upon the commit. The
+downloads are ranged GET requests, the links are server-side copies.
+
+The pending objects left by a crash are not swept by the rawx, a lifecycle
+rule of the bucket should expire them.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Prefix of the headers carrying the metadata of the objects
+	s3MetaPrefix = "x-amz-meta-"
+
+	// The parts of a multipart upload, but the last one, cannot be smaller
+	s3PartSizeMin = 5 * 1024 * 1024
+
+	// Longest wait for a connection to the object storage, then for the
+	// headers of its reply, so that an unreachable bucket fails the
+	// requests instead of holding them
+	s3DialTimeout    = 5 * time.Second
+	s3RequestTimeout = 30 * time.Second
+)
+
+var errS3Config = errors.New("Invalid S3 configuration")
+
+// An error replied by the object storage
+type s3Error struct {
+	status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("S3 error %d %s: %s", e.status, e.Code, e.Message)
+}
+
+type s3Repository struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	// Size of the parts of the multipart uploads, thus of the upload buffers
+	partSize int
+	client   *http.Client
+	// The requests are canceled with the request of the client, if any
+	ctx context.Context
+}
+
+var _ repository = (*s3Repository)(nil)
+
+func newS3Repository(endpoint, bucket, prefix, region, accessKey, secretKey string, partSize int) (*s3Repository, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errS3Config
+	}
+	if bucket == "" || region == "" || accessKey == "" || secretKey == "" || partSize < s3PartSizeMin {
+		return nil, errS3Config
+	}
+	return &s3Repository{
+		endpoint:  u,
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		partSize:  partSize,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: s3DialTimeout}).DialContext,
+			TLSHandshakeTimeout:   s3DialTimeout,
+			ResponseHeaderTimeout: s3RequestTimeout,
+			ExpectContinueTimeout: time.Second,
+			MaxIdleConnsPerHost:   64,
+			IdleConnTimeout:       90 * time.Second,
+		}},
+		ctx: context.Background(),
+	}, nil
+}
+
+// The same storage, the requests of which are canceled with the context
+func (s *s3Repository) withContext(ctx context.Context) *s3Repository {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+// Escape as required by the signature: all but the unreserved characters
+func awsEscape(s string, slash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !slash) {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// The name of the header carrying an XATTR. The object storage lowercases the
+// names of the metadata, the uppercase letters are escaped as any character
+// that is not valid in a header name.
+func s3MetaName(key string) string {
+	var sb strings.Builder
+	sb.WriteString(s3MetaPrefix)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "_%02x", c)
+		}
+	}
+	return sb.String()
+}
+
+// The name of the XATTR carried by a header, false if it carries none
+func s3AttrName(header string) (string, bool) {
+	header = strings.ToLower(header)
+	if !strings.HasPrefix(header, s3MetaPrefix) {
+		return "", false
+	}
+	var sb strings.Builder
+	name := header[len(s3MetaPrefix):]
+	for i := 0; i < len(name); i++ {
+		if name[i] != '_' {
+			sb.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", false
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		sb.WriteByte(byte(c))
+		i += 2
+	}
+	return sb.String(), true
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Build a request on the object with the given name, on the bucket itself
+// when the name is empty
+func (s *s3Repository) newRequest(method, name string, query url.Values, body []byte) *http.Request {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	if name != "" {
+		u.Path += "/" + s.prefix + name
+	}
+	u.RawPath = awsEscape(u.Path, false)
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, awsEscape(k, true)+"="+awsEscape(query.Get(k), true))
+	}
+	u.RawQuery = strings.Join(params, "&")
+
+	req, _ := http.NewRequestWithContext(s.ctx, method, u.String(), bytes.NewReader(body))
+	return req
+}
+
+// Sign the request once all its headers are set
+func (s *s3Repository) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	digest := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(digest[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" || k == "if-match" || k == "if-none-match" {
+			names = append(names, k)
+			values[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, k := range names {
+		headers.WriteString(k + ":" + values[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		headers.String(), signedHeaders, payloadHash}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	digest = sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+// Sign and send the request. A reply with an error status is consumed and
+// turned into an error: os.ErrNotExist for a missing object, os.ErrExist for
+// an object that must not exist.
+func (s *s3Repository) do(req *http.Request, body []byte) (*http.Response, error) {
+	s.sign(req, body, time.Now())
+	rep, err := s.client.Do(req)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return nil, errClientGone
+		}
+		return nil, &s3Error{Code: "RequestError", Message: err.Error()}
+	}
+	if rep.StatusCode/100 == 2 {
+		return rep, nil
+	}
+	defer rep.Body.Close()
+	switch rep.StatusCode {
+	case http.StatusNotFound:
+		io.Copy(ioutil.Discard, rep.Body)
+		return nil, os.ErrNotExist
+	case http.StatusPreconditionFailed:
+		io.Copy(ioutil.Discard, rep.Body)
+		return nil, os.ErrExist
+	default:
+		e := &s3Error{status: rep.StatusCode}
+		xml.NewDecoder(io.LimitReader(rep.Body, 64*1024)).Decode(e)
+		return nil, e
+	}
+}
+
+// Send the request and decode the XML body of its reply. A reply with a
+// success status may still carry an error (e.g. a failed copy).
+func (s *s3Repository) doXML(req *http.Request, body []byte, result interface{}) error {
+	rep, err := s.do(req, body)
+	if err != nil {
+		return err
+	}
+	defer rep.Body.Close()
+	raw, err := ioutil.ReadAll(rep.Body)
+	if err != nil {
+		return err
+	}
+	e := &s3Error{status: rep.StatusCode}
+	if xml.Unmarshal(raw, e) == nil && e.Code != "" {
+		return e
+	}
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(raw, result)
+}
+
+func (s *s3Repository) setMeta(req *http.Request, attrs map[string]string) {
+	for k, v := range attrs {
+		req.Header.Set(s3MetaName(k), url.PathEscape(v))
+	}
+}
+
+// An object as described by a HEAD request
+type s3Object struct {
+	size  int64
+	mtime time.Time
+	etag  string
+	attrs map[string]string
+}
+
+func (s *s3Repository) head(name string) (s3Object, error) {
+	var obj s3Object
+	rep, err := s.do(s.newRequest("HEAD", name, nil, nil), nil)
+	if err != nil {
+		return obj, err
+	}
+	rep.Body.Close()
+	obj.size = rep.ContentLength
+	obj.mtime, _ = http.ParseTime(rep.Header.Get("Last-Modified"))
+	obj.etag = rep.Header.Get("ETag")
+	obj.attrs = make(map[string]string)
+	for k, v := range rep.Header {
+		if attr, ok := s3AttrName(k); ok && len(v) > 0 {
+			if value, err := url.PathUnescape(v[0]); err == nil {
+				obj.attrs[attr] = value
+			}
+		}
+	}
+	return obj, nil
+}
+
+// Copy an object with the given metadata, in place when the names are equal
+func (s *s3Repository) copy(fromName, toName string, attrs map[string]string) error {
+	req := s.newRequest("PUT", toName, nil, nil)
+	req.Header.Set("X-Amz-Copy-Source", awsEscape("/"+s.bucket+"/"+s.prefix+fromName, false))
+	req.Header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	s.setMeta(req, attrs)
+	return s.doXML(req, nil, nil)
+}
+
+// Get the value of an XATTR as getxattr() would
+func getS3Attr(attrs map[string]string, key string, value []byte) (int, error) {
+	v, ok := attrs[key]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(value) < len(v) {
+		return 0, syscall.ERANGE
+	}
+	return copy(value, v), nil
+}
+
+func (s *s3Repository) getAttr(name, key string, value []byte) (int, error) {
+	obj, err := s.head(name)
+	if err != nil {
+		return 0, err
+	}
+	return getS3Attr(obj.attrs, key, value)
+}
+
+// The metadata of an object cannot be changed, the object is copied in place
+func (s *s3Repository) setAttr(name, key string, value []byte) error {
+	obj, err := s.head(name)
+	if err != nil {
+		return err
+	}
+	obj.attrs[key] = string(value)
+	return s.copy(name, name, obj.attrs)
+}
+
+// The space of a bucket is unknown
+func (s *s3Repository) statfs() (uint64, uint64, error) {
+	return 0, 0, nil
+}
+
+func (s *s3Repository) volumeOf(policy string) string {
+	return s.endpoint.String() + "/" + s.bucket
+}
+
+func (s *s3Repository) statfsPolicy(policy string) (uint64, uint64, error) {
+	return s.statfs()
+}
+
+func (s *s3Repository) writable() error {
+	rep, err := s.do(s.newRequest("HEAD", "", nil, nil), nil)
+	if err == nil {
+		rep.Body.Close()
+	}
+	return err
+}
+
+// The bucket may be shared among several services
+func (s *s3Repository) lock(ns, id string) error {
+	return nil
+}
+
+// The object storage replies once the data is durable
+func (s *s3Repository) durability() (bool, bool) {
+	return true, true
+}
+
+func (s *s3Repository) del(name string) error {
+	// A DELETE succeeds whether the object exists or not
+	if _, err := s.head(name); err != nil {
+		return err
+	}
+	rep, err := s.do(s.newRequest("DELETE", name, nil, nil), nil)
+	if err == nil {
+		rep.Body.Close()
+	}
+	return err
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated bool `xml:"IsTruncated"`
+}
+
+// List the chunks as the volumes do. The pending objects and the objects
+// that are not chunks are skipped.
+func (s *s3Repository) list(prefix, marker string, max int) ([]listedChunk, bool, error) {
+	chunks := make([]listedChunk, 0)
+	after := ""
+	if marker != "" {
+		after = s.prefix + marker
+	}
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.prefix+prefix)
+		query.Set("max-keys", strconv.Itoa(max-len(chunks)))
+		if after != "" {
+			query.Set("start-after", after)
+		}
+		var result s3ListResult
+		if err := s.doXML(s.newRequest("GET", "", query, nil), nil, &result); err != nil {
+			return nil, false, err
+		}
+		for _, c := range result.Contents {
+			after = c.Key
+			id := strings.TrimPrefix(c.Key, s.prefix)
+			if isValidChunkID(id) {
+				chunks = append(chunks, listedChunk{id: id, size: c.Size})
+			}
+		}
+		if !result.IsTruncated || len(result.Contents) <= 0 {
+			return chunks, false, nil
+		}
+		if len(chunks) >= max {
+			return chunks, true, nil
+		}
+	}
+}
+
+func (s *s3Repository) get(name string) (fileReader, error) {
+	obj, err := s.head(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{repo: s, name: name, obj: obj}, nil
+}
+
+func (s *s3Repository) put(name string) (fileWriter, error) {
+	if _, err := s.head(name); err == nil {
+		return nil, os.ErrExist
+	} else if err != os.ErrNotExist {
+		return nil, err
+	}
+	return &s3Writer{repo: s, name: name, attrs: make(map[string]string)}, nil
+}
+
+func (s *s3Repository) putPolicy(policy, name string) (fileWriter, error) {
+	return s.put(name)
+}
+
+func (s *s3Repository) replace(name string) (fileWriter, error) {
+	return &s3Writer{repo: s, name: name, overwrite: true, attrs: make(map[string]string)}, nil
+}
+
+func (s *s3Repository) replacePolicy(policy, name string) (fileWriter, error) {
+	return s.replace(name)
+}
+
+// The copy is done at once, server-side, with the metadata of the source
+func (s *s3Repository) link(fromName, toName string) (linkOperation, error) {
+	obj, err := s.head(fromName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.head(toName); err == nil {
+		return nil, os.ErrExist
+	} else if err != os.ErrNotExist {
+		return nil, err
+	}
+	if err = s.copy(fromName, toName, obj.attrs); err != nil {
+		return nil, err
+	}
+	return &s3Link{repo: s, name: toName}, nil
+}
+
+type s3Link struct {
+	repo *s3Repository
+	name string
+}
+
+func (l *s3Link) setAttr(key string, value []byte) error {
+	return l.repo.setAttr(l.name, key, value)
+}
+
+func (l *s3Link) commit() error {
+	return nil
+}
+
+func (l *s3Link) rollback() error {
+	return l.repo.del(l.name)
+}
+
+// Reads the data with a ranged GET, sent upon the first read after a seek
+type s3Reader struct {
+	repo   *s3Repository
+	name   string
+	obj    s3Object
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.body == nil {
+		if r.offset >= r.obj.size {
+			return 0, io.EOF
+		}
+		req := r.repo.newRequest("GET", r.name, nil, nil)
+		req.Header.Set("Range", "bytes="+itoa64(r.offset)+"-")
+		// The object may have been replaced since it was opened
+		if r.obj.etag != "" {
+			req.Header.Set("If-Match", r.obj.etag)
+		}
+		rep, err := r.repo.do(req, nil)
+		if err != nil {
+			return 0, err
+		}
+		r.body = rep.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) seek(offset int64) error {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return nil
+}
+
+func (r *s3Reader) Close() error {
+	return r.seek(0)
+}
+
+func (r *s3Reader) File() *os.File {
+	return nil
+}
+
+func (r *s3Reader) size() int64 {
+	return r.obj.size
+}
+
+func (r *s3Reader) mtime() time.Time {
+	return r.obj.mtime
+}
+
+func (r *s3Reader) getAttr(key string, value []byte) (int, error) {
+	return getS3Attr(r.obj.attrs, key, value)
+}
+
+func (r *s3Reader) userMeta() (map[string]string, error) {
+	var meta map[string]string
+	for k, v := range r.obj.attrs {
+		if strings.HasPrefix(k, AttrNameUserMetaPrefix) {
+			if meta == nil {
+				meta = make(map[string]string)
+			}
+			meta[strings.TrimPrefix(k, AttrNameUserMetaPrefix)] = v
+		}
+	}
+	return meta, nil
+}
+
+type s3Writer struct {
+	repo      *s3Repository
+	name      string
+	overwrite bool
+	attrs     map[string]string
+	buf       []byte
+
+	// The multipart upload to the pending object, once the first part is full
+	uploadID  string
+	parts     []string
+	completed bool
+}
+
+func (w *s3Writer) pendingName() string {
+	return w.name + pendingSuffix
+}
+
+func (w *s3Writer) setAttr(key string, value []byte) error {
+	w.attrs[key] = string(value)
+	return nil
+}
+
+// The space of a bucket is not reserved
+func (w *s3Writer) Extend(size int64) {}
+
+func (w *s3Writer) preallocate(size int64) error {
+	return nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := w.repo.partSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p, written = p[n:], written+n
+		if len(w.buf) >= w.repo.partSize {
+			if err := w.sendPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+func (w *s3Writer) sendPart() error {
+	if w.uploadID == "" {
+		query := url.Values{}
+		query.Set("uploads", "")
+		var result s3InitiateResult
+		if err := w.repo.doXML(w.repo.newRequest("POST", w.pendingName(), query, nil), nil, &result); err != nil {
+			return err
+		}
+		w.uploadID = result.UploadID
+	}
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(len(w.parts)+1))
+	query.Set("uploadId", w.uploadID)
+	rep, err := w.repo.do(w.repo.newRequest("PUT", w.pendingName(), query, w.buf), w.buf)
+	if err != nil {
+		return err
+	}
+	rep.Body.Close()
+	w.parts = append(w.parts, rep.Header.Get("ETag"))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3Complete struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+func (w *s3Writer) commit() error {
+	err := w.upload()
+	if err != nil {
+		w.abort()
+	}
+	return err
+}
+
+func (w *s3Writer) upload() error {
+	// A single part, sent at once with its metadata
+	if w.uploadID == "" {
+		req := w.repo.newRequest("PUT", w.name, nil, w.buf)
+		w.repo.setMeta(req, w.attrs)
+		if !w.overwrite {
+			req.Header.Set("If-None-Match", "*")
+		}
+		rep, err := w.repo.do(req, w.buf)
+		if err != nil {
+			return err
+		}
+		rep.Body.Close()
+		return nil
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.sendPart(); err != nil {
+			return err
+		}
+	}
+	complete := s3Complete{}
+	for i, etag := range w.parts {
+		complete.Parts = append(complete.Parts, s3CompletePart{PartNumber: i + 1, ETag: etag})
+	}
+	body, _ := xml.Marshal(complete)
+	query := url.Values{}
+	query.Set("uploadId", w.uploadID)
+	if err := w.repo.doXML(w.repo.newRequest("POST", w.pendingName(), query, body), body, nil); err != nil {
+		return err
+	}
+	w.completed = true
+
+	if !w.overwrite {
+		if _, err := w.repo.head(w.name); err == nil {
+			return os.ErrExist
+		} else if err != os.ErrNotExist {
+			return err
+		}
+	}
+	if err := w.repo.copy(w.pendingName(), w.name, w.attrs); err != nil {
+		return err
+	}
+	// The chunk is in place, a pending object left is only a waste of space
+	rep, err := w.repo.do(w.repo.newRequest("DELETE", w.pendingName(), nil, nil), nil)
+	if err != nil {
+		LogWarning("S3 pending object %s not deleted: %v", w.pendingName(), err)
+	} else {
+		rep.Body.Close()
+	}
+	return nil
+}
+
+func (w *s3Writer) abort() error {
+	var req *http.Request
+	if w.completed {
+		req = w.repo.newRequest("DELETE", w.pendingName(), nil, nil)
+	} else if w.uploadID != "" {
+		query := url.Values{}
+		query.Set("uploadId", w.uploadID)
+		req = w.repo.newRequest("DELETE", w.pendingName(), query, nil)
+	} else {
+		return nil
+	}
+	rep, err := w.repo.do(req, nil)
+	if err == nil {
+		rep.Body.Close()
+	}
+	return err
+}
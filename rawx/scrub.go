@@ -0,0 +1,258 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Slowly walks the volumes in the background, and verifies each chunk the same
+way a VERIFY request does. A corrupted chunk is logged, counted and notified
+with a "storage.chunk.corrupted" event. The scrubber yields to the clients:
+it checks a bounded number of chunks per second, reads a bounded number of
+bytes per second, and pauses while the rawx serves many requests at once.
+The cold chunks of the object storage are left apart, reading them back
+would cost the transfer of the whole data.
+*/
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Number of chunks listed at once by the scrubber
+	scrubPageSize = 1000
+
+	// How long the scrubber waits before it checks the load again
+	scrubBusyDelay = time.Second
+)
+
+// Returned by the reads of a stopped scrubber
+var errScrubStopped = errors.New("Scrubber stopped")
+
+type scrubber struct {
+	rawx *rawxService
+	// The chunks of the local volumes only
+	repo repository
+	// Delay between the verification of two chunks
+	delay time.Duration
+	// Bytes per second read from the volumes, 0 means no limit
+	byteRate float64
+	bytes    tokenBucket
+	// Number of requests in flight from which the scrubber pauses
+	maxInflight int32
+	// Delay between the start of two passes on the volume
+	interval time.Duration
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	lock      sync.Mutex
+	passes    int
+	position  string
+	lastError string
+}
+
+type scrubStatus struct {
+	passes    int
+	position  string
+	lastError string
+}
+
+func newScrubber(rawx *rawxService, rate int, byteRate int64, maxInflight int, interval time.Duration) *scrubber {
+	repo := rawx.repo
+	if cr, ok := repo.(*chunkRepository); ok {
+		repo = cr.local()
+	}
+	return &scrubber{
+		rawx:        rawx,
+		repo:        repo,
+		delay:       time.Second / time.Duration(rate),
+		byteRate:    float64(byteRate),
+		maxInflight: int32(maxInflight),
+		interval:    interval,
+		done:        make(chan struct{}),
+	}
+}
+
+func (s *scrubber) start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			started := time.Now()
+			s.pass()
+			select {
+			case <-s.done:
+				return
+			case <-time.After(time.Until(started.Add(s.interval))):
+			}
+		}
+	}()
+}
+
+func (s *scrubber) stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+func (s *scrubber) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *scrubber) status() scrubStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return scrubStatus{passes: s.passes, position: s.position, lastError: s.lastError}
+}
+
+// Wait before the next chunk, for as long as the rawx is busy. Tell if the
+// scrubber must exit.
+func (s *scrubber) wait() bool {
+	delay := s.delay
+	for {
+		select {
+		case <-s.done:
+			return false
+		case <-time.After(delay):
+		}
+		inflight := s.rawx.readLimit.inflight() + s.rawx.writeLimit.inflight()
+		if s.maxInflight <= 0 || inflight < s.maxInflight {
+			return true
+		}
+		delay = scrubBusyDelay
+	}
+}
+
+// Charge the bytes read, and wait for as long as the scrubber is in debt.
+// Tell if the scrubber must exit.
+func (s *scrubber) charge(n int) bool {
+	if s.byteRate <= 0 || n <= 0 {
+		return true
+	}
+	now := time.Now()
+	s.bytes.refill(s.byteRate, now)
+	s.bytes.tokens -= float64(n)
+	if s.bytes.tokens >= 0 {
+		return true
+	}
+	select {
+	case <-s.done:
+		return false
+	case <-time.After(s.bytes.delay(s.byteRate, 0)):
+		return true
+	}
+}
+
+// Reads a chunk at the pace of the scrubber. The file is hidden, so that all
+// the data goes through Read().
+type scrubReader struct {
+	fileReader
+	s *scrubber
+}
+
+func (r *scrubReader) File() *os.File {
+	return nil
+}
+
+func (r *scrubReader) Read(p []byte) (int, error) {
+	n, err := r.fileReader.Read(p)
+	if !r.s.charge(n) {
+		return n, errScrubStopped
+	}
+	return n, err
+}
+
+// Walk the whole volumes once, unless the scrubber is stopped
+func (s *scrubber) pass() {
+	marker := ""
+	for {
+		chunks, truncated, err := s.repo.list("", marker, scrubPageSize)
+		if err != nil {
+			LogWarning("Scrub listing error: %v", err)
+			s.setError(err)
+			return
+		}
+		for _, c := range chunks {
+			if !s.wait() {
+				return
+			}
+			if err = s.scrubChunk(c.id); err == errScrubStopped {
+				return
+			} else if err != nil && !os.IsNotExist(err) {
+				LogWarning("Scrub error on chunk %s: %v", c.id, err)
+				s.setError(err)
+			}
+			marker = c.id
+			s.lock.Lock()
+			s.position = marker
+			s.lock.Unlock()
+		}
+		if !truncated {
+			break
+		}
+	}
+	s.lock.Lock()
+	s.passes++
+	s.position = ""
+	s.lock.Unlock()
+}
+
+func (s *scrubber) setError(err error) {
+	s.lock.Lock()
+	s.lastError = err.Error()
+	s.lock.Unlock()
+}
+
+func (s *scrubber) scrubChunk(chunkID string) error {
+	rr := &rawxRequest{rawx: s.rawx, chunkID: chunkID, reqid: newRequestID()}
+	chunkIn, err := s.repo.get(chunkID)
+	if err != nil {
+		return err
+	}
+	defer chunkIn.Close()
+
+	if rr.chunk, err = loadAttr(chunkIn, chunkID, rr.reqid); err != nil {
+		return err
+	}
+	rr.patchUnknownSize(chunkIn)
+
+	report, err := verifyChunkData(rr, &scrubReader{fileReader: chunkIn, s: s})
+	if err != nil {
+		return err
+	}
+	if s.stopped() {
+		// The data may have been partially read
+		return errScrubStopped
+	}
+	atomic.AddUint64(&counters.ScrubChecked, 1)
+	if !report.Valid {
+		atomic.AddUint64(&counters.ScrubCorrupted, 1)
+		LogError("Corrupted chunk %s found by the scrubber, expected %s, got %s (reqid=%s)",
+			chunkID, report.ExpectedHash, report.ActualHash, rr.reqid)
+		if s.rawx.notifier != nil {
+			s.rawx.notifier.notifyCorrupted(rr.reqid, rr.chunk)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScrubPass(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+
+	// The data changed behind the rawx
+	putVerifiedChunk(t, rawx, "123456780", map[string]string{
+		AttrNameChunkChecksum: "25F9E794323B453885F5181F1B624D0B",
+	})
+	checked := atomic.LoadUint64(&counters.ScrubChecked)
+	corrupted := atomic.LoadUint64(&counters.ScrubCorrupted)
+
+	s := newScrubber(rawx, 1000, 0, 0, time.Hour)
+	s.pass()
+	if atomic.LoadUint64(&counters.ScrubChecked) != checked+1 ||
+		atomic.LoadUint64(&counters.ScrubCorrupted) != corrupted+1 {
+		t.Error("corrupted chunk not found")
+	}
+	if status := s.status(); status.passes != 1 || status.position != "" || status.lastError != "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// The scrubber pauses while the rawx is busy, and exits when stopped
+	rawx.readLimit.acquire()
+	s = newScrubber(rawx, 1000, 0, 1, time.Hour)
+	s.start()
+	time.Sleep(50 * time.Millisecond)
+	s.stop()
+	rawx.readLimit.release()
+	if atomic.LoadUint64(&counters.ScrubChecked) != checked+1 {
+		t.Error("chunk verified while busy")
+	}
+}
+
+// The cold chunks are never read back from the object storage
+func TestScrubCold(t *testing.T) {
+	s3, _, cleanupS3 := newTestS3Repository(t)
+	defer cleanupS3()
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+	rawx.repo = &chunkRepository{sub: rawx.repo.(*chunkRepository).sub, cold: s3,
+		coldPolicies: map[string]bool{"ARCHIVE": true}}
+
+	out, err := rawx.repo.putPolicy("ARCHIVE", testChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("cold"))
+	out.setAttr(AttrNameChunkChecksum, []byte("0DFA49FD2EB8EA1C3E1AD6E4EC6F51F2"))
+	if err = out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	checked := atomic.LoadUint64(&counters.ScrubChecked)
+	newScrubber(rawx, 1000, 0, 0, time.Hour).pass()
+	if atomic.LoadUint64(&counters.ScrubChecked) != checked {
+		t.Error("cold chunk verified")
+	}
+}
+
+// The bytes read are charged, the scrubber waits while in debt
+func TestScrubRateBytes(t *testing.T) {
+	rawx, cleanup := newTestService(t)
+	defer cleanup()
+
+	s := newScrubber(rawx, 1000, 1000, 0, time.Hour)
+	started := time.Now()
+	if !s.charge(1200) {
+		t.Fatal("scrubber stopped")
+	}
+	if elapsed := time.Since(started); elapsed < 150*time.Millisecond {
+		t.Errorf("no wait after the bytes read: %v", elapsed)
+	}
+	close(s.done)
+	if s.charge(1000) {
+		t.Error("stopped scrubber still charged")
+	}
+}
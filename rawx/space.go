@@ -0,0 +1,106 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tells if the volumes have enough free space to accept new chunks. Each
+// volume is inspected at most once per period, the last verdict is served
+// meanwhile.
+type freeSpaceChecker struct {
+	// Minimum amount of available bytes, 0 to disable the check
+	minBytes uint64
+	// Minimum ratio (in percents) of available space, 0 to disable the check
+	minPercent uint64
+
+	// The state of each volume, by name
+	volumes sync.Map
+}
+
+type volumeSpace struct {
+	throttle PeriodicThrottle
+	// 1 when the last check failed, 0 otherwise
+	full int32
+}
+
+func newFreeSpaceChecker(minBytes int64, minPercent int) *freeSpaceChecker {
+	fs := freeSpaceChecker{}
+	fs.set(minBytes, minPercent)
+	return &fs
+}
+
+// The thresholds may change at runtime, they apply at the next check
+func (fs *freeSpaceChecker) set(minBytes int64, minPercent int) {
+	var b, p uint64
+	if minBytes > 0 {
+		b = uint64(minBytes)
+	}
+	if minPercent > 0 {
+		p = uint64(minPercent)
+	}
+	atomic.StoreUint64(&fs.minBytes, b)
+	atomic.StoreUint64(&fs.minPercent, p)
+}
+
+func (fs *freeSpaceChecker) get() (int64, int) {
+	return int64(atomic.LoadUint64(&fs.minBytes)), int(atomic.LoadUint64(&fs.minPercent))
+}
+
+func (fs *freeSpaceChecker) enabled() bool {
+	minBytes, minPercent := fs.get()
+	return minBytes > 0 || minPercent > 0
+}
+
+// Check the primary volume
+func (fs *freeSpaceChecker) ok(repo repository) bool {
+	return fs.okPolicy(repo, "")
+}
+
+// Check the volume of the chunks of the storage policy. A volume of unknown
+// size, e.g. an object storage, is never full.
+func (fs *freeSpaceChecker) okPolicy(repo repository, policy string) bool {
+	minBytes, minPercent := fs.get()
+	if minBytes <= 0 && minPercent <= 0 {
+		return true
+	}
+	name := repo.volumeOf(policy)
+	v, ok := fs.volumes.Load(name)
+	if !ok {
+		v, _ = fs.volumes.LoadOrStore(name, &volumeSpace{
+			throttle: PeriodicThrottle{period: int64(freeSpaceCheckPeriod)},
+		})
+	}
+	vs := v.(*volumeSpace)
+	if vs.throttle.Ok() {
+		var full int32
+		total, avail, err := repo.statfsPolicy(policy)
+		if err != nil {
+			LogWarning("Failed to check the free space of %s: %v", name, err)
+		} else if total > 0 && (avail < uint64(minBytes) || avail*100 < total*uint64(minPercent)) {
+			full = 1
+		}
+		atomic.StoreInt32(&vs.full, full)
+	}
+	return atomic.LoadInt32(&vs.full) == 0
+}
+
+// How often the free space of the volume is actually checked
+const freeSpaceCheckPeriod = time.Second
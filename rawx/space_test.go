@@ -0,0 +1,42 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+// Each volume is checked on its own, an object storage is never full
+func TestFreeSpacePolicy(t *testing.T) {
+	fr, cleanup := newTestRepository(t)
+	defer cleanup()
+	cold := &s3Repository{endpoint: &url.URL{Scheme: "http", Host: "s3"}, bucket: "bucket"}
+	cr := &chunkRepository{sub: *fr, cold: cold, coldPolicies: map[string]bool{"ARCHIVE": true}}
+
+	// Unreachable thresholds
+	fs := newFreeSpaceChecker(1<<62, 0)
+	if fs.okPolicy(cr, "SINGLE") || fs.ok(cr) {
+		t.Error("full volume accepted")
+	}
+	if !fs.okPolicy(cr, "ARCHIVE") {
+		t.Error("object storage found full")
+	}
+	if cr.volumeOf("SINGLE") != fr.root || cr.volumeOf("ARCHIVE") != "http://s3/bucket" {
+		t.Errorf("unexpected volumes %s %s", cr.volumeOf("SINGLE"), cr.volumeOf("ARCHIVE"))
+	}
+}
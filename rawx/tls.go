@@ -0,0 +1,226 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Builds the TLS configuration of the HTTPS server. The certificate is held by
+a certReloader, so that it can be replaced (e.g. upon SIGHUP) without
+restarting the service: the established connections keep the certificate
+they negotiated, the new ones get the new certificate.
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// The cipher suites that may be configured. The suites of TLS 1.3 are not
+// configurable.
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+var errNoClientCA = errors.New("No valid certificate in the client CA file")
+var errAllowlistNoCA = errors.New("A client allowlist requires a client CA file")
+var errHTTP2CipherSuites = errors.New("HTTP/2 requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Load the certificate from the files. The current certificate is kept if
+// the new one is invalid.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.lock.Unlock()
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	if version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(v), "tls")]; ok {
+		return version, nil
+	}
+	return 0, errors.New("Unknown TLS version: " + v)
+}
+
+func parseCipherSuites(v string) ([]uint16, error) {
+	out := make([]uint16, 0)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		suite, ok := tlsCipherSuites[strings.ToUpper(name)]
+		if !ok {
+			return nil, errors.New("Unknown cipher suite: " + name)
+		}
+		out = append(out, suite)
+	}
+	return out, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errNoClientCA
+	}
+	return pool, nil
+}
+
+// Parse a comma-separated list of the names allowed to connect
+func parseAllowlist(v string) map[string]bool {
+	out := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			out[name] = true
+		}
+	}
+	return out
+}
+
+// Tell if the certificate of the peer, already verified against the client
+// CA, bears one of the allowed names, either as its CN or among its SAN.
+func peerAllowed(state *tls.ConnectionState, allowed map[string]bool) bool {
+	if len(state.PeerCertificates) <= 0 {
+		return false
+	}
+	cert := state.PeerCertificates[0]
+	if allowed[cert.Subject.CommonName] {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if allowed[name] {
+			return true
+		}
+	}
+	for _, name := range cert.EmailAddresses {
+		if allowed[name] {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if allowed[uri.String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP/2 forbids the weak cipher suites and requires one of these with
+// TLS <= 1.2 (RFC 7540, section 9.2.2). Go's HTTPS server refuses to start
+// otherwise, with an error that is far less explicit.
+func checkHTTP2CipherSuites(suites []uint16) error {
+	for _, suite := range suites {
+		if suite == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+			suite == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return nil
+		}
+	}
+	return errHTTP2CipherSuites
+}
+
+// Build the configuration of the HTTPS server from the options
+func newTLSConfig(opts optionsMap) (*tls.Config, *certReloader, error) {
+	cr, err := newCertReloader(opts["tls_cert_file"], opts["tls_key_file"])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: cr.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if v, ok := opts["tls_min_version"]; ok {
+		if cfg.MinVersion, err = parseTLSVersion(v); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if v, ok := opts["tls_cipher_suites"]; ok {
+		if cfg.CipherSuites, err = parseCipherSuites(v); err != nil {
+			return nil, nil, err
+		}
+		if opts.getBool("tls_http2", configDefaultHTTP2) && cfg.MinVersion < tls.VersionTLS13 {
+			if err = checkHTTP2CipherSuites(cfg.CipherSuites); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// Mutual TLS: the clients must present a certificate signed by the CA
+	if v, ok := opts["tls_client_ca_file"]; ok {
+		if cfg.ClientCAs, err = loadCertPool(v); err != nil {
+			return nil, nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if _, ok := opts["tls_client_allow"]; ok {
+		return nil, nil, errAllowlistNoCA
+	}
+
+	return cfg, cr, nil
+}
@@ -0,0 +1,123 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckHTTP2CipherSuites(t *testing.T) {
+	suites, _ := parseCipherSuites("TLS_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	if checkHTTP2CipherSuites(suites) != errHTTP2CipherSuites {
+		t.Error("suites without the one required by HTTP/2 accepted")
+	}
+	suites = append(suites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	if err := checkHTTP2CipherSuites(suites); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// The bodies are streamed both ways over HTTP/2, with their trailers, and
+// through the wrappers that enforce the idle timeouts.
+func TestHTTP2Streaming(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rep http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			rep.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		rc := http.NewResponseController(rep)
+		ir := &idleReader{r: req.Body, rc: rc, idle: time.Second}
+		body, err := ioutil.ReadAll(ir)
+		if err != nil {
+			rep.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rep.Header().Set("Trailer", HeaderNameChunkChecksum)
+		rep.WriteHeader(http.StatusOK)
+		iw := &idleWriter{w: rep, rc: rc, idle: time.Second, step: 4096}
+		iw.ReadFrom(bytes.NewReader(body))
+		rep.Header().Set(HeaderNameChunkChecksum, req.Trailer.Get(HeaderNameChunkChecksum))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("PUT", srv.URL+"/"+testChunkID, pr)
+	req.Trailer = http.Header{HeaderNameChunkChecksum: nil}
+	go func() {
+		for i := 0; i < len(data); i += 65536 {
+			pw.Write(data[i : i+65536])
+		}
+		// Known at the end of the body only
+		req.Trailer.Set(HeaderNameChunkChecksum, "0123456789ABCDEF")
+		pw.Close()
+	}()
+	rep, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rep.Body.Close()
+	if rep.ProtoMajor != 2 || rep.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected reply: %s %s", rep.Proto, rep.Status)
+	}
+	body, err := ioutil.ReadAll(rep.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Error("unexpected body")
+	}
+	if v := rep.Trailer.Get(HeaderNameChunkChecksum); v != "0123456789ABCDEF" {
+		t.Errorf("unexpected trailer %q", v)
+	}
+}
+
+// With an allowlist, only the listed peers are allowed, never the clients of
+// the plain HTTP listener
+func TestClientAllowed(t *testing.T) {
+	rawx := &rawxService{}
+	req := httptest.NewRequest("GET", "/"+testChunkID, nil)
+	if !rawx.clientAllowed(req) {
+		t.Error("plain HTTP refused without allowlist")
+	}
+
+	rawx.clientAllowlist = parseAllowlist("oio-proxy.example.com")
+	if rawx.clientAllowed(req) {
+		t.Error("plain HTTP allowed with an allowlist")
+	}
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+		{Subject: pkix.Name{CommonName: "oio-proxy.example.com"}},
+	}}
+	if !rawx.clientAllowed(req) {
+		t.Error("listed peer refused")
+	}
+	req.TLS.PeerCertificates[0].Subject.CommonName = "other.example.com"
+	if rawx.clientAllowed(req) {
+		t.Error("unlisted peer allowed")
+	}
+}
@@ -17,8 +17,13 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -40,15 +45,25 @@ func init() {
 	}
 }
 
+// Tell if the string is made of hexadecimal digits only. A positive length
+// is also checked. The bytes are checked rather than the runes, so that a
+// multi-byte character cannot alias a digit.
 func isHexaString(name string, length int) bool {
-	var i int
-	var n rune
-	for i, n = range name {
-		if notHexa[byte(n)] {
+	if length > 0 && len(name) != length {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if notHexa[name[i]] {
 			return false
 		}
 	}
-	return length <= 0 || i+1 == length
+	return true
+}
+
+// A valid chunk ID is made of hexadecimal digits only, whatever their case.
+// Thus it can be used as a file name as is: no separator, no "..".
+func isValidChunkID(id string) bool {
+	return isHexaString(id, chunkIDLength)
 }
 
 func hasPrefix(s, prefix string) (string, bool) {
@@ -58,11 +73,131 @@ func hasPrefix(s, prefix string) (string, bool) {
 	return "", false
 }
 
+func hasSuffix(s, suffix string) (string, bool) {
+	if strings.HasSuffix(s, suffix) {
+		return s[:len(s)-len(suffix)], true
+	}
+	return "", false
+}
+
+// etagMatches tells if the value of an If-None-Match header matches the given
+// entity tag, using the weak comparison function.
+func etagMatches(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+		if strings.EqualFold(tag, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashMatches tells if the value of an If-Match header matches the hash of a
+// chunk, using the strong comparison function. The hash may be quoted or not.
+func hashMatches(header, hash string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.Trim(tag, "\"")
+		if hash != "" && strings.EqualFold(tag, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedSince tells if the value of an If-Modified-Since header is not
+// older than the time of the last modification. The header has a precision
+// of a second.
+func notModifiedSince(header string, mtime time.Time) bool {
+	if header == "" {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	return !mtime.Truncate(time.Second).After(since)
+}
+
+// Generate an ID for the requests that carry none
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "-"
+	}
+	return strings.ToUpper(hex.EncodeToString(buf))
+}
+
 func _dslash(s string) bool { return len(s) > 1 && s[0] == '/' && s[1] == '/' }
 func itoa(i int) string     { return strconv.Itoa(i) }
 func utoa(i uint64) string  { return strconv.FormatUint(i, 10) }
 func itoa64(i int64) string { return strconv.FormatInt(i, 10) }
 
+// Caps the number of concurrent operations, 0 means no limit. The current
+// number of operations is counted even without limit.
+// A nil limit never denies anything.
+type concurrencyLimit struct {
+	max     int32
+	current int32
+}
+
+func (l *concurrencyLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	max := atomic.LoadInt32(&l.max)
+	if atomic.AddInt32(&l.current, 1) > max && max > 0 {
+		atomic.AddInt32(&l.current, -1)
+		return false
+	}
+	return true
+}
+
+func (l *concurrencyLimit) release() {
+	if l != nil {
+		atomic.AddInt32(&l.current, -1)
+	}
+}
+
+func (l *concurrencyLimit) inflight() int32 {
+	return atomic.LoadInt32(&l.current)
+}
+
+// The limit may change at runtime, the requests in flight are not affected
+func (l *concurrencyLimit) getMax() int32 {
+	return atomic.LoadInt32(&l.max)
+}
+
+func (l *concurrencyLimit) setMax(max int32) {
+	atomic.StoreInt32(&l.max, max)
+}
+
+// Serializes the operations on a same chunk, with a fixed set of locks
+// shared by all the chunks. The zero value is ready to use.
+type chunkLocks struct {
+	stripes [chunkLockStripes]sync.Mutex
+}
+
+// Lock the chunk, return the function unlocking it
+func (l *chunkLocks) lock(chunkID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(chunkID))
+	m := &l.stripes[h.Sum32()%chunkLockStripes]
+	m.Lock()
+	return m.Unlock
+}
+
 type PeriodicThrottle struct {
 	nanoLast int64
 	period   int64
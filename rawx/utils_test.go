@@ -0,0 +1,117 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2020 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsValidChunkID(t *testing.T) {
+	valid := strings.Repeat("0123456789ABCDEF", 4)
+	cases := []struct {
+		id    string
+		valid bool
+	}{
+		{valid, true},
+		{strings.ToLower(valid), true},
+		{"0123456789abcdef0123456789ABCDEF0123456789aBcDeF0123456789AbCdEf", true},
+		{"", false},
+		{valid[1:], false},
+		{valid + "0", false},
+		{valid[2:] + "..", false},
+		{valid[1:] + "/", false},
+		{"../" + valid[3:], false},
+		{valid[1:] + "G", false},
+		// A multi-byte character must not alias a digit
+		{valid[2:] + "Ł", false},
+	}
+	for _, tc := range cases {
+		if isValidChunkID(tc.id) != tc.valid {
+			t.Errorf("%q: expected valid=%v", tc.id, tc.valid)
+		}
+	}
+}
+
+func TestIsHexaStringAnyLength(t *testing.T) {
+	if !isHexaString("", 0) || !isHexaString("0aF", 0) {
+		t.Error("hexadecimal strings rejected")
+	}
+	if isHexaString("0aG", 0) || isHexaString("", 1) {
+		t.Error("invalid strings accepted")
+	}
+}
+
+func TestHashMatches(t *testing.T) {
+	hash := "0123456789ABCDEF0123456789ABCDEF"
+	for _, header := range []string{hash, `"` + hash + `"`, "*",
+		"0123456789abcdef0123456789abcdef", `"00", "` + hash + `"`} {
+		if !hashMatches(header, hash) {
+			t.Errorf("%s should match", header)
+		}
+	}
+	for _, header := range []string{"", `""`, `W/"` + hash + `"`, "00"} {
+		if hashMatches(header, hash) {
+			t.Errorf("%s should not match", header)
+		}
+	}
+	if hashMatches("", "") || hashMatches(`""`, "") {
+		t.Error("an empty hash should not match")
+	}
+}
+
+func TestNotModifiedSince(t *testing.T) {
+	mtime := time.Date(2020, 3, 4, 5, 6, 7, 500000000, time.UTC)
+	cases := []struct {
+		header      string
+		notModified bool
+	}{
+		{"", false},
+		{"garbage", false},
+		{"Wed, 04 Mar 2020 05:06:07 GMT", true},
+		{"Wed, 04 Mar 2020 05:06:08 GMT", true},
+		{"Wed, 04 Mar 2020 05:06:06 GMT", false},
+	}
+	for _, c := range cases {
+		if notModifiedSince(c.header, mtime) != c.notModified {
+			t.Errorf("%q: expected %v", c.header, c.notModified)
+		}
+	}
+}
+
+// The operations on a same chunk are serialized
+func TestChunkLocks(t *testing.T) {
+	var locks chunkLocks
+	unlock := locks.lock(testChunkID)
+	locked := make(chan struct{})
+	go func() {
+		defer locks.lock(testChunkID)()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("chunk locked twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("chunk still locked")
+	}
+}
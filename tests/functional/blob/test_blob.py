@@ -15,8 +15,9 @@
 # You should have received a copy of the GNU Lesser General Public
 # License along with this library.
 
+import json
 import string
-from os.path import isfile
+from os.path import getsize, isfile
 from hashlib import md5
 from six.moves.urllib_parse import unquote, urlparse
 from oio.common.http import headers_from_object_metadata, HeadersDict
@@ -204,11 +205,22 @@ class RawxTestSuite(CommonTestCase):
                          resp.getheader('x-oio-chunk-meta-chunk-hash'))
         self.assertEqual(chunk_size,
                          resp.getheader('x-oio-chunk-meta-chunk-size'))
+        # The size on disk, after a potential compression
+        self.assertEqual(chunk_size,
+                         resp.getheader('x-oio-chunk-clear-size'))
+        self.assertEqual(str(getsize(chunkpath)),
+                         resp.getheader('x-oio-chunk-stored-size'))
 
         # the first PUT succeeded, the second MUST fail
         resp, body = self._http_request(chunkurl, 'PUT', chunkdata, headers,
                                         trailers)
         self.assertEqual(409, resp.status)
+        # ... unless the client explicitly asked for a new chunk
+        explicit = dict(headers)
+        explicit['If-None-Match'] = '*'
+        resp, body = self._http_request(chunkurl, 'PUT', chunkdata, explicit,
+                                        trailers)
+        self.assertEqual(412, resp.status)
         if not self._compression():
             # check the file if is correct
             with open(chunkpath, 'rb') as chunkf:
@@ -216,10 +228,11 @@ class RawxTestSuite(CommonTestCase):
                 self.assertEqual(data, chunkdata)
 
         # check the whole download is correct
-        # TODO FIXME getting an empty content should return 204
+        # An empty content is served with "200 OK", not "204 No Content"
         resp, body = self._http_request(chunkurl, 'GET', '', {})
         self.assertEqual(200, resp.status)
         self.assertEqual(body, chunkdata)
+        self.assertEqual(str(length), resp.getheader('content-length'))
         self.assertEqual(fullpath,
                          resp.getheader('x-oio-chunk-meta-full-path'))
         headers.pop('x-oio-chunk-meta-full-path')
@@ -251,12 +264,33 @@ class RawxTestSuite(CommonTestCase):
             self.assertEqual(resp.status // 100, 2)
             self.assertEqual(len(body), end-start+1)
             self.assertEqual(body, chunkdata[start:end+1])
+            if resp.status == 206:
+                self.assertEqual(
+                    'bytes {0}-{1}/{2}'.format(start, end, length),
+                    resp.getheader('content-range'))
+        # check suffix ranges can be downloaded
+        if length > 0:
+            for suffix in set([1, length]):
+                r = "bytes=-{0}".format(suffix)
+                resp, body = self._http_request(chunkurl, 'GET', '',
+                                                {'Range': r})
+                self.assertEqual(206, resp.status)
+                self.assertEqual(body, chunkdata[-suffix:])
+            # check open-ended ranges can be downloaded
+            for start in set([0, length - 1]):
+                r = "bytes={0}-".format(start)
+                resp, body = self._http_request(chunkurl, 'GET', '',
+                                                {'Range': r})
+                self.assertEqual(206, resp.status)
+                self.assertEqual(body, chunkdata[start:])
         if length > 0:
             # TODO FIXME getting an unsatisfiable range on an empty content
             # returns "200 OK" with an empty body, but should return 416
             r = "bytes={0}-{1}".format(length, length+1)
             resp, body = self._http_request(chunkurl, 'GET', '', {'Range': r})
             self.assertEqual(416, resp.status)
+            self.assertEqual('bytes */{0}'.format(length),
+                             resp.getheader('content-range'))
 
         # verify chunk checksum
         resp, body = self._http_request(chunkurl, 'HEAD', '',
@@ -273,6 +307,22 @@ class RawxTestSuite(CommonTestCase):
     def test_empty_chunk(self):
         self._cycle_put(0, 201)
 
+    def test_empty_chunk_HEAD(self):
+        chunkid = random_chunk_id()
+        chunkurl = self._rawx_url(chunkid)
+        headers = self._chunk_attr(chunkid, b'')
+        trailers = {'x-oio-chunk-meta-metachunk-size': '0',
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        resp, _ = self._http_request(chunkurl, 'PUT', b'', headers, trailers)
+        self.assertEqual(201, resp.status)
+        for method in ('HEAD', 'GET'):
+            resp, body = self._http_request(chunkurl, method, '', {})
+            self.assertEqual(200, resp.status)
+            self.assertEqual(b'', body)
+            self.assertEqual('0', resp.getheader('content-length'))
+            self.assertEqual('0',
+                             resp.getheader('x-oio-chunk-meta-chunk-size'))
+
     def test_small_chunks(self):
         for i in [1, 2, 3, 4, 32, 64, 128, 256, 512]:
             self._cycle_put(i, 201)
@@ -321,6 +371,8 @@ class RawxTestSuite(CommonTestCase):
     def _check_not_present(self, chunkurl):
         resp, body = self._http_request(chunkurl, 'GET', '', {})
         self.assertEqual(404, resp.status)
+        resp, body = self._http_request(chunkurl, 'HEAD', '', {})
+        self.assertEqual(404, resp.status)
         resp, body = self._http_request(chunkurl, 'DELETE', '', {})
         self.assertEqual(404, resp.status)
 
@@ -367,10 +419,136 @@ class RawxTestSuite(CommonTestCase):
             32, bad_trailers={'x-oio-chunk-meta-chunk-hash':
                               'AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA'})
 
+    def test_chunkhash_trailer(self):
+        length = 32
+        chunkid = random_chunk_id()
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        chunkurl = self._rawx_url(chunkid)
+        headers = self._chunk_attr(chunkid, chunkdata)
+        chunk_hash = headers.pop('x-oio-chunk-meta-chunk-hash')
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+
+        # A mismatch aborts the upload, nothing is committed
+        trailers['x-oio-chunk-meta-chunk-hash'] = md5(b'other').hexdigest()
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata,
+                                     dict(headers), trailers)
+        self.assertEqual(400, resp.status)
+        self._check_not_present(chunkurl)
+
+        # The header and the trailer must agree
+        mixed = dict(headers)
+        mixed['x-oio-chunk-meta-chunk-hash'] = md5(b'other').hexdigest()
+        trailers['x-oio-chunk-meta-chunk-hash'] = chunk_hash
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, mixed,
+                                     trailers)
+        self.assertEqual(400, resp.status)
+        self._check_not_present(chunkurl)
+
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata,
+                                     dict(headers), trailers)
+        self.assertEqual(201, resp.status)
+        self.assertEqual(chunk_hash.upper(),
+                         resp.getheader('x-oio-chunk-meta-chunk-hash'))
+        resp, body = self._http_request(chunkurl, 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(chunkdata, body)
+        self.assertEqual(chunk_hash.upper(),
+                         resp.getheader('x-oio-chunk-meta-chunk-hash'))
+
     def test_bad_chunkid(self):
         self._check_bad_headers(
             32, bad_headers={'x-oio-chunk-meta-chunk-id': '00'*32})
 
+    def test_HEAD_absent_chunk(self):
+        chunkurl = self._rawx_url(random_chunk_id())
+        resp, body = self._http_request(chunkurl, 'HEAD', '', {})
+        self.assertEqual(404, resp.status)
+        resp, body = self._http_request(
+            chunkurl, 'HEAD', '', {'x-oio-check-hash': True})
+        self.assertEqual(404, resp.status)
+
+    def test_OPTIONS_chunk(self):
+        chunkurl = self._rawx_url(random_chunk_id())
+        resp, body = self._http_request(chunkurl, 'OPTIONS', '', {})
+        self.assertEqual(204, resp.status)
+        allowed = [m.strip() for m in resp.getheader('allow').split(',')]
+        for method in ('PUT', 'COPY', 'HEAD', 'GET', 'DELETE'):
+            self.assertIn(method, allowed)
+
+    def test_method_not_allowed(self):
+        chunkurl = self._rawx_url(random_chunk_id())
+        resp, body = self._http_request(chunkurl, 'POST', '', {})
+        self.assertEqual(405, resp.status)
+        allowed = [m.strip() for m in resp.getheader('allow').split(',')]
+        self.assertIn('GET', allowed)
+        self.assertIn('PUT', allowed)
+
+        resp, body = self._http_request(self._rawx_url('info'), 'POST', '',
+                                        {})
+        self.assertEqual(405, resp.status)
+        self.assertEqual('GET, HEAD', resp.getheader('allow'))
+
+    def test_info(self):
+        resp, body = self._http_request(self._rawx_url('info'), 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        info = dict(line.split(' ', 1)
+                    for line in body.decode('utf-8').splitlines())
+        for key in ('namespace', 'path', 'volume_total', 'volume_used',
+                    'volume_free', 'compression', 'checksum_algo',
+                    'buffer_size', 'inflight_reads', 'inflight_writes',
+                    'fsync_file', 'fsync_dir'):
+            self.assertIn(key, info)
+        self.assertEqual(int(info['volume_total']),
+                         int(info['volume_used']) + int(info['volume_free']))
+
+    def test_health(self):
+        for path in ('health', 'ready'):
+            resp, body = self._http_request(self._rawx_url(path), 'GET', '',
+                                            {})
+            self.assertEqual(200, resp.status)
+            self.assertEqual(b'ok\n', body)
+
+    def test_request_id(self):
+        chunkurl = self._rawx_url(random_chunk_id())
+        resp, body = self._http_request(chunkurl, 'GET', '',
+                                        {'X-oio-req-id': 'test-reqid'})
+        self.assertEqual(404, resp.status)
+        self.assertEqual('test-reqid', resp.getheader('x-oio-req-id'))
+
+        # An ID is generated when the client sends none
+        resp, body = self._http_request(chunkurl, 'GET', '', {})
+        self.assertEqual(404, resp.status)
+        self.assertTrue(resp.getheader('x-oio-req-id'))
+
+    def test_metrics(self):
+        chunkurl = self._rawx_url(random_chunk_id())
+        self._http_request(chunkurl, 'GET', '', {})
+        resp, body = self._http_request(self._rawx_url('metrics'), 'GET', '',
+                                        {})
+        self.assertEqual(200, resp.status)
+        self.assertTrue(
+            resp.getheader('content-type').startswith('text/plain'))
+        lines = body.decode('utf-8').splitlines()
+        self.assertIn('# TYPE rawx_request_duration_seconds histogram', lines)
+        self.assertTrue(
+            any(l.startswith('rawx_replies_total{code="404"} ')
+                for l in lines))
+
+    def test_expect_continue_rejected(self):
+        # A pre-flight failure is replied without "100 Continue",
+        # the body is never sent.
+        chunkid = random_chunk_id()
+        chunkurl = self._rawx_url(chunkid)
+        parsed = urlparse(chunkurl)
+        conn = http_connect(parsed.netloc, 'PUT', parsed.path,
+                            {'Expect': '100-continue',
+                             'Content-Length': '1024'})
+        resp = conn.getresponse()
+        self.assertEqual(400, resp.status)
+        conn.close()
+        self._check_not_present(chunkurl)
+
     def test_chunkid_lowercase(self):
         self._cycle_put(32, 201, chunkid_lowercase=True)
 
@@ -508,6 +686,79 @@ class RawxTestSuite(CommonTestCase):
         resp, _ = self._http_request(chunkurl1, 'COPY', '', headers)
         self.assertEqual(403, resp.status)
 
+    def test_copy_compressed(self):
+        # Compressible data, thus compressed if the rawx is configured so
+        chunkdata = b'0123456789' * 1000
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(len(chunkdata)),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        chunkid = random_chunk_id()
+        chunkurl = self._rawx_url(chunkid)
+        headers = self._chunk_attr(chunkid, chunkdata)
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+        self.assertTrue(resp.getheader('Location').endswith('/' + chunkid))
+        if self._compression():
+            self.assertLess(getsize(self._chunk_path(chunkid)),
+                            len(chunkdata))
+
+        copyid = random_chunk_id()
+        copyurl = self._rawx_url(copyid)
+        headers = {'Destination': copyurl,
+                   'x-oio-chunk-meta-full-path': encode_fullpath(
+                       "account-snapshot", "container-snapshot",
+                       "content-snapshot", 1456938361143741, random_id(32))}
+        resp, _ = self._http_request(chunkurl, 'COPY', '', headers)
+        self.assertEqual(201, resp.status)
+        self.assertTrue(resp.getheader('Location').endswith('/' + copyid))
+
+        resp, body = self._http_request(copyurl, 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(chunkdata, body)
+        self.assertEqual(md5(chunkdata).hexdigest().upper(),
+                         resp.getheader('x-oio-chunk-meta-chunk-hash'))
+        self.assertEqual(str(len(chunkdata)),
+                         resp.getheader('x-oio-chunk-meta-chunk-size'))
+
+    def test_copy_range(self):
+        length = 100
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        chunkid = random_chunk_id()
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        chunkurl = self._rawx_url(chunkid)
+        headers = self._chunk_attr(chunkid, chunkdata)
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+
+        copyid = random_chunk_id()
+        copyurl = self._rawx_url(copyid)
+        headers = {'Destination': copyurl,
+                   'x-oio-chunk-meta-full-path': encode_fullpath(
+                       "account-snapshot", "container-snapshot",
+                       "content-snapshot", 1456938361143741, random_id(32))}
+        headers['X-oio-Copy-Source-Range'] = 'bytes=200-300'
+        resp, _ = self._http_request(chunkurl, 'COPY', '', headers)
+        self.assertEqual(416, resp.status)
+        headers['X-oio-Copy-Source-Range'] = 'bytes=10-19'
+        resp, _ = self._http_request(chunkurl, 'COPY', '', headers)
+        self.assertEqual(201, resp.status)
+
+        resp, body = self._http_request(copyurl, 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(chunkdata[10:20], body)
+        self.assertEqual(md5(chunkdata[10:20]).hexdigest().upper(),
+                         resp.getheader('x-oio-chunk-meta-chunk-hash'))
+        self.assertEqual('10', resp.getheader('x-oio-chunk-meta-chunk-size'))
+        self.assertEqual(headers['x-oio-chunk-meta-full-path'],
+                         resp.getheader('x-oio-chunk-meta-full-path'))
+
+        # The source is left untouched
+        resp, body = self._http_request(chunkurl, 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(chunkdata, body)
+
     def test_copy_with_existing_destination(self):
         metachunk_hash = md5().hexdigest()
         trailers = {'x-oio-chunk-meta-metachunk-size': '1',
@@ -849,6 +1100,349 @@ class RawxTestSuite(CommonTestCase):
         del meta3['oio_version']
         self.assertDictEqual(meta1, meta3)
 
+    def test_multiple_ranges(self):
+        length = 100
+        chunkid = random_chunk_id()
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        chunkurl = self._rawx_url(chunkid)
+        headers = self._chunk_attr(chunkid, chunkdata)
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+
+        resp, body = self._http_request(chunkurl, 'GET', '',
+                                        {'Range': 'bytes=0-9,20-29'})
+        if self._compression():
+            # The whole chunk is served instead
+            self.assertEqual(200, resp.status)
+            self.assertEqual(chunkdata, body)
+        else:
+            self.assertEqual(206, resp.status)
+            ctype = resp.getheader('content-type')
+            self.assertTrue(ctype.startswith('multipart/byteranges'))
+            self.assertIn(b'Content-Range: bytes 0-9/100', body)
+            self.assertIn(chunkdata[0:10], body)
+            self.assertIn(b'Content-Range: bytes 20-29/100', body)
+            self.assertIn(chunkdata[20:30], body)
+
+        # Ranges covering the whole chunk are served as a whole
+        resp, body = self._http_request(chunkurl, 'GET', '',
+                                        {'Range': 'bytes=0-49,50-99'})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(chunkdata, body)
+
+    def test_conditional_GET(self):
+        length = 100
+        chunkid = random_chunk_id()
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        chunkurl = self._rawx_url(chunkid)
+        headers = self._chunk_attr(chunkid, chunkdata)
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+
+        etag = '"%s"' % md5(chunkdata).hexdigest().upper()
+        resp, body = self._http_request(chunkurl, 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(etag, resp.getheader('etag'))
+        self.assertEqual(chunkdata, body)
+
+        resp, body = self._http_request(chunkurl, 'GET', '',
+                                        {'Range': 'bytes=0-9'})
+        self.assertEqual(206, resp.status)
+        self.assertEqual(etag, resp.getheader('etag'))
+
+        resp, body = self._http_request(chunkurl, 'GET', '',
+                                        {'If-None-Match': etag})
+        self.assertEqual(304, resp.status)
+        self.assertEqual(b'', body)
+
+        resp, body = self._http_request(chunkurl, 'GET', '',
+                                        {'If-None-Match': '"0123", ' + etag})
+        self.assertEqual(304, resp.status)
+
+        resp, body = self._http_request(chunkurl, 'GET', '',
+                                        {'If-None-Match': '"0123"'})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(chunkdata, body)
+
+    def test_GET_with_trailers(self):
+        length = 100
+        chunkid = random_chunk_id()
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        chunkurl = self._rawx_url(chunkid)
+        headers = self._chunk_attr(chunkid, chunkdata)
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+
+        # The computed checksum is announced as a trailer, the reply is
+        # then chunked (http.client silently drops the trailers).
+        resp, body = self._http_request(chunkurl, 'GET', '',
+                                        {'TE': 'trailers'})
+        self.assertEqual(200, resp.status)
+        self.assertEqual('x-oio-chunk-computed-hash',
+                         resp.getheader('trailer').lower())
+        self.assertIsNone(resp.getheader('content-length'))
+        self.assertEqual(chunkdata, body)
+
+        # No trailer on range downloads
+        resp, body = self._http_request(chunkurl, 'GET', '',
+                                        {'TE': 'trailers',
+                                         'Range': 'bytes=0-9'})
+        self.assertEqual(206, resp.status)
+        self.assertIsNone(resp.getheader('trailer'))
+
+    def test_PATCH_chunk(self):
+        length = 100
+        chunkid = random_chunk_id()
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        chunkurl = self._rawx_url(chunkid)
+        resp, _ = self._http_request(chunkurl, 'PATCH', '',
+                                     {'x-oio-chunk-meta-chunk-pos': '1'})
+        self.assertEqual(404, resp.status)
+
+        headers = self._chunk_attr(chunkid, chunkdata)
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+
+        # Nothing to update
+        resp, _ = self._http_request(chunkurl, 'PATCH', '', {})
+        self.assertEqual(400, resp.status)
+
+        resp, _ = self._http_request(chunkurl, 'PATCH', '',
+                                     {'x-oio-chunk-meta-chunk-pos': '1'})
+        self.assertEqual(204, resp.status)
+
+        # The metadata changed, not the data
+        resp, body = self._http_request(chunkurl, 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(chunkdata, body)
+        self.assertEqual('1', resp.getheader('x-oio-chunk-meta-chunk-pos'))
+        self.assertEqual(headers['x-oio-chunk-meta-chunk-hash'].upper(),
+                         resp.getheader('x-oio-chunk-meta-chunk-hash'))
+
+    def test_bulk_delete(self):
+        length = 10
+        present = random_chunk_id()
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        headers = self._chunk_attr(present, chunkdata)
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        resp, _ = self._http_request(self._rawx_url(present), 'PUT',
+                                     chunkdata, headers, trailers)
+        self.assertEqual(201, resp.status)
+        absent = random_chunk_id()
+
+        parsed = urlparse(self._rawx_url('delete'))
+        data = json.dumps([present, absent, 'XYZ']).encode('utf-8')
+        conn = http_connect(parsed.netloc, 'POST', parsed.path,
+                            {'Content-Length': str(len(data))})
+        conn.send(data)
+        resp = conn.getresponse()
+        body = resp.read()
+        conn.close()
+        self.assertEqual(200, resp.status)
+        self.assertDictEqual({present: 'deleted',
+                              absent: 'not-found',
+                              'XYZ': 'invalid'},
+                             json.loads(body.decode('utf-8')))
+        self._check_not_present(self._rawx_url(present))
+
+    def test_list(self):
+        length = 10
+        chunkid = random_chunk_id()
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        headers = self._chunk_attr(chunkid, chunkdata)
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        resp, _ = self._http_request(self._rawx_url(chunkid), 'PUT',
+                                     chunkdata, headers, trailers)
+        self.assertEqual(201, resp.status)
+
+        resp, body = self._http_request(
+            self._rawx_url('list?prefix=' + chunkid[:40]), 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        listing = json.loads(body.decode('utf-8'))
+        self.assertEqual([chunkid], listing['chunks'])
+        self.assertFalse(listing['truncated'])
+        self.assertNotIn('metadata', listing)
+
+        resp, body = self._http_request(
+            self._rawx_url('list?meta=size,fullpath&prefix=' + chunkid),
+            'GET', '', {})
+        self.assertEqual(200, resp.status)
+        meta = json.loads(body.decode('utf-8'))['metadata'][chunkid]
+        self.assertEqual(self.fullpath, meta['fullpath'])
+        self.assertIn('size', meta)
+        resp, _ = self._http_request(self._rawx_url('list?meta=owner'),
+                                     'GET', '', {})
+        self.assertEqual(400, resp.status)
+
+        resp, body = self._http_request(
+            self._rawx_url('list?prefix=%s&marker=%s' % (chunkid[:40],
+                                                         chunkid)),
+            'GET', '', {})
+        self.assertEqual(200, resp.status)
+        self.assertEqual([], json.loads(body.decode('utf-8'))['chunks'])
+
+        resp, _ = self._http_request(self._rawx_url('list?prefix=XYZ'),
+                                     'GET', '', {})
+        self.assertEqual(400, resp.status)
+        resp, _ = self._http_request(self._rawx_url('list?marker=0123'),
+                                     'GET', '', {})
+        self.assertEqual(400, resp.status)
+
+    def test_content_type(self):
+        length = 10
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        for mime_type, expected in ((None, 'application/octet-stream'),
+                                    ('text/plain', 'text/plain')):
+            chunkid = random_chunk_id()
+            chunkurl = self._rawx_url(chunkid)
+            headers = self._chunk_attr(chunkid, chunkdata)
+            if mime_type:
+                headers['x-oio-chunk-meta-content-mime-type'] = mime_type
+            resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers,
+                                         trailers)
+            self.assertEqual(201, resp.status)
+            for method in ('HEAD', 'GET'):
+                resp, _ = self._http_request(chunkurl, method, '', {})
+                self.assertEqual(200, resp.status)
+                self.assertEqual(expected, resp.getheader('Content-Type'))
+
+        chunkid = random_chunk_id()
+        headers = self._chunk_attr(chunkid, chunkdata)
+        headers['x-oio-chunk-meta-content-mime-type'] = 'not a type'
+        resp, _ = self._http_request(self._rawx_url(chunkid), 'PUT',
+                                     chunkdata, headers, trailers)
+        self.assertEqual(400, resp.status)
+
+    def test_GET_if_modified_since(self):
+        length = 10
+        chunkid = random_chunk_id()
+        chunkurl = self._rawx_url(chunkid)
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        headers = self._chunk_attr(chunkid, chunkdata)
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+
+        resp, body = self._http_request(chunkurl, 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        last_modified = resp.getheader('Last-Modified')
+        self.assertTrue(last_modified)
+
+        resp, _ = self._http_request(chunkurl, 'GET', '',
+                                     {'If-Modified-Since': last_modified})
+        self.assertEqual(304, resp.status)
+        resp, body = self._http_request(
+            chunkurl, 'GET', '',
+            {'If-Modified-Since': 'Thu, 01 Jan 1970 00:00:00 GMT'})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(chunkdata, body)
+
+    def test_DELETE_if_match(self):
+        length = 10
+        chunkid = random_chunk_id()
+        chunkurl = self._rawx_url(chunkid)
+        chunkdata = random_buffer(string.printable, length).encode('utf-8')
+        headers = self._chunk_attr(chunkid, chunkdata)
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+
+        resp, _ = self._http_request(chunkurl, 'DELETE', '',
+                                     {'If-Match': md5().hexdigest()})
+        self.assertEqual(412, resp.status)
+        resp, _ = self._http_request(chunkurl, 'HEAD', '', {})
+        self.assertEqual(200, resp.status)
+
+        resp, _ = self._http_request(
+            chunkurl, 'DELETE', '', {'If-Match': md5(chunkdata).hexdigest()})
+        self.assertEqual(204, resp.status)
+        self._check_not_present(chunkurl)
+
+    def test_PUT_if_match(self):
+        length = 10
+        chunkid = random_chunk_id()
+        chunkurl = self._rawx_url(chunkid)
+        trailers = {'x-oio-chunk-meta-metachunk-size': str(9 * length),
+                    'x-oio-chunk-meta-metachunk-hash': md5().hexdigest()}
+        olddata = random_buffer(string.printable, length).encode('utf-8')
+        newdata = random_buffer(string.printable, length).encode('utf-8')
+
+        # Nothing to replace yet
+        headers = self._chunk_attr(chunkid, olddata)
+        headers['If-Match'] = '*'
+        resp, _ = self._http_request(chunkurl, 'PUT', olddata, headers,
+                                     trailers)
+        self.assertEqual(412, resp.status)
+        del headers['If-Match']
+        resp, _ = self._http_request(chunkurl, 'PUT', olddata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+
+        headers = self._chunk_attr(chunkid, newdata)
+        headers['If-Match'] = md5(newdata).hexdigest()
+        resp, _ = self._http_request(chunkurl, 'PUT', newdata, headers,
+                                     trailers)
+        self.assertEqual(412, resp.status)
+        headers['If-Match'] = md5(olddata).hexdigest()
+        resp, _ = self._http_request(chunkurl, 'PUT', newdata, headers,
+                                     trailers)
+        self.assertEqual(201, resp.status)
+
+        resp, body = self._http_request(chunkurl, 'GET', '', {})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(newdata, body)
+
+    def test_too_many_headers(self):
+        chunkid = random_chunk_id()
+        chunkurl = self._rawx_url(chunkid)
+        headers = self._chunk_attr(chunkid, b'')
+        for i in range(200):
+            headers['x-junk-%d' % i] = 'junk'
+        resp, _ = self._http_request(chunkurl, 'PUT', b'', headers)
+        self.assertEqual(431, resp.status)
+        self._check_not_present(chunkurl)
+
+    def test_VERIFY_chunk(self):
+        chunkid = random_chunk_id()
+        chunkdata = random_buffer(string.printable, 100).encode('utf-8')
+        chunkurl = self._rawx_url(chunkid)
+        headers = self._chunk_attr(chunkid, chunkdata)
+        resp, _ = self._http_request(chunkurl, 'PUT', chunkdata, headers)
+        self.assertEqual(201, resp.status)
+
+        resp, body = self._http_request(chunkurl, 'VERIFY', '', {})
+        self.assertEqual(200, resp.status)
+        report = json.loads(body)
+        self.assertTrue(report['valid'])
+        self.assertEqual(md5(chunkdata).hexdigest().upper(),
+                         report['actual_hash'])
+
+        with open(self._chunk_path(chunkid), "wb") as fp:
+            fp.write(b'chunk is dead')
+        resp, body = self._http_request(chunkurl, 'VERIFY', '', {})
+        self.assertEqual(422, resp.status)
+        self.assertFalse(json.loads(body)['valid'])
+
     def test_HEAD_chunk(self):
         length = 100
         chunkid = random_chunk_id()
@@ -869,6 +1463,12 @@ class RawxTestSuite(CommonTestCase):
         # default HEAD
         resp, body = self._http_request(chunkurl, 'HEAD', "", {})
         self.assertEqual(200, resp.status)
+        # The identity of the chunk can be audited without the data
+        self.assertEqual(headers['x-oio-chunk-meta-chunk-hash'].upper(),
+                         resp.getheader('x-oio-chunk-meta-chunk-hash'))
+        self.assertEqual(headers['x-oio-chunk-meta-full-path'],
+                         resp.getheader('x-oio-chunk-meta-full-path'))
+        self.assertEqual(str(length), resp.getheader('content-length'))
 
         # Check the hash
         resp, body = self._http_request(
@@ -937,5 +1537,10 @@ class RawxTestSuite(CommonTestCase):
             chunkurl_woattr, 'HEAD', "",
             {'X-oio-check-hash': "true",
              REQID_HEADER: request_id('test_HEAD_chunk')})
-        # If the size xattr is missing, we cannot read the chunk
+        # If the hash xattr is missing, we cannot check the chunk
         self.assertEqual(500, resp.status)
+        # But the metadata still can be queried
+        resp, body = self._http_request(chunkurl_woattr, 'HEAD', "", {})
+        self.assertEqual(200, resp.status)
+        self.assertEqual(str(len(b"without xattrs")),
+                         resp.getheader('content-length'))
@@ -197,7 +197,7 @@ grid_fsync_dir         ${FSYNC}
 # Preallocate space for the chunk file (enabled by default)
 #grid_fallocate enabled
 
-# Enable compression ('zlib' or 'lzo' or 'off')
+# Enable compression ('zlib', 'deflate', 'lzw', 'zstd', 'lz4' or 'off')
 grid_compression ${COMPRESSION}
 
 #tcp_keepalive disabled
@@ -857,6 +857,9 @@ pipeline = volume_index ${PRESERVE}
 [handler:storage.chunk.deleted]
 pipeline = volume_index ${PRESERVE}
 
+[handler:storage.chunk.corrupted]
+pipeline = ${PRESERVE}
+
 [handler:storage.meta2.deleted]
 pipeline = volume_index ${PRESERVE}
 